@@ -0,0 +1,569 @@
+package hex2img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// layout is the grid of blocks an image is divided into, optionally
+// surrounded by a border that is border blocks wide. Blocks are pixelSize
+// pixels wide and blockHeight pixels high.
+type layout struct {
+	blocksPerRow int
+	rows         int
+	pixelSize    int
+	blockHeight  int
+	columnMajor  bool
+	border       int
+
+	// rowWidths, when set, holds the width of each row, the last repeating,
+	// and blocksPerRow that of the widest.
+	rowWidths []int
+}
+
+// size returns the image dimensions in pixels.
+func (l layout) size() (width, height int) {
+	return (l.blocksPerRow + 2*l.border) * l.pixelSize, (l.rows + 2*l.border) * l.blockHeight
+}
+
+// rowWidth returns the number of blocks in a row.
+func (l layout) rowWidth(row int) int {
+	if len(l.rowWidths) == 0 {
+		return l.blocksPerRow
+	}
+	return l.rowWidths[min(row, len(l.rowWidths)-1)]
+}
+
+// rowStart returns the index of the first block of a row.
+func (l layout) rowStart(row int) int {
+	if len(l.rowWidths) == 0 {
+		return row * l.blocksPerRow
+	}
+	start := 0
+	for _, w := range l.rowWidths[:min(row, len(l.rowWidths))] {
+		start += w
+	}
+	if extra := row - len(l.rowWidths); extra > 0 {
+		start += extra * l.rowWidths[len(l.rowWidths)-1]
+	}
+	return start
+}
+
+// cells returns the number of blocks the grid has room for.
+func (l layout) cells() int {
+	return l.rowStart(l.rows)
+}
+
+// borderColor marks the border around the grid. Decoding finds the grid
+// by looking for it, so the first block must not have this color.
+var borderColor = color.NRGBA{R: 0xff, B: 0xff, A: 0xff}
+
+// drawWorkers is the number of goroutines drawImage splits the rows
+// between, one per CPU. Benchmarks set it to 1 to compare.
+var drawWorkers = runtime.NumCPU()
+
+// drawImage lays out data as blocks on a new image. Runs of whole rows
+// worth of blocks are split between drawWorkers goroutines; since blocks
+// never overlap, no two goroutines write the same pixel.
+func drawImage(data []byte, l layout, opts Options) draw.Image {
+	defer func(start time.Time) { opts.timing("draw", time.Since(start)) }(time.Now())
+	width, height := l.size()
+	var img draw.Image
+	switch r := image.Rect(0, 0, width, height); {
+	case opts.Gray && opts.Depth16:
+		img = image.NewGray16(r)
+	case opts.Gray, opts.Robust:
+		img = image.NewGray(r)
+	case opts.Depth16:
+		img = image.NewNRGBA64(r)
+	default:
+		// NRGBA keeps the alpha channel independent of the color channels,
+		// so RGBA blocks store their bytes unmodified.
+		img = image.NewNRGBA(r)
+	}
+	if l.border > 0 {
+		draw.Draw(img, img.Bounds(), image.NewUniform(borderColor), image.Point{}, draw.Src)
+	}
+
+	blockCount := opts.blockCount(len(data))
+	rowsPerWorker := (l.rows + drawWorkers - 1) / drawWorkers
+	pad := padColor(opts)
+	p := newProgress(opts.Progress, l.cells())
+
+	var wg sync.WaitGroup
+	for first := 0; first < l.rows; first += rowsPerWorker {
+		wg.Add(1)
+		go func(first, last int) {
+			defer wg.Done()
+			for row := first; row < last; row++ {
+				start, end := l.rowStart(row), l.rowStart(row+1)
+				for b := start; b < end; b++ {
+					c := pad
+					if b < blockCount {
+						c = blockAt(data, b, opts)
+					}
+					drawBlock(img, b, l, c)
+				}
+				p.add(end - start)
+			}
+		}(first, min(first+rowsPerWorker, l.rows))
+	}
+	wg.Wait()
+	return img
+}
+
+// progress reports drawn blocks to an Options.Progress callback, one call
+// at a time. A nil progress reports nothing.
+type progress struct {
+	fn    func(done, total int)
+	total int
+
+	mu   sync.Mutex
+	done int
+}
+
+func newProgress(fn func(done, total int), total int) *progress {
+	if fn == nil {
+		return nil
+	}
+	return &progress{fn: fn, total: total}
+}
+
+func (p *progress) add(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	p.fn(p.done, p.total)
+}
+
+// blockAt returns the color of block b of data.
+func blockAt(data []byte, b int, opts Options) color.Color {
+	if opts.Robust {
+		return color.Gray{Y: packedValue(data, b, robustBits) * robustStep}
+	}
+	if opts.Bits > 0 {
+		return bitsColor(data, b, opts.Bits)
+	}
+	return blockColor(data, b*opts.bytesPerBlock(), opts)
+}
+
+// bitsBase is the gray whose blue channel bit-packed blocks store their
+// bits in.
+const bitsBase = 0x80
+
+// bitsColor returns the color of block b of data in bit-packed mode: the
+// bits, in the low bits of a gray block's blue.
+func bitsColor(data []byte, b, bits int) color.NRGBA {
+	mask := byte(1<<bits - 1)
+	return color.NRGBA{R: bitsBase, G: bitsBase, B: bitsBase&^mask | packedValue(data, b, bits), A: 0xff}
+}
+
+// packedValue returns the bits of block b of data when every block holds
+// that many bits, most significant first. Bits past the end of data are 0.
+func packedValue(data []byte, b, bits int) byte {
+	v := byte(0)
+	for i := b * bits; i < (b+1)*bits; i++ {
+		v <<= 1
+		if i/8 < len(data) {
+			v |= data[i/8] >> (7 - i%8) & 1
+		}
+	}
+	return v
+}
+
+// robustBits is the number of bits of a robust block, and robustStep the
+// difference between the gray levels of consecutive values.
+const (
+	robustBits = 4
+	robustStep = 255 / (1<<robustBits - 1)
+)
+
+// robustValue returns the value of the robust block covering r: the level
+// most of its pixels are closest to, which outvotes the ringing lossy
+// compression leaves near its edges.
+func robustValue(img image.Image, r image.Rectangle) uint {
+	var votes [1 << robustBits]int
+	r = r.Intersect(img.Bounds())
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			votes[(int(grayAt(img, px, py))+robustStep/2)/robustStep]++
+		}
+	}
+	best := 0
+	for v, n := range votes {
+		if n > votes[best] {
+			best = v
+		}
+	}
+	return uint(best)
+}
+
+// blockColor returns the color of the block starting at data[i] in the
+// block mode selected by opts.
+func blockColor(data []byte, i int, opts Options) color.Color {
+	if opts.Palette != nil {
+		return opts.Palette[data[i]]
+	}
+	if opts.Depth16 {
+		if opts.Gray {
+			return color.Gray16{Y: getChannel16(data, i, opts.LittleEndian)}
+		}
+		return getColor16(data, i, opts.Alpha, opts.LittleEndian)
+	}
+	if opts.Gray {
+		return color.Gray{Y: data[i]}
+	}
+	c, _ := getColor(data, i, opts.Alpha)
+	return c
+}
+
+// padColor is the color of the unused blocks that complete the last row or
+// column: the background if one is set, else the color of a block of fill
+// bytes. Leaving them undrawn would make them transparent in RGB mode. They
+// are never read as data, since the length header says where the data ends.
+func padColor(opts Options) color.Color {
+	if opts.Background != nil {
+		return opts.Background
+	}
+	return blockAt(bytes.Repeat([]byte{opts.Fill}, opts.bytesPerBlock()), 0, opts)
+}
+
+// getColor builds the color of the block starting at data[i] and returns
+// it with the number of bytes of data it holds, which is less than a whole
+// block only at the end of data. Channels past the end of data are
+// zero-filled; without alpha the block is opaque.
+func getColor(data []byte, i int, alpha bool) (c color.NRGBA, n int) {
+	var b [4]byte
+	if alpha {
+		n = copy(b[:], data[i:])
+		return color.NRGBA{b[0], b[1], b[2], b[3]}, n
+	}
+	n = copy(b[:3], data[i:])
+	return color.NRGBA{b[0], b[1], b[2], 255}, n
+}
+
+// getColor16 is getColor for 16-bit channels, each made of two bytes in
+// big-endian order, or little-endian if little is set.
+func getColor16(data []byte, i int, alpha, little bool) color.NRGBA64 {
+	c := color.NRGBA64{
+		R: getChannel16(data, i, little),
+		G: getChannel16(data, i+2, little),
+		B: getChannel16(data, i+4, little),
+		A: 0xffff,
+	}
+	if alpha {
+		c.A = getChannel16(data, i+6, little)
+	}
+	return c
+}
+
+// getChannel16 reads a 16-bit channel from data[i:], zero-filling bytes
+// past the end of data.
+func getChannel16(data []byte, i int, little bool) uint16 {
+	var hi, lo uint16
+	if i < len(data) {
+		hi = uint16(data[i])
+	}
+	if i+1 < len(data) {
+		lo = uint16(data[i+1])
+	}
+	if little {
+		hi, lo = lo, hi
+	}
+	return hi<<8 | lo
+}
+
+func drawBlock(img draw.Image, blockIndex int, l layout, c color.Color) {
+	x, y := getBlockPosition(blockIndex, l)
+	for dy := 0; dy < l.blockHeight; dy++ {
+		for dx := 0; dx < l.pixelSize; dx++ {
+			img.Set(x+dx, y+dy, c)
+		}
+	}
+}
+
+// drawGrid draws a 1px line in c along the inner edges between blocks. A
+// line between rows of different widths spans the wider one.
+func drawGrid(img draw.Image, l layout, c color.Color) {
+	offX, offY := l.border*l.pixelSize, l.border*l.blockHeight
+	for row := range l.rows {
+		top := offY + row*l.blockHeight
+		width := l.rowWidth(row)*l.pixelSize + offX
+		for x := offX + l.pixelSize; x < width; x += l.pixelSize {
+			for y := top; y < top+l.blockHeight; y++ {
+				img.Set(x, y, c)
+			}
+		}
+		if row == 0 {
+			continue
+		}
+		width = max(l.rowWidth(row), l.rowWidth(row-1))*l.pixelSize + offX
+		for x := offX; x < width; x++ {
+			img.Set(x, top, c)
+		}
+	}
+}
+
+// getBlockPosition returns the top-left pixel of a block on the grid.
+func getBlockPosition(blockIndex int, l layout) (x, y int) {
+	col, row := blockIndex%l.blocksPerRow, blockIndex/l.blocksPerRow
+	switch {
+	case l.columnMajor:
+		col, row = blockIndex/l.rows, blockIndex%l.rows
+	case len(l.rowWidths) > 0:
+		col, row = l.locate(blockIndex)
+	}
+	return (col + l.border) * l.pixelSize, (row + l.border) * l.blockHeight
+}
+
+// locate returns the column and row of a block on a grid of rows of the
+// given widths.
+func (l layout) locate(blockIndex int) (col, row int) {
+	for r, w := range l.rowWidths {
+		if blockIndex < w {
+			return blockIndex, r
+		}
+		blockIndex -= w
+	}
+	last := l.rowWidths[len(l.rowWidths)-1]
+	return blockIndex % last, len(l.rowWidths) + blockIndex/last
+}
+
+// cropToBorder finds the border drawn around the grid in img, which may
+// itself be part of a larger picture, and returns the grid inside it. The
+// outer edge is the bounding box of all border colored pixels. Walking
+// diagonally from its top-left corner leads past the border into the
+// blocks, from where the border is as wide as the way left to it and as
+// high as the way up to it, which differ for non-square blocks. Most
+// formats draw the border of gray images in the luminance of the border
+// color, which their palette, if any, need not map it to, so that gray is
+// a border too.
+func cropToBorder(img image.Image, gray bool) (image.Image, error) {
+	marker := color.NRGBAModel.Convert(img.ColorModel().Convert(borderColor))
+	grayMarker := marker
+	if gray {
+		grayMarker = color.NRGBAModel.Convert(color.GrayModel.Convert(borderColor))
+	}
+	isBorder := func(x, y int) bool {
+		c := color.NRGBAModel.Convert(img.At(x, y))
+		return c == marker || c == grayMarker
+	}
+
+	b := img.Bounds()
+	box := image.Rectangle{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if isBorder(x, y) {
+				box = box.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if box.Empty() {
+		return nil, fmt.Errorf("no border found")
+	}
+
+	t := 0
+	for box.Min.X+t < box.Max.X && box.Min.Y+t < box.Max.Y && isBorder(box.Min.X+t, box.Min.Y+t) {
+		t++
+	}
+	tx, ty := t, t
+	for tx > 0 && !isBorder(box.Min.X+tx-1, box.Min.Y+t) {
+		tx--
+	}
+	for ty > 0 && !isBorder(box.Min.X+t, box.Min.Y+ty-1) {
+		ty--
+	}
+	inner := image.Rect(box.Min.X+tx, box.Min.Y+ty, box.Max.X-tx, box.Max.Y-ty)
+	if inner.Empty() {
+		return nil, fmt.Errorf("border encloses no blocks")
+	}
+
+	return cropImage(img, inner)
+}
+
+// hasBorder reports whether the top-left pixel of img has exactly the
+// border color, or with gray its luminance, as in images written with a
+// border. Without one the first block holds the magic signature, which is
+// neither.
+func hasBorder(img image.Image, gray bool) bool {
+	b := img.Bounds()
+	if b.Empty() {
+		return false
+	}
+	c := color.NRGBAModel.Convert(img.At(b.Min.X, b.Min.Y))
+	return c == borderColor || gray && c == color.NRGBAModel.Convert(color.GrayModel.Convert(borderColor))
+}
+
+// cropImage returns the part of img inside r.
+func cropImage(img image.Image, r image.Rectangle) (image.Image, error) {
+	sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		return nil, fmt.Errorf("cannot crop %T", img)
+	}
+	return sub.SubImage(r), nil
+}
+
+// readBlocks samples the center pixel of every block, in the block order
+// of the grid, so that images shifted or padded by a few pixels still
+// decode. Robust blocks are read from all of their pixels instead. Partial
+// blocks at the right and bottom edges are ignored.
+func readBlocks(img image.Image, l layout, opts Options) []byte {
+	b := img.Bounds()
+	if b.Dx()%l.pixelSize != 0 || b.Dy()%l.blockHeight != 0 {
+		opts.warnf("image size %dx%d is not a multiple of the block size %dx%d, ignoring partial blocks", b.Dx(), b.Dy(), l.pixelSize, l.blockHeight)
+	}
+
+	var data []byte
+	var bits uint
+	nbits := 0
+	for i := range l.cells() {
+		x, y := getBlockPosition(i, l)
+		if n := opts.packedBits(); n > 0 {
+			// Bits collect until they make a whole byte
+			if opts.Robust {
+				bits = bits<<n | robustValue(img, image.Rect(x, y, x+l.pixelSize, y+l.blockHeight).Add(b.Min))
+			} else {
+				mask := byte(1<<n - 1)
+				bits = bits<<n | uint(nrgbaAt(img, b.Min.X+x+l.pixelSize/2, b.Min.Y+y+l.blockHeight/2).B&mask)
+			}
+			for nbits += n; nbits >= 8; nbits -= 8 {
+				data = append(data, byte(bits>>(nbits-8)))
+			}
+			continue
+		}
+		x, y = b.Min.X+x+l.pixelSize/2, b.Min.Y+y+l.blockHeight/2
+		if opts.Palette != nil {
+			data = append(data, byte(opts.Palette.Index(img.At(x, y))))
+			continue
+		}
+		if opts.Depth16 {
+			data = appendColor16(data, img.At(x, y), opts)
+			continue
+		}
+		if opts.Gray {
+			data = append(data, grayAt(img, x, y))
+			continue
+		}
+		c := nrgbaAt(img, x, y)
+		data = append(data, c.R, c.G, c.B)
+		if opts.Alpha {
+			data = append(data, c.A)
+		}
+	}
+
+	return data
+}
+
+// appendColor16 appends the 16-bit channels of c to data. The channels
+// are read at full precision rather than narrowed to 8 bits.
+func appendColor16(data []byte, c color.Color, opts Options) []byte {
+	if opts.Gray {
+		y := color.Gray16Model.Convert(c).(color.Gray16).Y
+		return appendChannel16(data, y, opts.LittleEndian)
+	}
+	n := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	for _, v := range []uint16{n.R, n.G, n.B} {
+		data = appendChannel16(data, v, opts.LittleEndian)
+	}
+	if opts.Alpha {
+		data = appendChannel16(data, n.A, opts.LittleEndian)
+	}
+	return data
+}
+
+// appendChannel16 appends the two bytes of a 16-bit channel to data in the
+// order getChannel16 reads them.
+func appendChannel16(data []byte, v uint16, little bool) []byte {
+	if little {
+		return binary.LittleEndian.AppendUint16(data, v)
+	}
+	return binary.BigEndian.AppendUint16(data, v)
+}
+
+// grayAt returns the gray level at (x, y), reading the pixel buffer
+// directly for gray images.
+func grayAt(img image.Image, x, y int) byte {
+	if m, ok := img.(*image.Gray); ok {
+		return m.Pix[m.PixOffset(x, y)]
+	}
+	return color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y
+}
+
+// nrgbaAt returns the non-premultiplied color at (x, y). NRGBA images and
+// opaque pixels of RGBA images are read from the pixel buffer directly,
+// which avoids an interface call and a 16-bit round trip per block.
+func nrgbaAt(img image.Image, x, y int) color.NRGBA {
+	switch m := img.(type) {
+	case *image.NRGBA:
+		p := m.Pix[m.PixOffset(x, y):]
+		return color.NRGBA{R: p[0], G: p[1], B: p[2], A: p[3]}
+	case *image.RGBA:
+		if p := m.Pix[m.PixOffset(x, y):]; p[3] == 0xff {
+			return color.NRGBA{R: p[0], G: p[1], B: p[2], A: p[3]}
+		}
+	}
+	// Converting to NRGBA undoes the alpha premultiplication of RGBA()
+	// before the channels are narrowed to 8 bits.
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+// resolvePixelSize validates opts.PixelSize, detecting it from img when it
+// is 0.
+func resolvePixelSize(img image.Image, opts Options) (int, error) {
+	if opts.PixelSize == 0 {
+		return detectPixelSize(img, opts), nil
+	}
+	return opts.PixelSize, validatePixelSize(opts.PixelSize)
+}
+
+// detectPixelSize derives the block size from the top-left region of img.
+// Block edges lie on multiples of the pixel size, so it is the greatest
+// common divisor of every offset at which the color changes between
+// neighbouring pixels. A region without edges falls back to the image
+// dimensions.
+func detectPixelSize(img image.Image, opts Options) int {
+	const region = 256
+
+	b := img.Bounds()
+	size := 0
+	maxX, maxY := min(b.Max.X, b.Min.X+region), min(b.Max.Y, b.Min.Y+region)
+	for y := b.Min.Y; y < maxY && size != 1; y++ {
+		for x := b.Min.X; x < maxX && size != 1; x++ {
+			c := img.At(x, y)
+			if x > b.Min.X && c != img.At(x-1, y) {
+				size = gcd(size, x-b.Min.X)
+			}
+			if y > b.Min.Y && c != img.At(x, y-1) {
+				size = gcd(size, y-b.Min.Y)
+			}
+		}
+	}
+
+	if size == 0 {
+		size = gcd(b.Dx(), b.Dy())
+	}
+	if size <= 1 {
+		opts.warnf("could not detect the pixel size, assuming 1")
+		return 1
+	}
+	return size
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,78 @@
+package hex2img
+
+import (
+	"image/color"
+	"runtime"
+	"testing"
+)
+
+func TestGetColorTail(t *testing.T) {
+	data := []byte{0x10, 0x20, 0x30, 0x40, 0x50, 0x60}
+	for _, tc := range []struct {
+		tail  int
+		alpha bool
+		want  color.NRGBA
+	}{
+		{1, false, color.NRGBA{0x40, 0x00, 0x00, 0xff}},
+		{2, false, color.NRGBA{0x40, 0x50, 0x00, 0xff}},
+		{3, false, color.NRGBA{0x40, 0x50, 0x60, 0xff}},
+		{1, true, color.NRGBA{0x40, 0x00, 0x00, 0x00}},
+		{3, true, color.NRGBA{0x40, 0x50, 0x60, 0x00}},
+	} {
+		// The last block starts at offset 3, holding tail bytes of data
+		got, n := getColor(data[:3+tc.tail], 3, tc.alpha)
+		if got != tc.want || n != tc.tail {
+			t.Errorf("tail of %d bytes, alpha %v: got %v holding %d bytes, want %v", tc.tail, tc.alpha, got, n, tc.want)
+		}
+	}
+
+	// A whole block holds no more than its channels
+	if _, n := getColor(data, 0, false); n != 3 {
+		t.Errorf("RGB block holds %d bytes, want 3", n)
+	}
+	if _, n := getColor(data, 0, true); n != 4 {
+		t.Errorf("RGBA block holds %d bytes, want 4", n)
+	}
+}
+
+func TestGetColor16Tail(t *testing.T) {
+	data := []byte{0x12, 0x34, 0x56}
+	got := getColor16(data, 0, false, false)
+	if want := (color.NRGBA64{0x1234, 0x5600, 0x0000, 0xffff}); got != want {
+		t.Errorf("big-endian: got %v, want %v", got, want)
+	}
+	got = getColor16(data, 0, false, true)
+	if want := (color.NRGBA64{0x3412, 0x0056, 0x0000, 0xffff}); got != want {
+		t.Errorf("little-endian: got %v, want %v", got, want)
+	}
+}
+
+// BenchmarkDrawImage draws 10 MB of blocks serially and split between the
+// CPUs, to show what drawing in parallel gains.
+func BenchmarkDrawImage(b *testing.B) {
+	data := make([]byte, 10<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	opts := Options{PixelSize: 1, Square: true}
+	stream, l, err := pack(data, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, bench := range []struct {
+		name    string
+		workers int
+	}{
+		{"10MB/serial", 1},
+		{"10MB/parallel", runtime.NumCPU()},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			defer func(n int) { drawWorkers = n }(drawWorkers)
+			drawWorkers = bench.workers
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				drawImage(stream, l, opts)
+			}
+		})
+	}
+}
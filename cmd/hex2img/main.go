@@ -0,0 +1,2014 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/706f6c6c7578/hex2img"
+)
+
+// version and buildDate are set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.buildDate=2024-01-02"
+var (
+	version   = "dev"
+	buildDate = ""
+)
+
+// passEnv is the environment variable read for the -e passphrase when -pass
+// is not given, which keeps it off the command line.
+const passEnv = "HEX2IMG_PASS"
+
+// input describes how the text to encode is read.
+type input struct {
+	enc      textEncoding
+	tile     int  // times the payload is repeated
+	comments bool // whether # and // start comments in hex
+
+	// reading, when set, adds up the time spent waiting for the input
+	reading *time.Duration
+}
+
+// textEncoding is how the payload is written as text on the input of encode
+// and the output of decode.
+type textEncoding int
+
+const (
+	encodingHex textEncoding = iota
+	// encodingPaddedHex is hex whose input is left-padded with a zero digit
+	// when it has an odd length.
+	encodingPaddedHex
+	encodingBase64
+	// encodingBase32 is padded base32, whose input may omit the padding
+	// and be in either case.
+	encodingBase32
+	encodingRaw
+	// encodingHexDump is the output of xxd or hexdump -C on input and of
+	// hexdump -C on output.
+	encodingHexDump
+)
+
+func main() {
+	decode := flag.Bool("d", false, "Decode an image to hex (the format is detected unless given)")
+	blocksPerRow := flag.Int("b", 0, "Number of blocks per row (0 to choose from -square)")
+	maxDim := flag.Int("maxdim", 32768, "Refuse to encode images wider or taller than this many pixels (0 for no limit)")
+	maxWidth := flag.Int("maxwidth", 0, "Fit as many blocks per row as an image this many pixels wide holds (instead of -b)")
+	rowLayout := flag.String("layout", "", "Lay the blocks out in rows of these comma-separated numbers of blocks, the last repeating (instead of -b); PNGs record it for decoding")
+	rows := flag.Int("rows", 0, "Lay the blocks out in this many rows, or fewer when the last ones would be empty (instead of -b)")
+	square := flag.Bool("square", true, "With -b 0, lay blocks out in a square instead of a single row")
+	columnMajor := flag.Bool("col", false, "Fill blocks top to bottom, then left to right")
+	useSVG := flag.Bool("v", false, "Use SVG format instead of PNG")
+	pixelSize := flag.Int("s", hex2img.DefaultPixelSize, "Pixel size of each block (0 to detect it when decoding)")
+	blockWidth := flag.Int("bw", 0, "Block width in pixels, instead of -s")
+	blockHeight := flag.Int("bh", 0, "Block height in pixels, for non-square blocks (0 for the block width)")
+	scale := flag.Int("scale", 0, "Render an SVG this many times larger without changing its blocks; when decoding, the factor an image was enlarged by (0 to detect it for PNG)")
+	alpha := flag.Bool("a", false, "Store 4 bytes per block as RGBA instead of 3 as RGB")
+	gray := flag.Bool("g", false, "Store 1 byte per block as a gray level")
+	depth16 := flag.Bool("16", false, "Store two bytes per channel in a 16-bit PNG, doubling the bytes per block")
+	endian := flag.String("endian", "big", "Byte order of the two bytes in each -16 channel: big or little")
+	bits := flag.Int("bits", 0, "Store this many bits (1-8) per block in the low bits of a gray block's blue channel")
+	robust := flag.Bool("robust", false, "Store 4 bits per block as one of 16 gray levels read by majority vote, to survive lossy JPEG at a pixel size that is a multiple of 8")
+	palettePath := flag.String("palette", "", "Store 1 byte per block as a color from this file of 256 #rrggbb lines")
+	useJPEG := flag.Bool("j", false, "Use lossy JPEG format instead of PNG")
+	useGIF := flag.Bool("gif", false, "Use GIF format instead of PNG (at most 256 distinct block colors)")
+	useBMP := flag.Bool("bmp", false, "Use BMP format instead of PNG")
+	useTIFF := flag.Bool("tiff", false, "Use uncompressed TIFF format instead of PNG")
+	useWebP := flag.Bool("webp", false, "Use lossless WebP format instead of PNG")
+	useTerm := flag.Bool("term", false, "Preview the blocks as colored text on the terminal instead of writing an image")
+	quality := flag.Int("q", jpeg.DefaultQuality, "JPEG quality (1-100)")
+	level := flag.String("level", "default", "PNG compression level: default, none, speed or best")
+	interlace := flag.Bool("interlace", false, "Write an Adam7 interlaced PNG for progressive display (decoding needs no flag)")
+	caption := flag.String("caption", "", "Store this note, such as the source file name, in a PNG as its Description")
+	showMeta := flag.Bool("showmeta", false, "Print the key and value of every tEXt chunk of a PNG, such as its -caption, instead of decoding it")
+	checksum := flag.Bool("c", false, "Append a CRC32 checksum on encode and verify it on decode")
+	diff := flag.Bool("diff", false, "Compare the blocks of the two images given as arguments and print those that differ")
+	verify := flag.Bool("verify", false, "Decode with -c and only print OK or FAIL, exiting with a nonzero status on failure")
+	labels := flag.Bool("labels", false, "Write the stream offset of every block, counting the signature and length header, on an SVG (decoding ignores it)")
+	grid := flag.Bool("grid", false, "Draw lines between blocks of a PNG (for inspection only, cannot be decoded)")
+	gridColor := flag.String("gridcolor", "#808080", "Color of the -grid lines as #rrggbb")
+	ecc := flag.Int("ecc", 0, "Add this many Reed-Solomon parity blocks per 255 blocks to repair up to half as many corrupted ones; the image records it, unless written with -noheader")
+	border := flag.Int("border", 0, "Surround the blocks with this many blocks of magenta; when decoding, any value above 0 finds the blocks inside such a border, which is otherwise only found around a whole image")
+	fill := flag.String("fill", "00", "Hex byte filling the unused part of the last block and row")
+	bg := flag.String("bg", "", "Color the unused blocks completing the last row as #rrggbb instead of as -fill bytes")
+	strict := flag.Bool("strict", false, "When decoding, fail on images without the hex2img signature instead of warning")
+	noHeader := flag.Bool("noheader", false, "Leave out the hex2img signature, as in images from older versions")
+	compress := flag.Bool("z", false, "Gzip the payload before encoding and gunzip it after decoding")
+	encrypt := flag.Bool("e", false, "Encrypt the payload with AES-256-GCM on encode and decrypt it on decode")
+	pass := flag.String("pass", "", "Passphrase for -e (default $"+passEnv+")")
+	scrambleSeed := flag.String("scramble", "", "Shuffle the payload bytes by a permutation derived from this seed on encode and restore them with the same seed on decode (obfuscation, not encryption)")
+	useBase64 := flag.Bool("base64", false, "Read and write the payload as base64 instead of hex")
+	useBase32 := flag.Bool("base32", false, "Read and write the payload as base32 instead of hex (input may be lowercase or unpadded)")
+	noComments := flag.Bool("nocomments", false, "Keep # and // in hex input instead of skipping them to the end of the line as comments")
+	pad := flag.Bool("pad", false, "Left-pad hex input of odd length with a zero digit")
+	raw := flag.Bool("raw", false, "Read and write the payload as raw bytes instead of hex")
+	hexDump := flag.Bool("hexdump", false, "Read the payload as the output of xxd or hexdump -C and write it like hexdump -C")
+	tile := flag.Int("t", 1, "Repeat the input this many times before encoding it, to make large test images")
+	dedup := flag.Bool("dedup", false, "Decode a payload of repeats of the same bytes, as written with -t, to a single copy")
+	check := flag.Bool("check", false, "After encoding, decode the image in memory and warn if it does not give back the input")
+	stats := flag.Bool("stats", false, "Print the distinct block colors, most common byte and entropy of the payload on stderr after encoding")
+	info := flag.Bool("info", false, "Print the dimensions and estimated size of the image instead of encoding it")
+	bench := flag.Bool("bench", false, "Print the time taken to read, decode, pack, draw and encode the input on stderr")
+	showProgress := flag.Bool("progress", false, "Show the share of blocks drawn on stderr while encoding")
+	hexArg := flag.String("hex", "", "Encode these hex digits instead of reading the payload from stdin or files")
+	inPath := flag.String("i", "", "Read input from file instead of stdin")
+	imageURL := flag.String("url", "", "Decode the image at this http or https URL instead of stdin")
+	clip := flag.Bool("clip", false, "Decode the image on the clipboard instead of stdin (needs pngpaste on macOS, wl-paste or xclip elsewhere)")
+	outPath := flag.String("o", "", "Write output to file instead of stdout")
+	useJSON := flag.Bool("json", false, "Decode to a JSON object holding the hex payload, its length and the image layout")
+	noNewline := flag.Bool("n", false, "Do not write a newline after the decoded hex or base64")
+	outDir := flag.String("outdir", "", "Decode each part of an image made from several files into its own file in this directory")
+	flag.StringVar(outDir, "split", "", "Same as -outdir")
+	configPath := flag.String("config", "", "Read default flag values from this file instead of ~/"+configName)
+	relayout := flag.Int("relayout", 0, "Decode the input image and write it again in the same format and pixel size with this many blocks per row")
+	appendPath := flag.String("append", "", "Decode this image and write one in its format and layout holding its payload followed by the input")
+	preview := flag.String("preview", "", "Also write a contrast-enhanced PNG of larger blocks with grid lines to this file, for inspection only")
+	goSrc := flag.Bool("gosrc", false, "Write Go source declaring the bytes of every block of the image instead of the image")
+	splitSize := flag.String("split-size", "", "Split an image larger than WxH pixels into a sequence of images at most that large, numbered like out.000.png after -o; decode them by giving all of them as arguments")
+	hashName := flag.Bool("hashname", false, "Write the image to the directory given by -o, named after the SHA-256 of its content, and print its path on stderr")
+	selfTest := flag.Bool("selftest", false, "Encode and decode random bytes in the chosen format, or every format, and print PASS or FAIL")
+	crop := flag.String("crop", "", "Decode only the rectangle x,y,w,h of the image, in pixels from its top-left corner")
+	quiet := flag.Bool("quiet", false, "Do not print warnings; errors are still printed")
+	help := flag.Bool("h", false, "Show help")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	paths := parseArgs(os.Args[1:])
+	if err := applyConfig(*configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *showVersion {
+		printVersion()
+		os.Exit(0)
+	}
+
+	if *help || len(os.Args) == 1 {
+		printUsage()
+		os.Exit(0)
+	}
+
+	if *verify {
+		*decode, *checksum = true, true
+	}
+	if *diff || *showMeta {
+		*decode = true
+	}
+
+	defaultFormat := hex2img.FormatPNG
+	if *decode || *appendPath != "" || *relayout != 0 {
+		defaultFormat = hex2img.FormatAuto
+	}
+	f, err := selectFormat(defaultFormat, map[hex2img.Format]bool{
+		hex2img.FormatSVG:  *useSVG,
+		hex2img.FormatJPEG: *useJPEG,
+		hex2img.FormatGIF:  *useGIF,
+		hex2img.FormatBMP:  *useBMP,
+		hex2img.FormatTIFF: *useTIFF,
+		hex2img.FormatWebP: *useWebP,
+		hex2img.FormatANSI: *useTerm,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *alpha && *gray {
+		fmt.Fprintln(os.Stderr, "Error: -a and -g cannot be combined")
+		os.Exit(1)
+	}
+
+	passphrase := *pass
+	if passphrase == "" {
+		passphrase = os.Getenv(passEnv)
+	}
+	if *encrypt && passphrase == "" {
+		fmt.Fprintf(os.Stderr, "Error: -e needs a passphrase from -pass or $%s\n", passEnv)
+		os.Exit(1)
+	}
+	if !*encrypt {
+		passphrase = ""
+	}
+
+	pngLevel, ok := map[string]png.CompressionLevel{
+		"default": png.DefaultCompression,
+		"none":    png.NoCompression,
+		"speed":   png.BestSpeed,
+		"best":    png.BestCompression,
+	}[*level]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown -level %q\n", *level)
+		os.Exit(1)
+	}
+
+	if *endian != "big" && *endian != "little" {
+		fmt.Fprintf(os.Stderr, "Error: -endian must be big or little, got %q\n", *endian)
+		os.Exit(1)
+	}
+
+	fillByte, err := hex.DecodeString(*fill)
+	if err != nil || len(fillByte) != 1 {
+		fmt.Fprintf(os.Stderr, "Error: -fill must be a single hex byte, got %q\n", *fill)
+		os.Exit(1)
+	}
+
+	var palette color.Palette
+	if *palettePath != "" {
+		if palette, err = loadPalette(*palettePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	gc, err := parseHexColor(*gridColor)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -gridcolor: %v\n", err)
+		os.Exit(1)
+	}
+
+	var background color.Color
+	if *bg != "" {
+		if background, err = parseHexColor(*bg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -bg: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var rowWidths []int
+	if *rowLayout != "" {
+		if rowWidths, err = parseLayout(*rowLayout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -layout: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var splitWidth, splitHeight int
+	if *splitSize != "" {
+		if splitWidth, splitHeight, err = parseSize(*splitSize); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -split-size: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var cropRect image.Rectangle
+	if *crop != "" {
+		if cropRect, err = parseCrop(*crop); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -crop: %v\n", err)
+			os.Exit(1)
+		}
+		if !*decode {
+			fmt.Fprintln(os.Stderr, "Error: -crop can only be given when decoding")
+			os.Exit(1)
+		}
+	}
+
+	if *blockWidth > 0 {
+		*pixelSize = *blockWidth
+	}
+
+	opts := hex2img.Options{
+		BlocksPerRow:   *blocksPerRow,
+		MaxWidth:       *maxWidth,
+		Rows:           *rows,
+		RowWidths:      rowWidths,
+		MaxDim:         *maxDim,
+		Square:         *square,
+		ColumnMajor:    *columnMajor,
+		PixelSize:      *pixelSize,
+		BlockHeight:    *blockHeight,
+		Scale:          *scale,
+		Alpha:          *alpha,
+		Gray:           *gray,
+		Palette:        palette,
+		Depth16:        *depth16,
+		LittleEndian:   *endian == "little",
+		Bits:           *bits,
+		Robust:         *robust,
+		Format:         f,
+		Quality:        *quality,
+		PNGCompression: pngLevel,
+		Interlace:      *interlace,
+		Caption:        *caption,
+		Checksum:       *checksum,
+		Grid:           *grid,
+		Labels:         *labels,
+		GridColor:      gc,
+		Compress:       *compress,
+		ECC:            *ecc,
+		Fill:           fillByte[0],
+		Background:     background,
+		Border:         *border,
+		Crop:           cropRect,
+		NoMagic:        *noHeader,
+		Strict:         *strict,
+		Passphrase:     passphrase,
+		Scramble:       *scrambleSeed,
+		Warnings:       os.Stderr,
+	}
+	if *quiet {
+		opts.Warnings = io.Discard
+	}
+
+	if *showProgress && !*decode {
+		opts.Progress = progressPrinter(os.Stderr)
+	}
+	if *bench {
+		if *decode || *info || *selfTest {
+			fmt.Fprintln(os.Stderr, "Error: -bench can only be given when encoding, and not together with -info or -selftest")
+			os.Exit(1)
+		}
+		opts.Timings = timingPrinter(os.Stderr)
+	}
+
+	var enc textEncoding
+	switch {
+	case countSet(*useBase64, *useBase32, *raw, *hexDump) > 1:
+		fmt.Fprintln(os.Stderr, "Error: only one of -base64, -base32, -raw and -hexdump may be given")
+		os.Exit(1)
+	case *pad && (*useBase64 || *useBase32 || *raw || *hexDump):
+		fmt.Fprintln(os.Stderr, "Error: -pad only applies to hex input")
+		os.Exit(1)
+	case *useBase64:
+		enc = encodingBase64
+	case *useBase32:
+		enc = encodingBase32
+	case *raw:
+		enc = encodingRaw
+	case *hexDump:
+		enc = encodingHexDump
+	case *pad:
+		enc = encodingPaddedHex
+	}
+
+	if *diff {
+		if len(paths) != 2 {
+			fmt.Fprintln(os.Stderr, "Error: -diff needs exactly two images")
+			os.Exit(1)
+		}
+		differ, err := diffImages(os.Stdout, paths[0], paths[1], opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error comparing: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		if differ {
+			os.Exit(1)
+		}
+		return
+	}
+
+	in := input{enc: enc, tile: *tile, comments: !*noComments}
+
+	if *selfTest {
+		formats := []hex2img.Format{opts.Format}
+		if *decode || opts.Format == hex2img.FormatPNG {
+			formats = []hex2img.Format{
+				hex2img.FormatPNG, hex2img.FormatSVG, hex2img.FormatJPEG, hex2img.FormatGIF,
+				hex2img.FormatBMP, hex2img.FormatTIFF, hex2img.FormatWebP,
+			}
+		}
+		if !runSelfTest(os.Stdout, formats, opts) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// A single input file is read like -i; several are joined
+	if len(paths) == 1 && *inPath == "" {
+		*inPath, paths = paths[0], nil
+	}
+	if len(paths) > 0 && (*inPath != "" || *decode && (*imageURL != "" || *clip || *showMeta || *verify)) {
+		fmt.Fprintln(os.Stderr, "Error: several input files cannot be given together with -i, and when decoding a sequence of images not with -url, -clip, -showmeta or -verify")
+		os.Exit(1)
+	}
+	if *outDir != "" && (!*decode || *outPath != "") {
+		fmt.Fprintln(os.Stderr, "Error: -outdir can only be given when decoding, and not together with -o")
+		os.Exit(1)
+	}
+	if *tile < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -t must be at least 1, got %d\n", *tile)
+		os.Exit(1)
+	}
+	if *hexArg != "" && (*decode || *relayout != 0 || *inPath != "" || len(paths) > 0 || enc != encodingHex && enc != encodingPaddedHex) {
+		fmt.Fprintln(os.Stderr, "Error: -hex can only be given when encoding hex, and not together with -relayout, -i or input files")
+		os.Exit(1)
+	}
+	if *strict && !*decode {
+		fmt.Fprintln(os.Stderr, "Error: -strict can only be given when decoding")
+		os.Exit(1)
+	}
+	if *dedup && (!*decode || *outDir != "") {
+		fmt.Fprintln(os.Stderr, "Error: -dedup can only be given when decoding, and not together with -outdir")
+		os.Exit(1)
+	}
+	if *preview != "" && (*decode || *info || *appendPath != "" || *goSrc) {
+		fmt.Fprintln(os.Stderr, "Error: -preview can only be given when encoding, and not together with -info, -append or -gosrc")
+		os.Exit(1)
+	}
+	if *check && (*decode || *info || *appendPath != "" || *goSrc || *grid || opts.Format == hex2img.FormatANSI) {
+		fmt.Fprintln(os.Stderr, "Error: -check can only be given when encoding a decodable image, and not together with -info, -append, -gosrc, -grid or -term")
+		os.Exit(1)
+	}
+	if *stats && (*decode || *info) {
+		fmt.Fprintln(os.Stderr, "Error: -stats can only be given when encoding, and not together with -info")
+		os.Exit(1)
+	}
+	if *useJSON && (!*decode || *outDir != "" || enc != encodingHex) {
+		fmt.Fprintln(os.Stderr, "Error: -json can only be given when decoding to hex, and not together with -outdir")
+		os.Exit(1)
+	}
+	if *clip && (!*decode || *inPath != "" || *imageURL != "" || *diff) {
+		fmt.Fprintln(os.Stderr, "Error: -clip can only be given when decoding, and not together with -i, -url or -diff")
+		os.Exit(1)
+	}
+	if *imageURL != "" && (!*decode || *inPath != "" || *diff) {
+		fmt.Fprintln(os.Stderr, "Error: -url can only be given when decoding, and not together with -i or -diff")
+		os.Exit(1)
+	}
+	if *appendPath != "" && (*decode || *info) {
+		fmt.Fprintln(os.Stderr, "Error: -append can only be given when encoding, and not together with -info")
+		os.Exit(1)
+	}
+	if *hashName && (*decode || *info || *outPath == "" || *appendPath != "" || opts.Format == hex2img.FormatANSI) {
+		fmt.Fprintln(os.Stderr, "Error: -hashname can only be given when encoding an image into the directory given by -o, and not together with -info or -append")
+		os.Exit(1)
+	}
+	if *goSrc && (*decode || *info || *appendPath != "" || *hashName) {
+		fmt.Fprintln(os.Stderr, "Error: -gosrc can only be given when encoding, and not together with -info, -append or -hashname")
+		os.Exit(1)
+	}
+	if *splitSize != "" && (*decode || *info || *outPath == "" || *appendPath != "" || *goSrc || *hashName || *preview != "" || *check || opts.Format == hex2img.FormatANSI) {
+		fmt.Fprintln(os.Stderr, "Error: -split-size can only be given when encoding an image to the file given by -o, and not together with -info, -append, -gosrc, -hashname, -preview or -check")
+		os.Exit(1)
+	}
+	if *relayout < 0 || *relayout > 0 && (*decode || *info || len(paths) > 0 || *appendPath != "" || *goSrc || *hashName || *splitSize != "" || *preview != "" || *check || *stats || *rows > 0 || *rowLayout != "") {
+		fmt.Fprintln(os.Stderr, "Error: -relayout must be positive and takes a single image, and cannot be given together with -d, -info, -append, -gosrc, -hashname, -split-size, -preview, -check, -stats, -rows or -layout")
+		os.Exit(1)
+	}
+	if *showMeta && (*outDir != "" || *useJSON || *diff || *verify) {
+		fmt.Fprintln(os.Stderr, "Error: -showmeta cannot be given together with -outdir, -json, -diff or -verify")
+		os.Exit(1)
+	}
+	if *verify && (*outDir != "" || *outPath != "") {
+		fmt.Fprintln(os.Stderr, "Error: -verify writes no output, so -o and -outdir cannot be given")
+		os.Exit(1)
+	}
+
+	if *verify {
+		err := withFiles(*inPath, "", fromClipboard(*clip, fromURL(*imageURL, &opts, func(r io.Reader, _ io.Writer) error {
+			_, err := hex2img.Read(r, opts)
+			return err
+		})))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+		fmt.Fprintln(os.Stderr, "OK")
+	} else if *decode {
+		err := withFiles(*inPath, *outPath, fromClipboard(*clip, fromURL(*imageURL, &opts, func(r io.Reader, w io.Writer) error {
+			if *showMeta {
+				return printPNGText(r, w)
+			}
+			if *outDir != "" {
+				return decodeToDir(r, paths, *outDir, enc, !*noNewline, opts)
+			}
+			if *useJSON {
+				return decodeToJSON(r, w, paths, !*noNewline, *dedup, opts)
+			}
+			return decodeToHex(r, w, paths, enc, !*noNewline, *dedup, opts)
+		})))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error decoding: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	} else if *relayout > 0 {
+		err := withFiles(*inPath, *outPath, func(r io.Reader, w io.Writer) error {
+			return hex2img.Relayout(w, r, *relayout, opts)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	} else {
+		// The image appended to is read before the output, which may be the
+		// same file, is truncated
+		var existing []byte
+		if *appendPath != "" {
+			if existing, err = os.ReadFile(*appendPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Error encoding: %v\n", err)
+				os.Exit(exitCode(err))
+			}
+		}
+		// Several input files are joined into one payload of parts
+		opts.Multipart = len(paths) > 0
+		var statsOut io.Writer
+		if *stats {
+			statsOut = os.Stderr
+		}
+		encode := func(r io.Reader, w io.Writer) error {
+			if existing != nil {
+				return appendToImage(r, w, existing, paths, in, opts)
+			}
+			if *info {
+				return printInfo(os.Stderr, r, paths, in, opts)
+			}
+			if *goSrc {
+				return writeGoSource(r, w, paths, in, opts)
+			}
+			return encodeHexToImage(r, w, paths, in, statsOut, *check, *preview, opts)
+		}
+		out := *outPath
+		if *hashName {
+			out, encode = "", toHashName(*outPath, opts.Format, encode)
+		}
+		if *splitSize != "" {
+			out, encode = "", func(r io.Reader, _ io.Writer) error {
+				return encodeSequence(r, paths, in, *outPath, splitWidth, splitHeight, opts)
+			}
+		}
+		err := withFiles(*inPath, out, fromText(*hexArg, encode))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding: %v\n", err)
+			os.Exit(exitCode(err))
+		}
+	}
+}
+
+// Exit statuses other than 0 for success and 2 for invalid flags.
+const (
+	exitError       = 1 // any other error
+	exitImageFormat = 3 // the input is not a valid image
+	exitIO          = 4 // a file, stream or URL could not be read or written
+)
+
+// exitCode picks the exit status for an error of encoding or decoding.
+func exitCode(err error) int {
+	var pathErr *fs.PathError
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &pathErr), errors.As(err, &urlErr):
+		return exitIO
+	case errors.Is(err, hex2img.ErrUnknownFormat), errors.Is(err, hex2img.ErrInvalidImage):
+		return exitImageFormat
+	}
+	return exitError
+}
+
+// parseArgs parses the command line flags and returns the remaining
+// arguments. Unlike flag.Parse it keeps parsing flags after an argument, so
+// that input files may come first, as in "hex2img input.hex -o out.png".
+// Everything after "--" is an argument, even if it starts with "-".
+func parseArgs(args []string) []string {
+	var rest []string
+	for {
+		flag.CommandLine.Parse(args)
+		if n := len(args) - flag.NArg(); n > 0 && args[n-1] == "--" {
+			return append(rest, flag.Args()...)
+		}
+		args = flag.Args()
+		if len(args) == 0 {
+			return rest
+		}
+		rest, args = append(rest, args[0]), args[1:]
+	}
+}
+
+// selfTestSize is the number of random bytes -selftest encodes.
+const selfTestSize = 4096
+
+// runSelfTest encodes random bytes in each format with opts, decodes them
+// with the format detected and prints whether they came back unchanged.
+// When testing several formats, those that cannot hold the chosen modes
+// are skipped. It reports whether every format tested passed.
+func runSelfTest(w io.Writer, formats []hex2img.Format, opts hex2img.Options) bool {
+	opts.Warnings = nil
+	data := make([]byte, selfTestSize)
+	rand.Read(data)
+
+	ok := true
+	for _, f := range formats {
+		o := opts
+		o.Format = f
+		payload := data
+		switch f {
+		case hex2img.FormatJPEG:
+			// Only this survives JPEG compression, unless blocks are robust
+			o.PixelSize = max(8, o.PixelSize&^7)
+			if !o.Robust {
+				o.Gray, o.Quality = true, 100
+			}
+		case hex2img.FormatGIF:
+			// Few enough distinct block colors for a GIF palette, unless
+			// compression or encryption scrambles them again
+			if (o.Compress || o.Passphrase != "") && len(formats) > 1 {
+				fmt.Fprintf(w, "SKIP %s: compressed or encrypted blocks have too many colors\n", f)
+				continue
+			}
+			payload = make([]byte, len(data))
+			for i, b := range data {
+				payload[i] = b & 0xc0
+			}
+		}
+
+		if err := o.Validate(); err != nil && len(formats) > 1 {
+			fmt.Fprintf(w, "SKIP %s: %v\n", f, err)
+			continue
+		}
+
+		var img bytes.Buffer
+		err := hex2img.Write(&img, payload, o)
+		if err == nil {
+			o.Format = hex2img.FormatAuto
+			var got []byte
+			if got, err = hex2img.Read(&img, o); err == nil && !bytes.Equal(got, payload) {
+				err = errors.New("decoded bytes differ")
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", f, err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(w, "PASS %s\n", f)
+	}
+	return ok
+}
+
+// configName is the file in the home directory read by applyConfig when
+// -config is not given.
+const configName = ".hex2img.toml"
+
+// applyConfig sets the flags named in a config file of "name = value" lines
+// unless they were given on the command line. Values may be quoted as TOML
+// strings, and # starts a comment. Without a path ~/.hex2img.toml is read
+// if it exists.
+func applyConfig(path string) error {
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, configName)
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return fmt.Errorf("%s:%d: expected name = value", path, n+1)
+		}
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("%s:%d: malformed string", path, n+1)
+			}
+		} else {
+			value, _, _ = strings.Cut(value, "#")
+			value = strings.TrimSpace(value)
+		}
+
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s:%d: unknown flag %q", path, n+1, name)
+		}
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, n+1, value, name, err)
+		}
+	}
+	return nil
+}
+
+// withFiles runs fn on the named input and output files, falling back to
+// stdin and stdout for empty names. Output is buffered, and flushing or
+// closing it is reported as an error like any other write. An output file
+// is written under a temporary name and only renamed to its own once
+// everything was written, so a failure leaves no partial file behind and
+// any earlier file of that name untouched. Devices and pipes are written
+// directly.
+func withFiles(inPath, outPath string, fn func(io.Reader, io.Writer) error) error {
+	var in io.Reader = os.Stdin
+	if inPath != "" {
+		f, err := os.Open(inPath)
+		if err != nil {
+			return fmt.Errorf("opening input: %w", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	out := os.Stdout
+	atomic := false
+	if outPath != "" {
+		var f *os.File
+		var err error
+		if fi, statErr := os.Stat(outPath); statErr == nil && !fi.Mode().IsRegular() {
+			f, err = os.OpenFile(outPath, os.O_WRONLY, 0)
+		} else {
+			atomic = true
+			f, err = os.CreateTemp(filepath.Dir(outPath), "."+filepath.Base(outPath)+".*")
+		}
+		if err != nil {
+			return fmt.Errorf("creating output: %w", err)
+		}
+		if atomic {
+			// Removing fails harmlessly once the file has been renamed
+			defer os.Remove(f.Name())
+		}
+		defer f.Close()
+		out = f
+	}
+
+	bw := &bufferedFile{bufio.NewWriter(out), out}
+	if err := fn(in, bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+	if outPath != "" {
+		if err := out.Close(); err != nil {
+			return fmt.Errorf("closing output: %w", err)
+		}
+	}
+	if atomic {
+		if err := commitOutput(out.Name(), outPath); err != nil {
+			return fmt.Errorf("creating output: %w", err)
+		}
+	}
+	return nil
+}
+
+// commitOutput renames the temporary file tmp to path, giving it the mode
+// of the file it replaces, or 0644 for a new file.
+func commitOutput(tmp, path string) error {
+	mode := fs.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// formatExtensions are the file name extensions of the image formats.
+var formatExtensions = map[hex2img.Format]string{
+	hex2img.FormatPNG:  ".png",
+	hex2img.FormatSVG:  ".svg",
+	hex2img.FormatJPEG: ".jpg",
+	hex2img.FormatGIF:  ".gif",
+	hex2img.FormatBMP:  ".bmp",
+	hex2img.FormatTIFF: ".tiff",
+	hex2img.FormatWebP: ".webp",
+}
+
+// toHashName wraps fn, a function for withFiles, to write the image it
+// writes into dir under the SHA-256 of its content and the extension of
+// format, and to print that path on stderr. Identical images thus end up
+// in the same file.
+func toHashName(dir string, format hex2img.Format, fn func(io.Reader, io.Writer) error) func(io.Reader, io.Writer) error {
+	return func(r io.Reader, _ io.Writer) error {
+		var img bytes.Buffer
+		if err := fn(r, &img); err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("creating output directory: %w", err)
+		}
+		sum := sha256.Sum256(img.Bytes())
+		path := filepath.Join(dir, hex.EncodeToString(sum[:])+formatExtensions[format])
+		err := withFiles("", path, func(_ io.Reader, w io.Writer) error {
+			_, err := w.Write(img.Bytes())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fmt.Fprintln(os.Stderr, path)
+		return nil
+	}
+}
+
+// selectFormat picks the single format whose flag is set, or def if none is.
+func selectFormat(def hex2img.Format, set map[hex2img.Format]bool) (hex2img.Format, error) {
+	selected := def
+	explicit := false
+	for f, ok := range set {
+		if !ok {
+			continue
+		}
+		if explicit {
+			return 0, fmt.Errorf("only one of -v, -j, -gif, -bmp, -tiff, -webp and -term may be given")
+		}
+		selected, explicit = f, true
+	}
+	return selected, nil
+}
+
+// progressPrinter returns a progress callback that keeps a percentage up to
+// date on a single line of w, redrawing it at most every 100ms.
+func progressPrinter(w io.Writer) func(done, total int) {
+	var last time.Time
+	return func(done, total int) {
+		if done < total && time.Since(last) < 100*time.Millisecond {
+			return
+		}
+		last = time.Now()
+		fmt.Fprintf(w, "\rEncoding: %3d%%", done*100/max(total, 1))
+		if done >= total {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// timingPrinter returns a Timings callback that prints every phase on its
+// own line of w.
+func timingPrinter(w io.Writer) func(phase string, elapsed time.Duration) {
+	return func(phase string, elapsed time.Duration) {
+		fmt.Fprintf(w, "%-12s %v\n", phase+":", elapsed)
+	}
+}
+
+// fetchTimeout bounds fetching an image for -url, including its body.
+const fetchTimeout = 30 * time.Second
+
+// fromURL wraps fn, a function for withFiles, to read the image at rawURL
+// instead of the input when rawURL is set. Unless a format was chosen, the
+// content type of the response sets opts.Format, which fn sees when it
+// reads opts after the call.
+func fromURL(rawURL string, opts *hex2img.Options, fn func(io.Reader, io.Writer) error) func(io.Reader, io.Writer) error {
+	if rawURL == "" {
+		return fn
+	}
+	return func(_ io.Reader, w io.Writer) error {
+		client := &http.Client{Timeout: fetchTimeout}
+		resp, err := client.Get(rawURL)
+		if err != nil {
+			return fmt.Errorf("fetching image: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			// Reported like a failed request, so that it exits as one
+			err := &url.Error{Op: "Get", URL: rawURL, Err: fmt.Errorf("server returned %s", resp.Status)}
+			return fmt.Errorf("fetching image: %w", err)
+		}
+
+		if opts.Format == hex2img.FormatAuto {
+			opts.Format = contentTypeFormat(resp.Header.Get("Content-Type"))
+		}
+		return fn(resp.Body, w)
+	}
+}
+
+// clipboardCommands are the commands tried in order to read a PNG from the
+// clipboard, by operating system. Unix systems other than macOS use those
+// of Linux.
+var clipboardCommands = map[string][][]string{
+	"darwin": {{"pngpaste", "-"}},
+	"linux": {
+		{"wl-paste", "--no-newline", "--type", "image/png"},
+		{"xclip", "-selection", "clipboard", "-target", "image/png", "-out"},
+	},
+}
+
+// fromText wraps fn, a function for withFiles, to read text instead of the
+// input when text is set.
+func fromText(text string, fn func(io.Reader, io.Writer) error) func(io.Reader, io.Writer) error {
+	if text == "" {
+		return fn
+	}
+	return func(_ io.Reader, w io.Writer) error {
+		return fn(strings.NewReader(text), w)
+	}
+}
+
+// fromClipboard wraps fn, a function for withFiles, to read the image on
+// the clipboard instead of the input when clip is set. It runs the first
+// of clipboardCommands that is installed.
+func fromClipboard(clip bool, fn func(io.Reader, io.Writer) error) func(io.Reader, io.Writer) error {
+	if !clip {
+		return fn
+	}
+	return func(_ io.Reader, w io.Writer) error {
+		cmds := clipboardCommands[runtime.GOOS]
+		if runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+			cmds = clipboardCommands["linux"]
+		}
+		for _, args := range cmds {
+			if _, err := exec.LookPath(args[0]); err != nil {
+				continue
+			}
+			var stderr bytes.Buffer
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Stderr = &stderr
+			img, err := cmd.Output()
+			if err != nil {
+				return fmt.Errorf("reading clipboard with %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+			}
+			return fn(bytes.NewReader(img), w)
+		}
+		if len(cmds) == 0 {
+			return fmt.Errorf("reading the clipboard is not supported on %s", runtime.GOOS)
+		}
+		var names []string
+		for _, args := range cmds {
+			names = append(names, args[0])
+		}
+		return fmt.Errorf("reading the clipboard needs %s to be installed", strings.Join(names, " or "))
+	}
+}
+
+// contentTypeFormat maps an image media type to its format, and anything
+// else to FormatAuto so the format is detected.
+func contentTypeFormat(contentType string) hex2img.Format {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return map[string]hex2img.Format{
+		"image/png":     hex2img.FormatPNG,
+		"image/svg+xml": hex2img.FormatSVG,
+		"image/jpeg":    hex2img.FormatJPEG,
+		"image/gif":     hex2img.FormatGIF,
+		"image/bmp":     hex2img.FormatBMP,
+		"image/tiff":    hex2img.FormatTIFF,
+		"image/webp":    hex2img.FormatWebP,
+	}[mediaType]
+}
+
+// bufferedFile is the buffered output withFiles passes on, which remembers
+// the file it writes to.
+type bufferedFile struct {
+	*bufio.Writer
+	f *os.File
+}
+
+// isTerminal reports whether w is output from withFiles that ends up on a
+// terminal.
+func isTerminal(w io.Writer) bool {
+	bw, ok := w.(*bufferedFile)
+	if !ok {
+		return false
+	}
+	fi, err := bw.f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// parseCrop parses a rectangle given as x,y,w,h.
+func parseCrop(s string) (image.Rectangle, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 {
+		return image.Rectangle{}, fmt.Errorf("expected x,y,w,h, got %q", s)
+	}
+	var v [4]int
+	for i, f := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return image.Rectangle{}, fmt.Errorf("%q is not an integer", f)
+		}
+		v[i] = n
+	}
+	if v[0] < 0 || v[1] < 0 || v[2] < 1 || v[3] < 1 {
+		return image.Rectangle{}, fmt.Errorf("x and y must not be negative and w and h must be positive, got %q", s)
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// parseSize parses a size given as WxH.
+func parseSize(s string) (width, height int, err error) {
+	w, h, ok := strings.Cut(s, "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected WxH, got %q", s)
+	}
+	if width, err = strconv.Atoi(w); err != nil || width < 1 {
+		return 0, 0, fmt.Errorf("width %q is not a positive integer", w)
+	}
+	if height, err = strconv.Atoi(h); err != nil || height < 1 {
+		return 0, 0, fmt.Errorf("height %q is not a positive integer", h)
+	}
+	return width, height, nil
+}
+
+// parseLayout parses a comma-separated list of row widths in blocks.
+func parseLayout(s string) ([]int, error) {
+	var widths []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", f)
+		}
+		if n < 1 {
+			return nil, fmt.Errorf("rows must be at least 1 block wide, got %d", n)
+		}
+		widths = append(widths, n)
+	}
+	return widths, nil
+}
+
+// parseHexColor parses a color written as #rrggbb or rrggbb.
+func parseHexColor(s string) (color.Color, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+	if err != nil || len(b) != 3 {
+		return nil, fmt.Errorf("%q is not of the form #rrggbb", s)
+	}
+	return color.NRGBA{R: b[0], G: b[1], B: b[2], A: 255}, nil
+}
+
+// loadPalette reads a color table of exactly 256 #rrggbb lines. Blank lines
+// are skipped.
+func loadPalette(path string) (color.Palette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading palette: %w", err)
+	}
+
+	var palette color.Palette
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		c, err := parseHexColor(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		palette = append(palette, c)
+	}
+	if len(palette) != 256 {
+		return nil, fmt.Errorf("%s: palette has %d colors, need exactly 256", path, len(palette))
+	}
+	return palette, nil
+}
+
+func printVersion() {
+	date := buildDate
+	if date == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range info.Settings {
+				if s.Key == "vcs.time" {
+					date = s.Value
+				}
+			}
+		}
+	}
+	fmt.Printf("hex2img %s (%s", version, runtime.Version())
+	if date != "" {
+		fmt.Printf(", built %s", date)
+	}
+	fmt.Println(")")
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "  Encode: cat hexfile.txt | "+filepath.Base(os.Args[0])+" -b blocks_per_row [-s pixel_size] [-a|-g] [-v|-j|-gif|-bmp|-tiff|-webp|-term] [-z] [-e] > output.png/svg")
+	fmt.Fprintln(os.Stderr, "  Decode: cat input.png/svg | "+filepath.Base(os.Args[0])+" -d [-s pixel_size] [-a|-g] [-v|-j|-gif|-bmp|-tiff|-webp] [-z] [-e] > output.txt")
+	fmt.Fprintln(os.Stderr, "  Files:  "+filepath.Base(os.Args[0])+" [options] input.hex -o output.png")
+	fmt.Fprintln(os.Stderr, "  Join:   "+filepath.Base(os.Args[0])+" [options] file1.hex file2.hex ... > output.png")
+	fmt.Fprintln(os.Stderr, "  Split:  "+filepath.Base(os.Args[0])+" -d -outdir dir [options] < input.png")
+	fmt.Fprintln(os.Stderr, "  Verify: "+filepath.Base(os.Args[0])+" -verify [options] < input.png")
+	fmt.Fprintln(os.Stderr, "  Seq:    "+filepath.Base(os.Args[0])+" -split-size WxH [options] input.hex -o out.png, then "+filepath.Base(os.Args[0])+" -d [options] out.*.png")
+	fmt.Fprintln(os.Stderr, "  Diff:   "+filepath.Base(os.Args[0])+" -diff [options] a.png b.png")
+	fmt.Fprintln(os.Stderr, "\nJPEG output (-j) is lossy and corrupts the encoded bytes. Only grayscale")
+	fmt.Fprintln(os.Stderr, "JPEGs written with -g -q 100, or with -robust at most qualities, and a pixel")
+	fmt.Fprintln(os.Stderr, "size that is a multiple of 8 can be decoded again, the former without")
+	fmt.Fprintln(os.Stderr, "repeating -g -q 100.")
+	fmt.Fprintln(os.Stderr, "\nPNGs drawn with -grid are for inspection only and are refused on decode.")
+	fmt.Fprintf(os.Stderr, "\nThe exit status is %d when the input is not a valid image, %d when a file\n", exitImageFormat, exitIO)
+	fmt.Fprintf(os.Stderr, "cannot be read or written and %d on other errors.\n", exitError)
+	fmt.Fprintf(os.Stderr, "\nDefaults for any option can be set in ~/%s as name = value lines,\n", configName)
+	fmt.Fprintln(os.Stderr, "such as s = 16 or gif = true. Options on the command line take precedence.")
+	fmt.Fprintln(os.Stderr, "\nOptions:")
+	flag.PrintDefaults()
+}
+
+// encodeHexToImage reads the payload and writes its image to w, its
+// preview to the file preview if that is set, and its statistics to stats
+// if that is not nil. With check, the image is also decoded again and
+// compared to the payload.
+func encodeHexToImage(r io.Reader, w io.Writer, paths []string, in input, stats io.Writer, check bool, preview string, opts hex2img.Options) error {
+	data, err := readPayload(r, paths, in, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.Format == hex2img.FormatJPEG && !opts.Robust {
+		fmt.Fprintln(opts.Warnings, "Warning: JPEG is lossy; this image cannot be decoded back losslessly")
+	}
+	if opts.Format == hex2img.FormatANSI && !isTerminal(w) {
+		fmt.Fprintln(opts.Warnings, "Warning: output is not a terminal; writing ANSI escape codes anyway")
+	}
+	var written bytes.Buffer
+	if check {
+		w = io.MultiWriter(w, &written)
+	}
+	err = hex2img.Write(w, data, opts)
+	if errors.Is(err, hex2img.ErrImageTooLarge) {
+		return fmt.Errorf("%w; use -b or -maxwidth to lay out the blocks differently, or raise -maxdim", err)
+	}
+	if err != nil {
+		return err
+	}
+	if check {
+		checkImage(&written, data, opts)
+	}
+	if preview != "" {
+		if err := writePreview(preview, data, opts); err != nil {
+			return fmt.Errorf("writing preview: %w", err)
+		}
+	}
+	if stats == nil {
+		return nil
+	}
+	return printStats(stats, data, opts)
+}
+
+// checkImage decodes img and warns when it fails to decode or does not give
+// back data, with the offset of the first byte that differs.
+func checkImage(img io.Reader, data []byte, opts hex2img.Options) {
+	opts.Progress = nil
+	got, err := hex2img.Read(img, opts)
+	if err != nil {
+		fmt.Fprintf(opts.Warnings, "Warning: -check: the image does not decode: %v\n", err)
+		return
+	}
+	if bytes.Equal(got, data) {
+		return
+	}
+	i := 0
+	for i < min(len(got), len(data)) && got[i] == data[i] {
+		i++
+	}
+	fmt.Fprintf(opts.Warnings, "Warning: -check: the image decodes to %d bytes that differ from the %d of the input from byte %d on\n", len(got), len(data), i)
+}
+
+// encodeSequence reads the payload and writes its image to the file out,
+// unless it would be larger than width by height pixels. Then the payload
+// is split over a sequence of images no larger than that, each holding as
+// much as fits, which are written to files numbered after out. Without a
+// layout the images wrap their rows at the width.
+func encodeSequence(r io.Reader, paths []string, in input, out string, width, height int, opts hex2img.Options) error {
+	data, err := readPayload(r, paths, in, opts)
+	if err != nil {
+		return err
+	}
+	if opts.BlocksPerRow == 0 && opts.MaxWidth == 0 && opts.Rows == 0 && len(opts.RowWidths) == 0 {
+		opts.MaxWidth = width
+	}
+	fits := func(payload []byte) (bool, error) {
+		if len(payload) > hex2img.MaxDataLen {
+			return false, nil
+		}
+		info, err := hex2img.MeasureSize(payload, opts)
+		if errors.Is(err, hex2img.ErrImageTooLarge) {
+			return false, nil
+		}
+		return err == nil && info.Width <= width && info.Height <= height, err
+	}
+	write := func(path string, payload []byte) error {
+		err := withFiles("", path, func(_ io.Reader, w io.Writer) error {
+			return hex2img.Write(w, payload, opts)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+
+	ok, err := fits(data)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return write(out, data)
+	}
+
+	// Every image takes the longest run of the rest that fits, found by
+	// bisection, with the header it is written with. The header holds the
+	// number of images, which is only known afterwards and with -z changes
+	// the compressed size, so the split is done again with the number from
+	// the last one until it needs no more. Should it then need fewer, the
+	// images left over hold none of the payload.
+	split := func(count int) ([][]byte, error) {
+		var chunks [][]byte
+		for rest := data; len(rest) > 0 || len(chunks) < count; {
+			lo, hi := 0, len(rest)
+			for lo < hi {
+				mid := (lo + hi + 1) / 2
+				ok, err := fits(hex2img.SequencePart(rest[:mid], len(chunks), count))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					lo = mid
+				} else {
+					hi = mid - 1
+				}
+			}
+			if lo == 0 {
+				ok, err := fits(hex2img.SequencePart(nil, len(chunks), count))
+				if err != nil {
+					return nil, err
+				}
+				if !ok || len(rest) > 0 {
+					return nil, fmt.Errorf("a %dx%d image cannot hold any of the payload", width, height)
+				}
+			}
+			if len(chunks) == hex2img.MaxSequenceLen {
+				return nil, fmt.Errorf("the payload needs more than %d images of %dx%d pixels", hex2img.MaxSequenceLen, width, height)
+			}
+			chunks = append(chunks, rest[:lo])
+			rest = rest[lo:]
+		}
+		return chunks, nil
+	}
+	chunks, err := split(0)
+	if err != nil {
+		return err
+	}
+	for count := 0; len(chunks) > count; {
+		count = len(chunks)
+		if chunks, err = split(count); err != nil {
+			return err
+		}
+	}
+
+	// The images record that they are parts, which write picks up
+	opts.SequencePart = true
+	ext := filepath.Ext(out)
+	for i, chunk := range chunks {
+		path := fmt.Sprintf("%s.%03d%s", strings.TrimSuffix(out, ext), i, ext)
+		if err := write(path, hex2img.SequencePart(chunk, i, len(chunks))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePreview writes a PNG of data to path that is easier to look at than
+// its image: the blocks are twice as large, with grid lines between them,
+// and every channel is histogram-equalized so that their colors spread over
+// the whole range. The preview cannot be decoded.
+func writePreview(path string, data []byte, opts hex2img.Options) error {
+	opts.Format, opts.Grid, opts.Labels, opts.Scale, opts.Progress, opts.Timings = hex2img.FormatPNG, true, false, 0, nil, nil
+	opts.PixelSize, opts.BlockHeight = 2*opts.PixelSize, 2*opts.BlockHeight
+	opts.MaxWidth *= 2
+	var buf bytes.Buffer
+	if err := hex2img.Write(&buf, data, opts); err != nil {
+		return err
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		return err
+	}
+	return withFiles("", path, func(_ io.Reader, w io.Writer) error {
+		return png.Encode(w, equalize(img))
+	})
+}
+
+// equalize returns an opaque copy of img with the levels of each color
+// channel remapped by their cumulative distribution, so that every range of
+// levels holds about as many pixels.
+func equalize(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+
+	var hist [3][256]int
+	for i := 0; i < len(out.Pix); i += 4 {
+		for ch := range hist {
+			hist[ch][out.Pix[i+ch]]++
+		}
+	}
+	var lut [3][256]byte
+	total := len(out.Pix) / 4
+	for ch := range hist {
+		cdf, low := 0, 0
+		for v, n := range hist[ch] {
+			if cdf == 0 {
+				low = n
+			}
+			cdf += n
+			if total > low {
+				lut[ch][v] = byte((cdf - low) * 255 / (total - low))
+			} else {
+				lut[ch][v] = byte(v)
+			}
+		}
+	}
+	for i := 0; i < len(out.Pix); i += 4 {
+		for ch := range lut {
+			out.Pix[i+ch] = lut[ch][out.Pix[i+ch]]
+		}
+		out.Pix[i+3] = 0xff
+	}
+	return out
+}
+
+// appendToImage reads the payload like encodeHexToImage and writes the
+// image existing with the payload appended to its own.
+func appendToImage(r io.Reader, w io.Writer, existing []byte, paths []string, in input, opts hex2img.Options) error {
+	data, err := readPayload(r, paths, in, opts)
+	if err != nil {
+		return err
+	}
+	err = hex2img.Append(w, bytes.NewReader(existing), data, opts)
+	if errors.Is(err, hex2img.ErrImageTooLarge) {
+		return fmt.Errorf("%w; raise -maxdim to append to it", err)
+	}
+	return err
+}
+
+// writeGoSource reads the payload like encodeHexToImage and writes a Go
+// source file declaring the bytes of every block of its image, in block
+// order, for embedding in tests. The blocks are read back from a PNG, so
+// they are exactly those any format holds.
+func writeGoSource(r io.Reader, w io.Writer, paths []string, in input, opts hex2img.Options) error {
+	data, err := readPayload(r, paths, in, opts)
+	if err != nil {
+		return err
+	}
+	opts.Format = hex2img.FormatPNG
+	var img bytes.Buffer
+	if err := hex2img.Write(&img, data, opts); err != nil {
+		return err
+	}
+	blocks, err := hex2img.ReadBlocks(&img, opts)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "// Code generated by hex2img -gosrc; DO NOT EDIT.\n\npackage main\n\n")
+	fmt.Fprintf(bw, "// blocks holds the bytes of every block of the image, in block order.\n")
+	fmt.Fprintf(bw, "var blocks = [][%d]byte{\n", len(blocks[0]))
+	for _, b := range blocks {
+		bw.WriteString("\t{")
+		for i, v := range b {
+			if i > 0 {
+				bw.WriteString(", ")
+			}
+			fmt.Fprintf(bw, "0x%02x", v)
+		}
+		bw.WriteString("},\n")
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// printStats reports to w how varied the payload is, which tells whether
+// it fits the 256 colors of GIF or compresses well.
+func printStats(w io.Writer, data []byte, opts hex2img.Options) error {
+	info, err := hex2img.Measure(data, opts)
+	if err != nil {
+		return err
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	common := 0
+	entropy := 0.0
+	for b, n := range counts {
+		if n > counts[common] {
+			common = b
+		}
+		if n > 0 {
+			p := float64(n) / float64(len(data))
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	fmt.Fprintf(w, "distinct block colors: %d\n", info.Colors)
+	if len(data) > 0 {
+		fmt.Fprintf(w, "most common byte: %02x (%d of %d bytes)\n", common, counts[common], len(data))
+	}
+	fmt.Fprintf(w, "entropy: %.3f bits per byte\n", entropy)
+	return nil
+}
+
+// printInfo reports to w what encodeHexToImage would write.
+func printInfo(w io.Writer, r io.Reader, paths []string, in input, opts hex2img.Options) error {
+	data, err := readPayload(r, paths, in, opts)
+	if err != nil {
+		return err
+	}
+	info, err := hex2img.Measure(data, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "blocks: %d (%d per row, %d rows)\n", info.Blocks, info.BlocksPerRow, info.Rows)
+	fmt.Fprintf(w, "size: %dx%d pixels\n", info.Width, info.Height)
+	fmt.Fprintf(w, "estimated file size: %d bytes\n", info.EstimatedSize)
+	return nil
+}
+
+// readPayload reads the bytes to encode from r or, when paths are given,
+// from each of those files joined into one multi-part payload. The payload
+// is repeated in.tile times.
+func readPayload(r io.Reader, paths []string, in input, opts hex2img.Options) ([]byte, error) {
+	if opts.Timings != nil {
+		// The text is decoded as it is read, so decoding takes the time
+		// not spent reading
+		var reading time.Duration
+		in.reading = &reading
+		defer func(start time.Time) {
+			opts.Timings("read", reading)
+			opts.Timings("decode-text", time.Since(start)-reading)
+		}(time.Now())
+	}
+	data, err := readParts(r, paths, in, opts)
+	if err != nil || in.tile == 1 {
+		return data, err
+	}
+	if !opts.Compress && int64(len(data))*int64(in.tile) > hex2img.MaxDataLen {
+		return nil, fmt.Errorf("input too large: %d bytes repeated %d times (max %d)", len(data), in.tile, hex2img.MaxDataLen)
+	}
+	return bytes.Repeat(data, in.tile), nil
+}
+
+// readParts reads the payload to repeat.
+func readParts(r io.Reader, paths []string, in input, opts hex2img.Options) ([]byte, error) {
+	// Without compression nothing larger than the length header allows can
+	// be encoded, so stop reading one byte past it instead of exhausting
+	// memory; the encoder then reports the input as too large.
+	limit := int64(math.MaxInt64)
+	if !opts.Compress {
+		limit = hex2img.MaxDataLen + 1
+	}
+
+	if len(paths) == 0 {
+		return decodeText(r, in, limit)
+	}
+
+	parts := make([][]byte, 0, len(paths))
+	for _, path := range paths {
+		part, err := readFile(path, in, limit)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return hex2img.JoinParts(parts), nil
+}
+
+// base32Text uppercases base32 text as it is read, and pads it to a whole
+// number of 8 character groups at the end unless it was padded already.
+type base32Text struct {
+	r      io.Reader
+	n      int
+	padded bool
+	eof    bool
+	pad    int // padding characters left to return after the text
+}
+
+func (b *base32Text) Read(p []byte) (int, error) {
+	if b.eof {
+		if b.pad == 0 {
+			return 0, io.EOF
+		}
+		n := min(b.pad, len(p))
+		for i := range n {
+			p[i] = '='
+		}
+		b.pad -= n
+		return n, nil
+	}
+	n, err := b.r.Read(p)
+	for i, c := range p[:n] {
+		if 'a' <= c && c <= 'z' {
+			p[i] = c - 'a' + 'A'
+		}
+		b.padded = b.padded || c == '='
+	}
+	b.n += n
+	if err == io.EOF {
+		b.eof, err = true, nil
+		if !b.padded && b.n%8 != 0 {
+			b.pad = 8 - b.n%8
+		}
+	}
+	return n, err
+}
+
+// countSet returns how many of flags are set.
+func countSet(flags ...bool) int {
+	n := 0
+	for _, f := range flags {
+		if f {
+			n++
+		}
+	}
+	return n
+}
+
+// timedReader adds the time its Read calls take to elapsed.
+type timedReader struct {
+	r       io.Reader
+	elapsed *time.Duration
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(p)
+	*t.elapsed += time.Since(start)
+	return n, err
+}
+
+func readFile(path string, in input, limit int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening input: %w", err)
+	}
+	defer f.Close()
+
+	data, err := decodeText(f, in, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return data, nil
+}
+
+// decodeText reads the encode input as payload bytes. Hex and base64 are
+// decoded as they are read, so that the text is not held in memory besides
+// the payload, which is read whole as encoding needs all of it.
+// Whitespace is ignored unless the input is raw. At most limit bytes are
+// returned.
+func decodeText(r io.Reader, in input, limit int64) ([]byte, error) {
+	if in.reading != nil {
+		r = &timedReader{r: r, elapsed: in.reading}
+	}
+	enc := in.enc
+	if enc == encodingRaw {
+		data, err := io.ReadAll(io.LimitReader(r, limit))
+		if err != nil {
+			return nil, fmt.Errorf("reading input: %w", err)
+		}
+		return data, nil
+	}
+	if enc == encodingHexDump {
+		return decodeHexDump(r, limit)
+	}
+
+	isHex := enc != encodingBase64 && enc != encodingBase32
+	text := &cleanText{r: r, hex: isHex, comments: in.comments && isHex}
+	r = text
+	if enc == encodingBase64 {
+		data, err := io.ReadAll(io.LimitReader(base64.NewDecoder(base64.StdEncoding, r), limit))
+		if err != nil {
+			return nil, fmt.Errorf("decoding base64: %w", err)
+		}
+		return data, nil
+	}
+	if enc == encodingBase32 {
+		data, err := io.ReadAll(io.LimitReader(base32.NewDecoder(base32.StdEncoding, &base32Text{r: r}), limit))
+		if err != nil {
+			return nil, fmt.Errorf("decoding base32: %w", err)
+		}
+		return data, nil
+	}
+
+	if enc == encodingPaddedHex {
+		// Whether to pad is only known at the end, so the text is buffered.
+		digits, err := io.ReadAll(text)
+		if err != nil {
+			return nil, fmt.Errorf("reading input: %w", err)
+		}
+		if len(digits)%2 == 1 {
+			digits = append([]byte{'0'}, digits...)
+		}
+		r = bytes.NewReader(digits)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(hex.NewDecoder(r), limit))
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("hex input has odd length (%d digits); expected pairs, or use -pad", text.n)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding hex: %w", err)
+	}
+	return data, nil
+}
+
+// decodeHexDump reads the bytes listed in the output of xxd or hexdump -C,
+// dropping the offset column and the ASCII gutter. A line holding only "*"
+// stands for copies of the line before it, up to the offset of the next
+// line. At most limit bytes are returned.
+func decodeHexDump(r io.Reader, limit int64) ([]byte, error) {
+	var data, last []byte
+	repeat := false
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan() && int64(len(data)) < limit; n++ {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "*" {
+			repeat = true
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		offset, hexPart, err := splitHexDumpLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("hex dump line %d: %w", n, err)
+		}
+		if repeat {
+			if len(last) == 0 || offset < int64(len(data)) || (offset-int64(len(data)))%int64(len(last)) != 0 {
+				return nil, fmt.Errorf("hex dump line %d: offset %x does not follow the repeated line", n, offset)
+			}
+			for int64(len(data)) < offset && int64(len(data)) < limit {
+				data = append(data, last...)
+			}
+			repeat = false
+		}
+		if offset != int64(len(data)) {
+			return nil, fmt.Errorf("hex dump line %d: expected offset %x, got %x", n, len(data), offset)
+		}
+
+		if last, err = hex.DecodeString(hexPart); err != nil {
+			return nil, fmt.Errorf("hex dump line %d: %w", n, err)
+		}
+		data = append(data, last...)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading input: %w", err)
+	}
+	if repeat {
+		return nil, errors.New("hex dump ends with a repeated line but no final offset")
+	}
+	return data[:min(int64(len(data)), limit)], nil
+}
+
+// splitHexDumpLine returns the offset of a hex dump line and its hex digits
+// without separators. xxd ends the offset with a colon and puts two spaces
+// before the ASCII gutter, while hexdump -C puts the gutter between bars.
+func splitHexDumpLine(line string) (int64, string, error) {
+	field, rest, _ := strings.Cut(strings.TrimLeft(line, " "), " ")
+	xxd := strings.HasSuffix(field, ":")
+	offset, err := strconv.ParseInt(strings.TrimSuffix(field, ":"), 16, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid offset %q", field)
+	}
+	if xxd {
+		rest, _, _ = strings.Cut(rest, "  ")
+	} else {
+		rest, _, _ = strings.Cut(rest, "|")
+	}
+	return offset, strings.Join(strings.Fields(rest), ""), nil
+}
+
+// cleanText drops spaces and line breaks from the underlying reader and
+// counts the bytes it keeps. For hex it also drops the comma and colon
+// separators and the 0x prefixes that debuggers put between bytes, and with
+// comments set, everything from # or // to the end of the line.
+type cleanText struct {
+	r        io.Reader
+	hex      bool
+	comments bool
+	n        int
+
+	in        [512]byte
+	out       []byte
+	err       error
+	inToken   bool
+	zero      bool // a leading 0 held back until it is known not to start 0x
+	slash     bool // a / held back until it is known not to start //
+	inComment bool
+}
+
+func (c *cleanText) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		n, err := c.r.Read(c.in[:])
+		for _, b := range c.in[:n] {
+			c.clean(b)
+		}
+		if err != nil {
+			c.flush()
+			c.err = err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	c.n += n
+	return n, nil
+}
+
+func (c *cleanText) clean(b byte) {
+	if c.comments {
+		if c.inComment {
+			c.inComment = b != '\n'
+			return
+		}
+		if c.slash {
+			c.slash = false
+			if b == '/' {
+				c.inComment = true
+				return
+			}
+			c.out = append(c.out, '/')
+		}
+		if b == '#' || b == '/' {
+			c.flushZero()
+			c.inToken = false
+			c.inComment, c.slash = b == '#', b == '/'
+			return
+		}
+	}
+	if b == ' ' || b == '\n' || b == '\r' || b == '\t' || (c.hex && (b == ',' || b == ':')) {
+		c.flushZero()
+		c.inToken = false
+		return
+	}
+	if !c.hex {
+		c.out = append(c.out, b)
+		return
+	}
+
+	if c.zero {
+		c.zero = false
+		if b == 'x' || b == 'X' {
+			return
+		}
+		c.out = append(c.out, '0')
+	}
+	if !c.inToken && b == '0' {
+		c.zero = true
+	} else {
+		c.out = append(c.out, b)
+	}
+	c.inToken = true
+}
+
+func (c *cleanText) flushZero() {
+	if c.zero {
+		c.out = append(c.out, '0')
+		c.zero = false
+	}
+}
+
+// flush emits the bytes held back at the end of the input.
+func (c *cleanText) flush() {
+	c.flushZero()
+	if c.slash {
+		c.out = append(c.out, '/')
+		c.slash = false
+	}
+}
+
+func decodeToHex(r io.Reader, w io.Writer, paths []string, enc textEncoding, newline, dedup bool, opts hex2img.Options) error {
+	data, _, err := readImage(r, paths, opts)
+	if err != nil {
+		return err
+	}
+	if dedup {
+		data = collapseRepeats(data)
+	}
+	return writeText(w, data, enc, newline)
+}
+
+// printPNGText writes the tEXt chunks of a PNG as key: value lines, sorted
+// by key.
+func printPNGText(r io.Reader, w io.Writer) error {
+	text, err := hex2img.ReadPNGText(r)
+	if err != nil {
+		return err
+	}
+	for _, key := range slices.Sorted(maps.Keys(text)) {
+		if _, err := fmt.Fprintf(w, "%s: %s\n", key, text[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeToJSON writes the payload as hex in a JSON object along with the
+// layout the image was read with, or the first image of a sequence.
+func decodeToJSON(r io.Reader, w io.Writer, paths []string, newline, dedup bool, opts hex2img.Options) error {
+	data, info, err := readImage(r, paths, opts)
+	if err != nil {
+		return err
+	}
+	if dedup {
+		data = collapseRepeats(data)
+	}
+	out, err := json.Marshal(struct {
+		Hex          string `json:"hex"`
+		Bytes        int    `json:"bytes"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		BlocksPerRow int    `json:"blocksPerRow"`
+	}{hex.EncodeToString(data), len(data), info.Width, info.Height, info.BlocksPerRow})
+	if err != nil {
+		return err
+	}
+	if newline {
+		out = append(out, '\n')
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// collapseRepeats returns the shortest prefix of data that repeats to make
+// up all of data.
+func collapseRepeats(data []byte) []byte {
+	for n := 1; n < len(data); n++ {
+		if len(data)%n == 0 && bytes.Equal(bytes.Repeat(data[:n], len(data)/n), data) {
+			return data[:n]
+		}
+	}
+	return data
+}
+
+// decodeToDir writes every part of the decoded payload to its own numbered
+// file in dir. A payload built from a single input is written as one part.
+func decodeToDir(r io.Reader, paths []string, dir string, enc textEncoding, newline bool, opts hex2img.Options) error {
+	data, info, err := readImage(r, paths, opts)
+	if err != nil {
+		return err
+	}
+	parts := [][]byte{data}
+	if info.Multipart {
+		if parts, err = hex2img.SplitParts(data); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating output directory: %w", err)
+	}
+	ext := map[textEncoding]string{encodingHex: ".hex", encodingPaddedHex: ".hex", encodingBase64: ".b64", encodingBase32: ".b32", encodingRaw: ".bin", encodingHexDump: ".txt"}[enc]
+	for i, part := range parts {
+		path := filepath.Join(dir, fmt.Sprintf("part-%03d%s", i+1, ext))
+		err := withFiles("", path, func(_ io.Reader, w io.Writer) error {
+			return writeText(w, part, enc, newline)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// diffImages writes the index and bytes of every block that differs between
+// the images a and b, followed by a count, and reports whether any did.
+// An image without blocks is an error.
+func diffImages(w io.Writer, a, b string, opts hex2img.Options) (bool, error) {
+	var blocks [2][][]byte
+	for i, path := range []string{a, b} {
+		err := withFiles(path, "", func(r io.Reader, _ io.Writer) error {
+			var err error
+			blocks[i], err = hex2img.ReadBlocks(r, opts)
+			return err
+		})
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(blocks[i]) == 0 {
+			// There would be nothing to compare it with
+			return false, fmt.Errorf("%s: %w: no blocks found", path, hex2img.ErrInvalidImage)
+		}
+	}
+
+	n := max(len(blocks[0]), len(blocks[1]))
+	differ := 0
+	for i := 0; i < n; i++ {
+		before, after := blockText(blocks[0], i), blockText(blocks[1], i)
+		if before != after {
+			fmt.Fprintf(w, "block %d: %s -> %s\n", i, before, after)
+			differ++
+		}
+	}
+	fmt.Fprintf(w, "%d of %d blocks differ\n", differ, n)
+	return differ > 0, nil
+}
+
+// blockText formats block i of blocks as hex, or as "none" past the end.
+func blockText(blocks [][]byte, i int) string {
+	if i >= len(blocks) {
+		return "none"
+	}
+	return hex.EncodeToString(blocks[i])
+}
+
+// readImage decodes the image on r or, when paths are given, the sequence of
+// images in those files, in any order. An image that is part of a sequence
+// cannot be decoded alone.
+func readImage(r io.Reader, paths []string, opts hex2img.Options) ([]byte, hex2img.Info, error) {
+	if len(paths) == 0 {
+		data, info, err := readOneImage(r, opts)
+		if err != nil || !info.SequencePart {
+			return data, info, err
+		}
+		if data, err = hex2img.JoinSequence([][]byte{data}); err != nil {
+			return nil, info, fmt.Errorf("%w; give all images of the sequence as arguments", err)
+		}
+		return data, info, nil
+	}
+
+	var first hex2img.Info
+	payloads := make([][]byte, len(paths))
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, first, fmt.Errorf("opening input: %w", err)
+		}
+		data, info, err := readOneImage(f, opts)
+		f.Close()
+		if err != nil {
+			return nil, first, fmt.Errorf("%s: %w", path, err)
+		}
+		if !info.SequencePart {
+			return nil, first, fmt.Errorf("%s: image is not part of a sequence", path)
+		}
+		if i == 0 {
+			first = info
+		}
+		payloads[i] = data
+	}
+	data, err := hex2img.JoinSequence(payloads)
+	return data, first, err
+}
+
+// readOneImage decodes the payload and layout of the image on r. A failed
+// checksum is only a warning, so the possibly corrupted payload is still
+// returned.
+func readOneImage(r io.Reader, opts hex2img.Options) ([]byte, hex2img.Info, error) {
+	data, info, err := hex2img.ReadInfo(r, opts)
+	switch {
+	case errors.Is(err, hex2img.ErrChecksum):
+		fmt.Fprintf(opts.Warnings, "Warning: %v\n", err)
+	case errors.Is(err, hex2img.ErrUnknownFormat):
+		return nil, info, fmt.Errorf("%w; use -v, -j, -gif, -bmp, -tiff or -webp to choose one", err)
+	case err != nil:
+		return nil, info, err
+	}
+	return data, info, nil
+}
+
+// writeText writes data in the given encoding, followed by a newline when
+// asked to. Raw bytes never get one.
+func writeText(w io.Writer, data []byte, enc textEncoding, newline bool) error {
+	var err error
+	switch enc {
+	case encodingRaw:
+		_, err = w.Write(data)
+		return err
+	case encodingBase64:
+		_, err = io.WriteString(w, base64.StdEncoding.EncodeToString(data))
+	case encodingBase32:
+		_, err = io.WriteString(w, base32.StdEncoding.EncodeToString(data))
+	case encodingHexDump:
+		// The dump already ends with a newline, and the closing offset
+		// line of hexdump -C follows it
+		_, err = fmt.Fprintf(w, "%s%08x", hex.Dump(data), len(data))
+	default:
+		_, err = fmt.Fprintf(w, "%x", data)
+	}
+	if err != nil || !newline {
+		return err
+	}
+
+	// Add a newline at the end
+	_, err = fmt.Fprintln(w)
+	return err
+}
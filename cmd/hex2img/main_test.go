@@ -0,0 +1,1273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/706f6c6c7578/hex2img"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, so that
+// the tests can run the command with arguments and watch it exit.
+const runMainEnv = "HEX2IMG_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// result is what a run of the command printed and its exit status.
+type result struct {
+	stdout, stderr string
+	code           int
+}
+
+// run runs the command with args in dir, reading stdin. Its home is dir,
+// so that nothing of the user's is read, and the passphrase is unset.
+func run(t *testing.T, dir, stdin string, args ...string) result {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, passEnv+"=") && !strings.HasPrefix(kv, "HOME=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, runMainEnv+"=1", "HOME="+dir)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	var exitErr *exec.ExitError
+	err := cmd.Run()
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("running %v: %v", args, err)
+	}
+	return result{stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()}
+}
+
+// mustRun is run for commands that must succeed.
+func mustRun(t *testing.T, dir, stdin string, args ...string) result {
+	t.Helper()
+	res := run(t, dir, stdin, args...)
+	if res.code != 0 {
+		t.Fatalf("%v exited with %d: %s", args, res.code, res.stderr)
+	}
+	return res
+}
+
+// imageSize returns the size of the encoded image img.
+func imageSize(t *testing.T, img string) (width, height int) {
+	t.Helper()
+	cfg, _, err := image.DecodeConfig(strings.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Width, cfg.Height
+}
+
+func TestPixelSizeFlag(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		size          string
+		width, height int
+	}{
+		{"1", 5, 1},
+		{"4", 20, 4},
+	} {
+		img := mustRun(t, dir, "00112233445566", "-b", "5", "-s", tc.size)
+		if w, h := imageSize(t, img.stdout); w != tc.width || h != tc.height {
+			t.Errorf("-s %s: image is %dx%d, want %dx%d", tc.size, w, h, tc.width, tc.height)
+		}
+		res := mustRun(t, dir, img.stdout, "-d", "-s", tc.size)
+		if res.stdout != "00112233445566\n" {
+			t.Errorf("-s %s: decoded %q, want %q", tc.size, res.stdout, "00112233445566\n")
+		}
+	}
+
+	if res := run(t, dir, "00", "-s", "-1"); res.code == 0 {
+		t.Error("-s -1 succeeded, want an error")
+	}
+}
+
+func TestJPEGWarning(t *testing.T) {
+	dir := t.TempDir()
+	res := mustRun(t, dir, "deadbeef", "-j", "-o", "out.jpg")
+	if want := "Warning: JPEG is lossy; this image cannot be decoded back losslessly\n"; res.stderr != want {
+		t.Errorf("printed %q, want %q", res.stderr, want)
+	}
+}
+
+func TestDecodeGrayJPEG(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "deadbeef", "-j", "-g", "-q", "100", "-o", "out.jpg")
+	if res := mustRun(t, dir, "", "-d", "out.jpg"); res.stdout != "deadbeef\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "deadbeef\n")
+	}
+	mustRun(t, dir, "deadbeef", "-j", "-g", "-q", "90", "-o", "lossy.jpg")
+	if res := run(t, dir, "", "-d", "lossy.jpg"); res.code == 0 {
+		t.Errorf("decoding a quality 90 JPEG succeeded with %q, want a refusal", res.stdout)
+	}
+}
+
+func TestSplitFlag(t *testing.T) {
+	dir := t.TempDir()
+	parts := []string{"00", "", strings.Repeat("ab01", 300)}
+	var files []string
+	for i, part := range parts {
+		name := filepath.Join(dir, fmt.Sprintf("%c.hex", 'a'+i))
+		if err := os.WriteFile(name, []byte(part), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, name)
+	}
+	mustRun(t, dir, "", append([]string{"-o", "joined.png"}, files...)...)
+
+	for _, name := range []string{"-split", "-outdir"} {
+		out := filepath.Join(dir, name[1:])
+		mustRun(t, dir, "", "-d", name, out, "joined.png")
+		for i, part := range parts {
+			got, err := os.ReadFile(filepath.Join(out, fmt.Sprintf("part-%03d.hex", i+1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != part+"\n" {
+				t.Errorf("%s: part %d is %q, want %q", name, i+1, got, part+"\n")
+			}
+		}
+	}
+}
+
+func TestBase64(t *testing.T) {
+	dir := t.TempDir()
+	img := mustRun(t, dir, "3q2+7wA=\n", "-base64").stdout
+	if res := mustRun(t, dir, img, "-d"); res.stdout != "deadbeef00\n" {
+		t.Errorf("decoded to hex %q, want %q", res.stdout, "deadbeef00\n")
+	}
+	if res := mustRun(t, dir, img, "-d", "-base64"); res.stdout != "3q2+7wA=\n" {
+		t.Errorf("decoded to base64 %q, want %q", res.stdout, "3q2+7wA=\n")
+	}
+	if res := run(t, dir, "not base64!", "-base64"); res.code == 0 {
+		t.Error("invalid base64 input succeeded, want an error")
+	}
+}
+
+// endless reads as text repeated forever.
+type endless struct {
+	text string
+	off  int
+}
+
+func (e *endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = e.text[e.off]
+		e.off = (e.off + 1) % len(e.text)
+	}
+	return len(p), nil
+}
+
+func TestDecodeTextInPieces(t *testing.T) {
+	got, err := decodeText(iotest.OneByteReader(strings.NewReader("de ad\nbe\r\nef\n")), input{enc: encodingHex}, 100)
+	if err != nil || !bytes.Equal(got, []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("one byte at a time: got %x, %v", got, err)
+	}
+
+	// Input that never ends is decoded only up to the limit, so the text
+	// is never read whole
+	for _, tc := range []struct {
+		enc  textEncoding
+		text string
+	}{
+		{encodingHex, "00ff\n"},
+		{encodingBase64, "AP8A\n"},
+		{encodingRaw, "\x00\xff"},
+	} {
+		got, err := decodeText(&endless{text: tc.text}, input{enc: tc.enc}, 1000)
+		if err != nil || len(got) != 1000 {
+			t.Errorf("encoding %d: got %d bytes, %v, want 1000", tc.enc, len(got), err)
+		}
+	}
+}
+
+func TestOddLengthHex(t *testing.T) {
+	_, err := decodeText(strings.NewReader("abc\n"), input{enc: encodingHex}, 100)
+	if err == nil || !strings.Contains(err.Error(), "odd length (3 digits)") {
+		t.Errorf("got %v, want an odd length error counting 3 digits", err)
+	}
+	got, err := decodeText(strings.NewReader("a bc\n"), input{enc: encodingPaddedHex}, 100)
+	if err != nil || !bytes.Equal(got, []byte{0x0a, 0xbc}) {
+		t.Errorf("padded: got %x, %v, want 0abc", got, err)
+	}
+
+	dir := t.TempDir()
+	if res := run(t, dir, "abc", "-o", "out.png"); res.code != exitError || !strings.Contains(res.stderr, "-pad") {
+		t.Errorf("odd input exited with %d and printed %q, want %d and a hint to use -pad", res.code, res.stderr, exitError)
+	}
+	mustRun(t, dir, "abc", "-pad", "-o", "out.png")
+	if res := mustRun(t, dir, "", "-d", "out.png"); res.stdout != "0abc\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "0abc\n")
+	}
+}
+
+func TestFillFlag(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "42ffff", "-fill", "ff", "-b", "4", "-o", "out.png")
+	if res := mustRun(t, dir, "", "-d", "out.png"); res.stdout != "42ffff\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "42ffff\n")
+	}
+	for _, fill := range []string{"zz", "fff", ""} {
+		if res := run(t, dir, "42", "-fill", fill, "-o", "bad.png"); res.code == 0 {
+			t.Errorf("-fill %q succeeded, want an error", fill)
+		}
+	}
+}
+
+func TestBlocksPerRowFlag(t *testing.T) {
+	dir := t.TempDir()
+	res := mustRun(t, dir, "01020304", "-b", "1000000", "-s", "2")
+	if !strings.Contains(res.stderr, "Warning: 1000000 blocks per row") {
+		t.Errorf("stderr %q, want a warning about the blocks per row", res.stderr)
+	}
+	if w, h := imageSize(t, res.stdout); w != 8 || h != 2 {
+		t.Errorf("image is %dx%d, want 8x2", w, h)
+	}
+	if res := run(t, dir, "01020304", "-b", "-2", "-o", "bad.png"); res.code == 0 {
+		t.Error("-b -2 succeeded, want an error")
+	}
+}
+
+func TestDecodeExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "deadbeef", "-o", "out.png")
+	encoded, err := os.ReadFile(filepath.Join(dir, "out.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "short.png"), encoded[:len(encoded)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		stdin string
+		args  []string
+		code  int
+	}{
+		{"truncated", "", []string{"-d", "short.png"}, exitImageFormat},
+		{"not an image", "hello, world", []string{"-d"}, exitImageFormat},
+		{"missing file", "", []string{"-d", "missing.png"}, exitIO},
+	} {
+		if res := run(t, dir, tc.stdin, tc.args...); res.code != tc.code {
+			t.Errorf("%s: exited with %d, want %d: %s", tc.name, res.code, tc.code, res.stderr)
+		}
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	for _, s := range []string{"#2080c0", "2080c0"} {
+		if c, err := parseHexColor(s); err != nil || c != (color.NRGBA{0x20, 0x80, 0xc0, 0xff}) {
+			t.Errorf("%q: got %v, %v", s, c, err)
+		}
+	}
+	for _, s := range []string{"blue", "#2080c", "#2080c0ff", ""} {
+		if _, err := parseHexColor(s); err == nil {
+			t.Errorf("%q: parsed, want an error", s)
+		}
+	}
+}
+
+func TestMaxDimFlag(t *testing.T) {
+	dir := t.TempDir()
+	hex := strings.Repeat("ab", 300)
+	res := run(t, dir, hex, "-square=false", "-maxdim", "500", "-o", "out.png")
+	if res.code == 0 || !strings.Contains(res.stderr, "use -b or -maxwidth") {
+		t.Errorf("exited with %d and printed %q, want an error suggesting -b", res.code, res.stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.png")); !os.IsNotExist(err) {
+		t.Error("a refused image left an output file")
+	}
+	mustRun(t, dir, hex, "-square=false", "-maxdim", "500", "-b", "50", "-o", "out.png")
+}
+
+func TestAppendFlag(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "0011", "-b", "2", "-o", "log.png")
+	// The output may be the image appended to
+	mustRun(t, dir, "2233", "-append", "log.png", "-o", "log.png")
+	mustRun(t, dir, "4455", "-append", "log.png", "-o", "log.png")
+	if res := mustRun(t, dir, "", "-d", "log.png"); res.stdout != "001122334455\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "001122334455\n")
+	}
+	if res := run(t, dir, "66", "-append", "missing.png", "-o", "log.png"); res.code != exitIO {
+		t.Errorf("appending to a missing image exited with %d, want %d", res.code, exitIO)
+	}
+}
+
+func TestParseCrop(t *testing.T) {
+	if r, err := parseCrop("21, 13,128,16"); err != nil || r != image.Rect(21, 13, 149, 29) {
+		t.Errorf("got %v, %v, want %v", r, err, image.Rect(21, 13, 149, 29))
+	}
+	for _, s := range []string{"1,2,3", "a,2,3,4", "-1,0,3,4", "0,0,0,4", "1,2,3,4,5"} {
+		if _, err := parseCrop(s); err == nil {
+			t.Errorf("%q: parsed, want an error", s)
+		}
+	}
+}
+
+func TestBlockSizeFlags(t *testing.T) {
+	dir := t.TempDir()
+	img := mustRun(t, dir, "00112233445566", "-bw", "4", "-bh", "12", "-b", "5").stdout
+	if w, h := imageSize(t, img); w != 20 || h != 12 {
+		t.Errorf("image is %dx%d, want 20x12", w, h)
+	}
+	if res := mustRun(t, dir, img, "-d"); res.stdout != "00112233445566\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "00112233445566\n")
+	}
+}
+
+func TestHugeBlockSizeFlags(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "00112233445566", "-bmp", "-o", "out.bmp")
+	for _, args := range [][]string{
+		{"-d", "-s", "4611686018427387904", "-b", "4", "-bh", "1", "out.bmp"},
+		{"-d", "-s", "4", "-scale", "4611686018427387904", "out.bmp"},
+		{"-d", "-s", "60000", "-b", "4", "-bh", "1", "out.bmp"},
+		{"-d", "-s", "2", "-scale", "60000", "out.bmp"},
+		{"-s", "4611686018427387904", "-o", "huge.png"},
+		{"-bh", "4611686018427387904", "-o", "huge.png"},
+		{"-bh", "65537", "-o", "huge.png"},
+		{"-v", "-scale", "4611686018427387904", "-o", "huge.svg"},
+	} {
+		stdin := ""
+		if args[0] != "-d" {
+			stdin = "00112233445566"
+		}
+		if res := run(t, dir, stdin, args...); res.code != exitError && res.code != exitImageFormat {
+			t.Errorf("%v: exited with %d, want an error: %s", args, res.code, res.stderr)
+		}
+	}
+}
+
+func TestCaptionFlag(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "deadbeef", "-caption", "from notes.txt", "-o", "out.png")
+	res := mustRun(t, dir, "", "-d", "-showmeta", "out.png")
+	if !strings.Contains(res.stdout, "Description: from notes.txt\n") || !strings.Contains(res.stdout, "hex2img:pixelSize: ") {
+		t.Errorf("-showmeta printed %q, want the caption and the layout", res.stdout)
+	}
+	if res := run(t, dir, "deadbeef", "-caption", "snow ☃", "-o", "bad.png"); res.code == 0 {
+		t.Error("a caption outside Latin-1 succeeded, want an error")
+	}
+}
+
+func TestLayoutFlag(t *testing.T) {
+	if widths, err := parseLayout("8, 8,4"); err != nil || !slices.Equal(widths, []int{8, 8, 4}) {
+		t.Errorf("got %v, %v, want [8 8 4]", widths, err)
+	}
+	for _, s := range []string{"", "8,,4", "8,0", "x"} {
+		if _, err := parseLayout(s); err == nil {
+			t.Errorf("%q: parsed, want an error", s)
+		}
+	}
+
+	dir := t.TempDir()
+	hex := strings.Repeat("0123456789", 10)
+	img := mustRun(t, dir, hex, "-layout", "8,8,4", "-s", "2").stdout
+	if w, _ := imageSize(t, img); w != 16 {
+		t.Errorf("image is %d pixels wide, want 16", w)
+	}
+	if res := mustRun(t, dir, img, "-d"); res.stdout != hex+"\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, hex+"\n")
+	}
+}
+
+func TestRelayoutFlag(t *testing.T) {
+	dir := t.TempDir()
+	hex := strings.Repeat("0123456789", 10)
+	mustRun(t, dir, hex, "-b", "4", "-s", "2", "-o", "out.png")
+	wide := mustRun(t, dir, "", "-relayout", "9", "-i", "out.png").stdout
+	if w, _ := imageSize(t, wide); w != 18 {
+		t.Errorf("image is %d pixels wide, want 18", w)
+	}
+	if res := mustRun(t, dir, wide, "-d"); res.stdout != hex+"\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, hex+"\n")
+	}
+	if res := run(t, dir, "", "-relayout", "-1", "-i", "out.png", "-o", "bad.png"); res.code == 0 {
+		t.Error("-relayout -1 succeeded, want an error")
+	}
+}
+
+func TestStrictFlag(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "deadbeef", "-noheader", "-o", "old.png")
+	mustRun(t, dir, "deadbeef", "-o", "new.png")
+	if res := mustRun(t, dir, "", "-d", "old.png"); res.stdout != "deadbeef\n" || !strings.Contains(res.stderr, "Warning: no hex2img signature") {
+		t.Errorf("decoding without the signature printed %q and %q, want the payload and a warning", res.stdout, res.stderr)
+	}
+	if res := run(t, dir, "", "-d", "-strict", "old.png"); res.code == 0 || res.stdout != "" {
+		t.Errorf("-strict exited with %d and printed %q, want an error and no payload", res.code, res.stdout)
+	}
+	if res := mustRun(t, dir, "", "-d", "-strict", "new.png"); res.stdout != "deadbeef\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "deadbeef\n")
+	}
+	if res := run(t, dir, "deadbeef", "-strict", "-o", "out.png"); res.code == 0 {
+		t.Error("-strict when encoding succeeded, want an error")
+	}
+}
+
+func TestNoNewlineFlag(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "deadbeef", "-o", "out.png")
+	with := mustRun(t, dir, "", "-d", "out.png").stdout
+	without := mustRun(t, dir, "", "-d", "-n", "out.png").stdout
+	if without != "deadbeef" || len(with) != len(without)+1 {
+		t.Errorf("decoded %q with the newline and %q without", with, without)
+	}
+}
+
+func TestHexSeparators(t *testing.T) {
+	want := []byte{0xde, 0xad, 0xbe, 0xef}
+	for _, text := range []string{
+		"0xDEADBEEF",
+		"DE AD BE EF",
+		"de,ad,be,ef",
+		"de:ad:be:ef",
+		"0xde, 0Xad, 0xbe, 0xef\n",
+		"dEaDbEeF",
+	} {
+		// One byte at a time, so that 0 and x arrive in separate reads
+		got, err := decodeText(iotest.OneByteReader(strings.NewReader(text)), input{enc: encodingHex}, 100)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%q: got %x, %v, want %x", text, got, err, want)
+		}
+	}
+	// Zeros are only dropped as part of a prefix
+	got, err := decodeText(strings.NewReader("00 0a 0x0b a0"), input{enc: encodingHex}, 100)
+	if err != nil || !bytes.Equal(got, []byte{0x00, 0x0a, 0x0b, 0xa0}) {
+		t.Errorf("zeros: got %x, %v, want 000a0ba0", got, err)
+	}
+}
+
+func TestRawFlag(t *testing.T) {
+	dir := t.TempDir()
+	// Whitespace and zero bytes are payload like any other byte
+	payload := "\x00 raw\nbytes\r\n\x00"
+	img := mustRun(t, dir, payload, "-raw").stdout
+	if res := mustRun(t, dir, img, "-d", "-raw"); res.stdout != payload {
+		t.Errorf("decoded %q, want %q without a newline", res.stdout, payload)
+	}
+	if res := mustRun(t, dir, img, "-d"); res.stdout != "00207261770a62797465730d0a00\n" {
+		t.Errorf("decoded to hex %q", res.stdout)
+	}
+	if res := run(t, dir, payload, "-raw", "-base64"); res.code == 0 {
+		t.Error("-raw -base64 succeeded, want an error")
+	}
+}
+
+func TestSquareLayout(t *testing.T) {
+	dir := t.TempDir()
+	// 10 bytes and the 8 of the signature, version and length header make
+	// 6 blocks
+	const hex = "00112233445566778899"
+	for _, tc := range []struct {
+		args          []string
+		width, height int
+	}{
+		{nil, 3, 2},
+		{[]string{"-square=false"}, 6, 1},
+		{[]string{"-b", "2"}, 2, 3},
+	} {
+		img := mustRun(t, dir, hex, append([]string{"-s", "1"}, tc.args...)...).stdout
+		if w, h := imageSize(t, img); w != tc.width || h != tc.height {
+			t.Errorf("%v: image is %dx%d, want %dx%d", tc.args, w, h, tc.width, tc.height)
+		}
+		if res := mustRun(t, dir, img, "-d", "-s", "1"); res.stdout != hex+"\n" {
+			t.Errorf("%v: decoded %q, want %q", tc.args, res.stdout, hex+"\n")
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	dir := t.TempDir()
+	img := mustRun(t, dir, "deadbeef", "-s", "1").stdout
+	if !strings.HasPrefix(img, "\x89PNG") {
+		t.Fatal("encoding did not write a PNG")
+	}
+	if res := mustRun(t, dir, img, "-d", "-s", "1"); res.stdout != "deadbeef\n" || res.stderr != "" {
+		t.Errorf("decoded %q with warnings %q, want %q and none", res.stdout, res.stderr, "deadbeef\n")
+	}
+
+	// Images without the signature, as older versions wrote them, still
+	// decode, with a warning
+	img = mustRun(t, dir, "deadbeef", "-s", "1", "-noheader").stdout
+	res := mustRun(t, dir, img, "-d", "-s", "1")
+	if res.stdout != "deadbeef\n" || !strings.Contains(res.stderr, "no hex2img signature") {
+		t.Errorf("decoded %q with warnings %q, want %q and a missing signature", res.stdout, res.stderr, "deadbeef\n")
+	}
+
+	// A later format version is refused rather than misread
+	stream := []byte{'H', 'X', '2', 'I', 2, 0, 0, 1, 0xab}
+	blocks := image.NewNRGBA(image.Rect(0, 0, len(stream)/3, 1))
+	for i := 0; i < len(stream); i += 3 {
+		blocks.Set(i/3, 0, color.NRGBA{stream[i], stream[i+1], stream[i+2], 0xff})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, blocks); err != nil {
+		t.Fatal(err)
+	}
+	res = run(t, dir, buf.String(), "-d", "-s", "1")
+	if res.code == 0 || !strings.Contains(res.stderr, "unsupported format version 2") {
+		t.Errorf("version 2 exited with %d: %q, want a refusal", res.code, res.stderr)
+	}
+}
+
+func TestInfoFlag(t *testing.T) {
+	dir := t.TempDir()
+	// 10 bytes and the 8 of the signature, version and length header make
+	// 6 blocks
+	const hex = "00112233445566778899"
+	res := mustRun(t, dir, hex, "-info", "-b", "3", "-s", "2")
+	if res.stdout != "" {
+		t.Errorf("-info wrote %q to stdout, want nothing", res.stdout)
+	}
+	var blocks, perRow, rows, width, height, size int
+	_, err := fmt.Sscanf(res.stderr, "blocks: %d (%d per row, %d rows)\nsize: %dx%d pixels\nestimated file size: %d bytes\n",
+		&blocks, &perRow, &rows, &width, &height, &size)
+	if err != nil {
+		t.Fatalf("reading %q: %v", res.stderr, err)
+	}
+	if blocks != 6 || perRow != 3 || rows != 2 || width != 6 || height != 4 || size <= 0 {
+		t.Errorf("-info printed %q, want 6 blocks, 3 per row, 2 rows and 6x4 pixels", res.stderr)
+	}
+
+	// The image is as large as reported
+	img := mustRun(t, dir, hex, "-b", "3", "-s", "2").stdout
+	if w, h := imageSize(t, img); w != width || h != height {
+		t.Errorf("image is %dx%d, -info reported %dx%d", w, h, width, height)
+	}
+}
+
+func TestProgressFlag(t *testing.T) {
+	dir := t.TempDir()
+	res := mustRun(t, dir, strings.Repeat("00112233", 100), "-progress", "-b", "4")
+	if !strings.HasSuffix(res.stderr, "\rEncoding: 100%\n") {
+		t.Errorf("stderr is %q, want it to end with 100%% on a line of its own", res.stderr)
+	}
+	// Progress stays off stdout, which holds only the image
+	if !strings.HasPrefix(res.stdout, "\x89PNG") || strings.Contains(res.stdout, "Encoding:") {
+		t.Error("progress was written to stdout along with the image")
+	}
+
+	// Decoding reports nothing
+	if res := mustRun(t, dir, res.stdout, "-d", "-progress"); res.stderr != "" {
+		t.Errorf("decoding with -progress printed %q", res.stderr)
+	}
+}
+
+func TestInputFileArgument(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "input.hex"), []byte("deadbeef\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The file may come before the flags, and stdin is then not read
+	mustRun(t, dir, "ignored", "input.hex", "-o", "out.png")
+	if res := mustRun(t, dir, "", "-d", "out.png"); res.stdout != "deadbeef\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "deadbeef\n")
+	}
+
+	res := run(t, dir, "", "missing.hex", "-o", "out.png")
+	if res.code != exitIO || !strings.Contains(res.stderr, "missing.hex") {
+		t.Errorf("missing input file exited with %d and printed %q, want %d and the file name", res.code, res.stderr, exitIO)
+	}
+
+	// After --, even names that look like flags are files
+	if err := os.WriteFile(filepath.Join(dir, "-x"), []byte("cafe\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, dir, "ignored", "-o", "dash.png", "--", "input.hex", "-x")
+	// Two files make a payload of two parts
+	if res := mustRun(t, dir, "", "-d", "dash.png"); !strings.Contains(res.stdout, "deadbeef") || !strings.Contains(res.stdout, "cafe") {
+		t.Errorf("decoded %q, want both files", res.stdout)
+	}
+}
+
+func TestVerifyFlag(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "00112233445566778899aabb", "-c", "-s", "1", "-b", "8", "-o", "good.png")
+	res := mustRun(t, dir, "", "-verify", "-c", "good.png")
+	if res.stdout != "" || res.stderr != "OK\n" {
+		t.Errorf("good image printed %q and %q, want only OK", res.stdout, res.stderr)
+	}
+
+	// Change a payload byte, as damage in transit would
+	f, err := os.Open(filepath.Join(dir, "good.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := image.NewNRGBA(img.Bounds())
+	draw.Draw(bad, bad.Bounds(), img, image.Point{}, draw.Src)
+	bad.Pix[3*4] ^= 0x10
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, bad); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bad.png"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res = run(t, dir, "", "-verify", "-c", "-s", "1", "-b", "8", "bad.png")
+	if res.code != exitError || res.stdout != "" || !strings.HasPrefix(res.stderr, "FAIL: ") || !strings.Contains(res.stderr, "checksum") {
+		t.Errorf("corrupted image exited with %d and printed %q and %q, want %d and FAIL", res.code, res.stdout, res.stderr, exitError)
+	}
+
+	if res := run(t, dir, "not an image", "-verify"); res.code != exitImageFormat {
+		t.Errorf("verifying text exited with %d, want %d", res.code, exitImageFormat)
+	}
+	if res := run(t, dir, "", "-verify", "-o", "out.hex", "good.png"); res.code == 0 {
+		t.Error("-verify with -o succeeded, want an error")
+	}
+}
+
+func TestHexDump(t *testing.T) {
+	want := append(append([]byte("hex2img reads hex dumps\n"), make([]byte, 48)...), "the end"...)
+	for name, dump := range map[string]string{
+		"xxd": `00000000: 6865 7832 696d 6720 7265 6164 7320 6865  hex2img reads he
+00000010: 7820 6475 6d70 730a 0000 0000 0000 0000  x dumps.........
+00000020: 0000 0000 0000 0000 0000 0000 0000 0000  ................
+00000030: 0000 0000 0000 0000 0000 0000 0000 0000  ................
+00000040: 0000 0000 0000 0000 7468 6520 656e 64    ........the end
+`,
+		"hexdump -C": `00000000  68 65 78 32 69 6d 67 20  72 65 61 64 73 20 68 65  |hex2img reads he|
+00000010  78 20 64 75 6d 70 73 0a  00 00 00 00 00 00 00 00  |x dumps.........|
+00000020  00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00  |................|
+*
+00000040  00 00 00 00 00 00 00 00  74 68 65 20 65 6e 64     |........the end|
+0000004f
+`,
+	} {
+		got, err := decodeHexDump(strings.NewReader(dump), 1000)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, want)
+		}
+	}
+
+	for name, dump := range map[string]string{
+		"gap":               "00000000: 6865  he\n00000004: 6865  he\n",
+		"bad offset":        "zz: 6865  he\n",
+		"ends repeating":    "00000000  00 00  |..|\n*\n",
+		"repeat misaligned": "00000000  00 00 00  |...|\n*\n00000004  00  |.|\n",
+	} {
+		if _, err := decodeHexDump(strings.NewReader(dump), 1000); err == nil {
+			t.Errorf("%s: decoded, want an error", name)
+		}
+	}
+
+	dir := t.TempDir()
+	mustRun(t, dir, "00000000: dead beef  ....\n", "-hexdump", "-o", "out.png")
+	if res := mustRun(t, dir, "", "-d", "out.png"); res.stdout != "deadbeef\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "deadbeef\n")
+	}
+}
+
+func TestTermFlag(t *testing.T) {
+	dir := t.TempDir()
+	// 5 payload bytes and the 8-byte header make 5 blocks, 2 rows of 3,
+	// which share one line of 3 half blocks
+	res := mustRun(t, dir, "0001020304", "-term", "-b", "3")
+	lines := strings.Split(strings.TrimSuffix(res.stdout, "\n"), "\n")
+	if len(lines) != 1 || strings.Count(lines[0], "▀") != 3 || !strings.HasSuffix(lines[0], "\x1b[0m") {
+		t.Fatalf("preview is %q, want one line of 3 half blocks", res.stdout)
+	}
+	// The first block holds the "HX2" of the signature
+	if !strings.HasPrefix(lines[0], "\x1b[38;2;72;88;50m") {
+		t.Errorf("preview starts with %q, want the color of \"HX2\"", lines[0])
+	}
+	if !strings.Contains(res.stderr, "not a terminal") {
+		t.Errorf("stderr is %q, want a warning that the output is not a terminal", res.stderr)
+	}
+
+	if res := run(t, dir, "00", "-term", "-v"); res.code == 0 {
+		t.Error("-term -v succeeded, want an error")
+	}
+}
+
+func TestJSONFlag(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "00112233445566", "-b", "5", "-s", "4", "-o", "out.png")
+	res := mustRun(t, dir, "", "-d", "-json", "out.png")
+	var got map[string]any
+	if err := json.Unmarshal([]byte(res.stdout), &got); err != nil {
+		t.Fatalf("output %q is not JSON: %v", res.stdout, err)
+	}
+	want := map[string]any{"hex": "00112233445566", "bytes": 7.0, "width": 20.0, "height": 4.0, "blocksPerRow": 5.0}
+	if !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDiffFlag(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "00112233445566", "-b", "5", "-s", "2", "-o", "a.png")
+	mustRun(t, dir, "00112233445567", "-b", "5", "-s", "2", "-o", "b.png")
+	// Wide enough for 2 blocks of 8 pixels, but too low for a row of them
+	tiny := image.NewNRGBA(image.Rect(0, 0, 16, 4))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, tiny); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tiny.png"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := mustRun(t, dir, "", "-diff", "a.png", "a.png"); res.stdout != "0 of 5 blocks differ\n" {
+		t.Errorf("same images: printed %q", res.stdout)
+	}
+	res := run(t, dir, "", "-diff", "a.png", "b.png")
+	if res.code != exitError || res.stdout != "block 4: 445566 -> 445567\n1 of 5 blocks differ\n" {
+		t.Errorf("exited with %d and printed %q, want %d and the changed block", res.code, res.stdout, exitError)
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"no blocks", []string{"-diff", "-s", "8", "a.png", "tiny.png"}, exitImageFormat},
+		{"missing file", []string{"-diff", "a.png", "missing.png"}, exitIO},
+		{"one image", []string{"-diff", "a.png"}, exitError},
+	} {
+		if res := run(t, dir, "", tc.args...); res.code != tc.code {
+			t.Errorf("%s: exited with %d, want %d: %s", tc.name, res.code, tc.code, res.stderr)
+		}
+	}
+}
+
+func TestCollapseRepeats(t *testing.T) {
+	for _, tc := range []struct{ data, want string }{
+		{"abcabcabc", "abc"},
+		{"aaaa", "a"},
+		{"abab", "ab"},
+		{"abcab", "abcab"},
+		{"a", "a"},
+		{"", ""},
+	} {
+		if got := collapseRepeats([]byte(tc.data)); string(got) != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestTileFlag(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "c0ffee", "-t", "4", "-o", "out.png")
+	if res := mustRun(t, dir, "", "-d", "out.png"); res.stdout != strings.Repeat("c0ffee", 4)+"\n" {
+		t.Errorf("decoded %q, want 4 copies", res.stdout)
+	}
+	if res := mustRun(t, dir, "", "-d", "-dedup", "out.png"); res.stdout != "c0ffee\n" {
+		t.Errorf("decoded with -dedup %q, want %q", res.stdout, "c0ffee\n")
+	}
+	if res := run(t, dir, "c0ffee", "-t", "0", "-o", "bad.png"); res.code == 0 {
+		t.Error("-t 0 succeeded, want an error")
+	}
+}
+
+func TestComments(t *testing.T) {
+	text := "# header\nde ad // magic\nbe#ef\nef\n"
+	got, err := decodeText(iotest.OneByteReader(strings.NewReader(text)), input{enc: encodingHex, comments: true}, 100)
+	if err != nil || !bytes.Equal(got, []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("got %x, %v, want deadbeef", got, err)
+	}
+
+	// Without comments, # is kept and fails to decode as hex
+	if _, err := decodeText(strings.NewReader(text), input{enc: encodingHex}, 100); err == nil {
+		t.Error("comments decoded as hex, want an error")
+	}
+	// Base64 has / among its digits, so comments are never stripped from it
+	got, err = decodeText(strings.NewReader("//8=\n"), input{enc: encodingBase64, comments: true}, 100)
+	if err != nil || !bytes.Equal(got, []byte{0xff, 0xff}) {
+		t.Errorf("base64: got %x, %v, want ffff", got, err)
+	}
+
+	dir := t.TempDir()
+	mustRun(t, dir, "dead # first\nbeef // second\n", "-o", "out.png")
+	if res := mustRun(t, dir, "", "-d", "out.png"); res.stdout != "deadbeef\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "deadbeef\n")
+	}
+	if res := run(t, dir, "dead # first\n", "-nocomments", "-o", "bad.png"); res.code == 0 {
+		t.Error("-nocomments kept the comment and succeeded, want an error")
+	}
+}
+
+func TestStatsFlag(t *testing.T) {
+	dir := t.TempDir()
+	zeros := strings.Repeat("00", 30)
+	res := mustRun(t, dir, zeros, "-stats", "-o", "stats.png")
+	// Three header blocks and the zero blocks of the payload
+	want := "distinct block colors: 4\nmost common byte: 00 (30 of 30 bytes)\nentropy: 0.000 bits per byte\n"
+	if res.stderr != want {
+		t.Errorf("printed %q, want %q", res.stderr, want)
+	}
+	res = mustRun(t, dir, "000102030405060708090a0b0c0d0e0f", "-stats", "-o", "stats.png")
+	if !strings.Contains(res.stderr, "entropy: 4.000 bits per byte\n") {
+		t.Errorf("printed %q, want 4 bits of entropy for 16 distinct bytes", res.stderr)
+	}
+
+	// The image is the same as without -stats
+	mustRun(t, dir, "000102030405060708090a0b0c0d0e0f", "-o", "plain.png")
+	withStats, err := os.ReadFile(filepath.Join(dir, "stats.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := os.ReadFile(filepath.Join(dir, "plain.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(withStats, plain) {
+		t.Error("-stats changed the image")
+	}
+}
+
+func TestPrintStats(t *testing.T) {
+	var buf bytes.Buffer
+	if err := printStats(&buf, []byte{1, 1, 1, 2}, hex2img.Options{PixelSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "most common byte: 01 (3 of 4 bytes)\nentropy: 0.811 bits per byte\n"; !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("printed %q, want it to end in %q", buf.String(), want)
+	}
+}
+
+func TestURLFlag(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "deadbeef", "-o", "out.png")
+	mustRun(t, dir, "deadbeef", "-v", "-o", "out.svg")
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	for _, name := range []string{"out.png", "out.svg"} {
+		if res := mustRun(t, dir, "", "-d", "-url", srv.URL+"/"+name); res.stdout != "deadbeef\n" {
+			t.Errorf("%s: decoded %q, want %q", name, res.stdout, "deadbeef\n")
+		}
+	}
+	res := run(t, dir, "", "-d", "-url", srv.URL+"/missing.png")
+	if res.code != exitIO || !strings.Contains(res.stderr, "404") {
+		t.Errorf("missing image exited with %d and printed %q, want %d and the status", res.code, res.stderr, exitIO)
+	}
+	srv.Close()
+	if res := run(t, dir, "", "-d", "-url", srv.URL+"/out.png"); res.code != exitIO {
+		t.Errorf("unreachable server: exited with %d, want %d", res.code, exitIO)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	config := "# defaults\ns = 3 # pixels\nb = 2\n\nbg = \"#102030\"\n"
+	if err := os.WriteFile(filepath.Join(dir, ".hex2img.toml"), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, dir, "00112233445566", "-o", "out.png")
+	img, err := os.ReadFile(filepath.Join(dir, "out.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := imageSize(t, string(img)); w != 6 || h != 9 {
+		t.Errorf("image is %dx%d, want 6x9", w, h)
+	}
+	// 15 bytes make 5 blocks, so the last of the 3 rows has an unused block
+	m, err := png.Decode(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := color.NRGBAModel.Convert(m.At(5, 8)); c != (color.NRGBA{0x10, 0x20, 0x30, 0xff}) {
+		t.Errorf("unused block is %v, want the quoted -bg color", c)
+	}
+	// Flags on the command line win
+	if w, _ := imageSize(t, mustRun(t, dir, "00112233445566", "-s", "1").stdout); w != 2 {
+		t.Errorf("image is %d pixels wide, want 2", w)
+	}
+
+	for name, config := range map[string]string{
+		"unknown flag": "nosuchflag = 1\n",
+		"no value":     "s\n",
+		"bad value":    "s = big\n",
+		"bad string":   "bg = \"open\n",
+	} {
+		path := filepath.Join(dir, "bad.toml")
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if res := run(t, dir, "00", "-config", path, "-o", "bad.png"); res.code == 0 || !strings.Contains(res.stderr, "bad.toml:1") {
+			t.Errorf("%s: exited with %d and printed %q, want an error at bad.toml:1", name, res.code, res.stderr)
+		}
+	}
+	if res := run(t, dir, "00", "-config", "missing.toml", "-o", "bad.png"); res.code == 0 {
+		t.Error("a missing -config file succeeded, want an error")
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	dir := t.TempDir()
+	res := mustRun(t, dir, "", "-selftest")
+	for _, format := range []string{"png", "svg", "jpeg", "gif", "bmp", "tiff", "webp"} {
+		if !strings.Contains(res.stdout, "PASS "+format+"\n") {
+			t.Errorf("output %q lacks a pass for %s", res.stdout, format)
+		}
+	}
+	// Modes some formats cannot hold skip them
+	res = mustRun(t, dir, "", "-selftest", "-bits", "2")
+	if !strings.Contains(res.stdout, "PASS png\n") || !strings.Contains(res.stdout, "SKIP jpeg: ") {
+		t.Errorf("-bits 2: output %q, want PNG to pass and JPEG to be skipped", res.stdout)
+	}
+
+	var out strings.Builder
+	opts := hex2img.Options{PixelSize: 1, Grid: true}
+	if runSelfTest(&out, []hex2img.Format{hex2img.FormatBMP}, opts) || !strings.HasPrefix(out.String(), "FAIL bmp: ") {
+		t.Errorf("a single format that cannot hold the modes printed %q, want it to fail", out.String())
+	}
+}
+
+func TestHashNameFlag(t *testing.T) {
+	dir := t.TempDir()
+	res := mustRun(t, dir, "deadbeef", "-hashname", "-o", "images")
+	path := strings.TrimSuffix(res.stderr, "\n")
+	img, err := os.ReadFile(filepath.Join(dir, path))
+	if err != nil {
+		t.Fatalf("reading the printed path %q: %v", path, err)
+	}
+	sum := sha256.Sum256(img)
+	if want := filepath.Join("images", hex.EncodeToString(sum[:])+".png"); path != want {
+		t.Errorf("wrote %s, want %s", path, want)
+	}
+	if again := mustRun(t, dir, "deadbeef", "-hashname", "-o", "images"); again.stderr != res.stderr {
+		t.Errorf("the same image went to %q and %q", res.stderr, again.stderr)
+	}
+	if res := mustRun(t, dir, "deadbeef", "-hashname", "-bmp", "-o", "images"); !strings.HasSuffix(res.stderr, ".bmp\n") {
+		t.Errorf("BMP went to %q, want a .bmp file", res.stderr)
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "images")); err != nil || len(entries) != 2 {
+		t.Errorf("images holds %d files, %v, want 2", len(entries), err)
+	}
+
+	if res := run(t, dir, "deadbeef", "-hashname"); res.code == 0 {
+		t.Error("-hashname without -o succeeded, want an error")
+	}
+}
+
+func TestQuietFlag(t *testing.T) {
+	dir := t.TempDir()
+	if res := mustRun(t, dir, "01020304", "-b", "100", "-o", "out.png"); !strings.Contains(res.stderr, "Warning: ") {
+		t.Fatalf("printed %q, want a warning to silence", res.stderr)
+	}
+	if res := mustRun(t, dir, "01020304", "-b", "100", "-quiet", "-o", "out.png"); res.stderr != "" {
+		t.Errorf("-quiet printed %q, want nothing", res.stderr)
+	}
+	if res := run(t, dir, "0102030", "-quiet", "-o", "out.png"); res.code == 0 || !strings.HasPrefix(res.stderr, "Error") {
+		t.Errorf("-quiet exited with %d and printed %q, want the error still printed", res.code, res.stderr)
+	}
+}
+
+func TestGoSrcFlag(t *testing.T) {
+	dir := t.TempDir()
+	res := mustRun(t, dir, "00112233445566", "-gosrc")
+	formatted, err := format.Source([]byte(res.stdout))
+	if err != nil {
+		t.Fatalf("output is not Go: %v\n%s", err, res.stdout)
+	}
+	if string(formatted) != res.stdout {
+		t.Errorf("output is not gofmt-ed:\n%s", res.stdout)
+	}
+	// The signature, version and length header, then the payload
+	for _, block := range []string{"{0x48, 0x58, 0x32},", "{0x49, 0x01, 0x00},", "{0x44, 0x55, 0x66},"} {
+		if !strings.Contains(res.stdout, "\t"+block+"\n") {
+			t.Errorf("output lacks the block %s:\n%s", block, res.stdout)
+		}
+	}
+	// 5 blocks make a square of 3 by 2, completed by a block of fill bytes
+	if n := strings.Count(res.stdout, "0x"); n != 6*3 {
+		t.Errorf("output holds %d bytes, want the 18 of 6 blocks", n)
+	}
+
+	if res := mustRun(t, dir, "00112233445566", "-gosrc", "-a"); !strings.Contains(res.stdout, "var blocks = [][4]byte{") {
+		t.Errorf("alpha blocks are not 4 bytes:\n%s", res.stdout)
+	}
+}
+
+func TestAtomicOutput(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.png")
+	mustRun(t, dir, "deadbeef", "-o", "out.png")
+	if fi, err := os.Stat(out); err != nil || fi.Mode().Perm() != 0o644 {
+		t.Fatalf("new output: %v, %v, want mode 0644", fi, err)
+	}
+	before, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failure leaves the earlier file as it was, and no temporary one
+	if res := run(t, dir, "not hex", "-o", "out.png"); res.code == 0 {
+		t.Fatal("encoding text that is not hex succeeded")
+	}
+	if after, err := os.ReadFile(out); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("a failed encode changed the output: %v", err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("the directory holds %d files, %v, want only out.png", len(entries), err)
+	}
+	err = withFiles("", filepath.Join(dir, "new.png"), func(_ io.Reader, w io.Writer) error {
+		w.Write([]byte("partial"))
+		return errors.New("failed midway")
+	})
+	if _, statErr := os.Stat(filepath.Join(dir, "new.png")); err == nil || !os.IsNotExist(statErr) {
+		t.Errorf("a failure midway returned %v and left new.png: %v", err, statErr)
+	}
+
+	// Replacing a file keeps its mode
+	if err := os.Chmod(out, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, dir, "c0ffee", "-o", "out.png")
+	if fi, err := os.Stat(out); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("replaced output: %v, %v, want mode 0600", fi, err)
+	}
+}
+
+func TestEqualize(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for i, c := range []color.NRGBA{{10, 10, 10, 0x80}, {10, 12, 10, 0x80}, {11, 12, 10, 0xff}, {11, 12, 10, 0xff}} {
+		img.SetNRGBA(i%2, i/2, c)
+	}
+	// Levels spread over the whole range, except in blue, which has only one
+	out := equalize(img)
+	for i, want := range []color.NRGBA{{0, 0, 10, 0xff}, {0, 255, 10, 0xff}, {255, 255, 10, 0xff}, {255, 255, 10, 0xff}} {
+		if got := out.NRGBAAt(i%2, i/2); got != want {
+			t.Errorf("pixel %d is %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestPreviewFlag(t *testing.T) {
+	dir := t.TempDir()
+	hex := "0001020304050607"
+	mustRun(t, dir, hex, "-s", "3", "-preview", "preview.png", "-o", "out.png")
+	mustRun(t, dir, hex, "-s", "3", "-o", "plain.png")
+	files := make(map[string]string)
+	for _, name := range []string{"out.png", "preview.png", "plain.png"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = string(data)
+	}
+	w, h := imageSize(t, files["out.png"])
+	if pw, ph := imageSize(t, files["preview.png"]); pw != 2*w || ph != 2*h {
+		t.Errorf("preview is %dx%d, want twice the %dx%d image", pw, ph, w, h)
+	}
+	// The image itself is as without a preview
+	if files["out.png"] != files["plain.png"] {
+		t.Error("-preview changed the image")
+	}
+	if res := run(t, dir, "", "-d", "-preview", "preview.png", "out.png"); res.code == 0 {
+		t.Error("-preview when decoding succeeded, want an error")
+	}
+
+	// SVG-only options stay out of the PNG preview
+	mustRun(t, dir, hex, "-s", "3", "-v", "-labels", "-scale", "2", "-preview", "labelled.png", "-o", "out.svg")
+	labelled, err := os.ReadFile(filepath.Join(dir, "labelled.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pw, ph := imageSize(t, string(labelled)); pw != 2*w || ph != 2*h {
+		t.Errorf("preview of an SVG is %dx%d, want twice the %dx%d image", pw, ph, w, h)
+	}
+}
+
+func TestClipFlag(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the fake clipboard tool is a Linux shell script")
+	}
+	dir := t.TempDir()
+	mustRun(t, dir, "deadbeef", "-o", "out.png")
+
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+	res := run(t, dir, "", "-d", "-clip")
+	if res.code == 0 || !strings.Contains(res.stderr, "needs wl-paste or xclip to be installed") {
+		t.Errorf("without tools: exited with %d and printed %q, want an error naming them", res.code, res.stderr)
+	}
+
+	// wl-paste is missing, so xclip is used
+	script := "#!/bin/sh\nexec /bin/cat " + filepath.Join(dir, "out.png") + "\n"
+	if err := os.WriteFile(filepath.Join(bin, "xclip"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if res := mustRun(t, dir, "", "-d", "-clip"); res.stdout != "deadbeef\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "deadbeef\n")
+	}
+}
+
+func TestCheckFlag(t *testing.T) {
+	dir := t.TempDir()
+	hex := strings.Repeat("0123456789abcdef", 8)
+	if res := mustRun(t, dir, hex, "-check", "-o", "out.png"); res.stderr != "" {
+		t.Errorf("a lossless image printed %q, want nothing", res.stderr)
+	}
+	// JPEG mangles RGB blocks, which -check reports without failing
+	res := mustRun(t, dir, hex, "-check", "-j", "-q", "30", "-o", "out.jpg")
+	if !strings.Contains(res.stderr, "Warning: -check: the image") {
+		t.Errorf("a lossy image printed %q, want a warning", res.stderr)
+	}
+
+	var img bytes.Buffer
+	if err := hex2img.Write(&img, []byte{1, 2, 3, 4}, hex2img.Options{PixelSize: 4}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var warnings strings.Builder
+	checkImage(&img, []byte{1, 2, 9, 4}, hex2img.Options{Warnings: &warnings})
+	if want := "Warning: -check: the image decodes to 4 bytes that differ from the 4 of the input from byte 2 on\n"; warnings.String() != want {
+		t.Errorf("printed %q, want %q", warnings.String(), want)
+	}
+}
+
+func TestBase32(t *testing.T) {
+	for _, text := range []string{"32W34===", "32W34", "32w34", "32W\n34\n"} {
+		got, err := decodeText(iotest.OneByteReader(strings.NewReader(text)), input{enc: encodingBase32}, 100)
+		if err != nil || !bytes.Equal(got, []byte{0xde, 0xad, 0xbe}) {
+			t.Errorf("%q: got %x, %v, want deadbe", text, got, err)
+		}
+	}
+
+	dir := t.TempDir()
+	mustRun(t, dir, "32W353YA\n", "-base32", "-o", "out.png")
+	if res := mustRun(t, dir, "", "-d", "out.png"); res.stdout != "deadbeef00\n" {
+		t.Errorf("decoded to hex %q, want %q", res.stdout, "deadbeef00\n")
+	}
+	if res := mustRun(t, dir, "", "-d", "-base32", "out.png"); res.stdout != "32W353YA\n" {
+		t.Errorf("decoded to base32 %q, want %q", res.stdout, "32W353YA\n")
+	}
+	if res := run(t, dir, "1890", "-base32", "-o", "bad.png"); res.code == 0 {
+		t.Error("invalid base32 input succeeded, want an error")
+	}
+}
+
+func TestSplitSizeFlag(t *testing.T) {
+	dir := t.TempDir()
+	hex := strings.Repeat("0123456789abcdef", 112)
+	mustRun(t, dir, hex, "-s", "1", "-split-size", "16x8", "-o", "out.png")
+	names := []string{"out.000.png", "out.001.png", "out.002.png"}
+	for _, name := range names {
+		img, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w, h := imageSize(t, string(img)); w > 16 || h > 8 {
+			t.Errorf("%s is %dx%d, larger than 16x8", name, w, h)
+		}
+	}
+	for _, name := range []string{"out.png", "out.003.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("the payload split into 3 images also wrote %s", name)
+		}
+	}
+	if res := mustRun(t, dir, "", "-d", names[2], names[0], names[1]); res.stdout != hex+"\n" {
+		t.Errorf("decoded %d characters, want the %d of the input", len(res.stdout)-1, len(hex))
+	}
+	if res := run(t, dir, "", "-d", names[1]); res.code == 0 || !strings.Contains(res.stderr, "give all images of the sequence") {
+		t.Errorf("a single part exited with %d and printed %q, want an error asking for the others", res.code, res.stderr)
+	}
+
+	// Compressed parts are measured as written, headers included, so that
+	// none outgrows the size by a row
+	rng := rand.New(rand.NewPCG(1, 2))
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = "\x00\x01abc"[rng.IntN(5)]
+		if rng.IntN(3) == 0 {
+			payload[i] = byte(rng.Uint32())
+		}
+	}
+	hex = fmt.Sprintf("%x", payload)
+	for _, bound := range []image.Point{{12, 12}, {16, 8}, {20, 10}, {24, 8}} {
+		size := fmt.Sprintf("%dx%d", bound.X, bound.Y)
+		sub := filepath.Join(dir, size)
+		if err := os.Mkdir(sub, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		mustRun(t, sub, hex, "-z", "-s", "1", "-split-size", size, "-o", "out.png")
+		parts, err := filepath.Glob(filepath.Join(sub, "out.*.png"))
+		if err != nil || len(parts) < 2 {
+			t.Fatalf("%s: wrote %v, %v, want several parts", size, parts, err)
+		}
+		for _, part := range parts {
+			img, err := os.ReadFile(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w, h := imageSize(t, string(img)); w > bound.X || h > bound.Y {
+				t.Errorf("%s is %dx%d, larger than %s", filepath.Base(part), w, h, size)
+			}
+		}
+		if res := mustRun(t, sub, "", append([]string{"-d", "-z"}, parts...)...); res.stdout != hex+"\n" {
+			t.Errorf("%s: decoded %d characters, want the %d of the input", size, len(res.stdout)-1, len(hex))
+		}
+	}
+
+	// A payload that fits is written to the file as given
+	mustRun(t, dir, "deadbeef", "-s", "1", "-split-size", "16x8", "-o", "small.png")
+	if res := mustRun(t, dir, "", "-d", "small.png"); res.stdout != "deadbeef\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "deadbeef\n")
+	}
+}
+
+func TestHexFlag(t *testing.T) {
+	dir := t.TempDir()
+	// The payload comes from the flag, so stdin is not read
+	mustRun(t, dir, "ignored", "-hex", "0xDE:AD be ef", "-o", "out.png")
+	if res := mustRun(t, dir, "", "-d", "out.png"); res.stdout != "deadbeef\n" {
+		t.Errorf("decoded %q, want %q", res.stdout, "deadbeef\n")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "input.hex"), []byte("00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-hex", "dead", "input.hex", "-o", "bad.png"},
+		{"-hex", "dead", "-i", "input.hex", "-o", "bad.png"},
+		{"-hex", "dead", "-base64", "-o", "bad.png"},
+		{"-hex", "dead", "-d", "out.png"},
+	} {
+		if res := run(t, dir, "", args...); res.code == 0 {
+			t.Errorf("%v succeeded, want an error", args)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package hex2img
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	data := []byte("attack at dawn")
+	sealed, err := encrypt(data, "secret")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if bytes.Contains(sealed, data) {
+		t.Error("sealed payload holds the plain text")
+	}
+	again, err := encrypt(data, "secret")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if bytes.Equal(again, sealed) {
+		t.Error("two encryptions are the same, want a random salt and nonce")
+	}
+
+	got, err := decrypt(sealed, "secret")
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	for name, tc := range map[string]struct {
+		data       []byte
+		passphrase string
+	}{
+		"wrong passphrase": {sealed, "Secret"},
+		"altered":          {tampered, "secret"},
+		"truncated":        {sealed[:saltSize+4], "secret"},
+	} {
+		if _, err := decrypt(tc.data, tc.passphrase); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: got %v, want ErrDecrypt", name, err)
+		}
+	}
+}
+
+func TestReadWrongPassphrase(t *testing.T) {
+	opts := Options{PixelSize: 4, Passphrase: "secret"}
+	var buf bytes.Buffer
+	if err := Write(&buf, []byte("attack at dawn"), opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	opts.Passphrase = "guess"
+	if _, err := Read(&buf, opts); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("got %v, want ErrDecrypt", err)
+	}
+}
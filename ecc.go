@@ -0,0 +1,374 @@
+package hex2img
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Reed-Solomon error correction over GF(2^8).
+//
+// The stream is cut into groups of 255 blocks, each holding 255-n data
+// blocks followed by n parity blocks. Every channel of the blocks forms its
+// own codeword, so a corrupted block costs one symbol in each codeword and a
+// group survives up to n/2 corrupted blocks.
+
+const rsGroupSize = 255
+
+// eccFlag is set in the format version byte of the header that precedes
+// the groups and records their number of parity blocks, so that decoding
+// needs no option for it. No parity protects the header itself, so after
+// the magic signature and version byte it holds three copies of the version
+// byte and the number, each in blocks of its own, and decoding takes the
+// majority.
+const eccFlag = 0x10
+
+var gfExp, gfLog = gfTables()
+
+// gfTables builds the exponent and logarithm tables for the field generated
+// by the primitive polynomial x^8+x^4+x^3+x^2+1. The exponent table is
+// doubled so products of two logarithms index it without a modulo.
+func gfTables() (exp [512]byte, log [256]int) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(exp); i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}
+
+func gfMul(x, y byte) byte {
+	if x == 0 || y == 0 {
+		return 0
+	}
+	return gfExp[gfLog[x]+gfLog[y]]
+}
+
+func gfDiv(x, y byte) byte {
+	if x == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[x]+255-gfLog[y])%255]
+}
+
+func gfPow(x byte, power int) byte {
+	return gfExp[((gfLog[x]*power)%255+255)%255]
+}
+
+func gfInverse(x byte) byte {
+	return gfExp[255-gfLog[x]]
+}
+
+// Polynomials are stored with the highest degree coefficient first.
+
+func polyScale(p []byte, x byte) []byte {
+	r := make([]byte, len(p))
+	for i, c := range p {
+		r[i] = gfMul(c, x)
+	}
+	return r
+}
+
+func polyAdd(p, q []byte) []byte {
+	r := make([]byte, max(len(p), len(q)))
+	for i, c := range p {
+		r[i+len(r)-len(p)] = c
+	}
+	for i, c := range q {
+		r[i+len(r)-len(q)] ^= c
+	}
+	return r
+}
+
+func polyMul(p, q []byte) []byte {
+	r := make([]byte, len(p)+len(q)-1)
+	for j, b := range q {
+		for i, a := range p {
+			r[i+j] ^= gfMul(a, b)
+		}
+	}
+	return r
+}
+
+func polyEval(p []byte, x byte) byte {
+	y := p[0]
+	for _, c := range p[1:] {
+		y = gfMul(y, x) ^ c
+	}
+	return y
+}
+
+// polyMod returns the remainder of dividing p by the monic divisor d.
+func polyMod(p, d []byte) []byte {
+	out := append([]byte(nil), p...)
+	for i := 0; i < len(p)-len(d)+1; i++ {
+		coef := out[i]
+		if coef == 0 {
+			continue
+		}
+		for j := 1; j < len(d); j++ {
+			out[i+j] ^= gfMul(d[j], coef)
+		}
+	}
+	return out[len(out)-len(d)+1:]
+}
+
+func reverse(p []byte) []byte {
+	r := make([]byte, len(p))
+	for i, c := range p {
+		r[len(p)-1-i] = c
+	}
+	return r
+}
+
+// rsGenerator returns the generator polynomial with roots α^0..α^(n-1).
+func rsGenerator(n int) []byte {
+	g := []byte{1}
+	for i := 0; i < n; i++ {
+		g = polyMul(g, []byte{1, gfPow(2, i)})
+	}
+	return g
+}
+
+// rsParity returns the n parity symbols of msg.
+func rsParity(msg []byte, n int) []byte {
+	return polyMod(append(append([]byte(nil), msg...), make([]byte, n)...), rsGenerator(n))
+}
+
+// rsSyndromes evaluates the codeword at the generator roots. The leading
+// zero keeps the indices aligned with the usual formulation.
+func rsSyndromes(code []byte, n int) []byte {
+	synd := make([]byte, n+1)
+	for i := 0; i < n; i++ {
+		synd[i+1] = polyEval(code, gfPow(2, i))
+	}
+	return synd
+}
+
+// rsCorrect repairs code, n of whose symbols are parity, in place and
+// returns the positions it changed.
+func rsCorrect(code []byte, n int) ([]int, error) {
+	synd := rsSyndromes(code, n)
+	if isZero(synd) {
+		return nil, nil
+	}
+
+	errLoc, err := rsErrorLocator(synd, n)
+	if err != nil {
+		return nil, err
+	}
+	errPos, err := rsFindErrors(reverse(errLoc), len(code))
+	if err != nil {
+		return nil, err
+	}
+	rsCorrectErrata(code, synd, errPos)
+
+	if !isZero(rsSyndromes(code, n)) {
+		return nil, fmt.Errorf("too many corrupted blocks to repair")
+	}
+	return errPos, nil
+}
+
+// rsErrorLocator runs Berlekamp-Massey on the syndromes.
+func rsErrorLocator(synd []byte, n int) ([]byte, error) {
+	errLoc, oldLoc := []byte{1}, []byte{1}
+	shift := len(synd) - n
+	for i := 0; i < n; i++ {
+		k := i + shift
+		delta := synd[k]
+		for j := 1; j < len(errLoc); j++ {
+			delta ^= gfMul(errLoc[len(errLoc)-1-j], synd[k-j])
+		}
+		oldLoc = append(oldLoc, 0)
+		if delta != 0 {
+			if len(oldLoc) > len(errLoc) {
+				newLoc := polyScale(oldLoc, delta)
+				oldLoc = polyScale(errLoc, gfInverse(delta))
+				errLoc = newLoc
+			}
+			errLoc = polyAdd(errLoc, polyScale(oldLoc, delta))
+		}
+	}
+
+	for len(errLoc) > 0 && errLoc[0] == 0 {
+		errLoc = errLoc[1:]
+	}
+	if (len(errLoc)-1)*2 > n {
+		return nil, fmt.Errorf("too many corrupted blocks to repair")
+	}
+	return errLoc, nil
+}
+
+// rsFindErrors finds the roots of the error locator by Chien search.
+func rsFindErrors(errLoc []byte, length int) ([]int, error) {
+	var pos []int
+	for i := 0; i < length; i++ {
+		if polyEval(errLoc, gfPow(2, i)) == 0 {
+			pos = append(pos, length-1-i)
+		}
+	}
+	if len(pos) != len(errLoc)-1 {
+		return nil, fmt.Errorf("too many corrupted blocks to repair")
+	}
+	return pos, nil
+}
+
+// rsCorrectErrata computes the error magnitudes with the Forney algorithm
+// and removes them from code.
+func rsCorrectErrata(code, synd []byte, errPos []int) {
+	coefPos := make([]int, len(errPos))
+	for i, p := range errPos {
+		coefPos[i] = len(code) - 1 - p
+	}
+
+	errLoc := []byte{1}
+	for _, p := range coefPos {
+		errLoc = polyMul(errLoc, polyAdd([]byte{1}, []byte{gfPow(2, p), 0}))
+	}
+	divisor := append([]byte{1}, make([]byte, len(errLoc))...)
+	errEval := reverse(polyMod(polyMul(reverse(synd), errLoc), divisor))
+
+	x := make([]byte, len(coefPos))
+	for i, p := range coefPos {
+		x[i] = gfPow(2, -(255 - p))
+	}
+	for i, xi := range x {
+		xiInv := gfInverse(xi)
+		prime := byte(1)
+		for j, xj := range x {
+			if j != i {
+				prime = gfMul(prime, 1^gfMul(xiInv, xj))
+			}
+		}
+		y := gfMul(xi, polyEval(reverse(errEval), xiInv))
+		code[errPos[i]] ^= gfDiv(y, prime)
+	}
+}
+
+func isZero(p []byte) bool {
+	for _, c := range p {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// eccEncode pads stream to whole groups of 255-n data blocks and appends n
+// parity blocks to every group.
+func eccEncode(stream []byte, n, bpb int) []byte {
+	k := rsGroupSize - n
+	groups := (len(stream) + k*bpb - 1) / (k * bpb)
+	stream = append(stream, make([]byte, groups*k*bpb-len(stream))...)
+
+	out := make([]byte, 0, groups*rsGroupSize*bpb)
+	msg := make([]byte, k)
+	for g := 0; g < groups; g++ {
+		data := stream[g*k*bpb : (g+1)*k*bpb]
+		out = append(out, data...)
+		parity := make([]byte, n*bpb)
+		for ch := 0; ch < bpb; ch++ {
+			for t := range msg {
+				msg[t] = data[t*bpb+ch]
+			}
+			for t, p := range rsParity(msg, n) {
+				parity[t*bpb+ch] = p
+			}
+		}
+		out = append(out, parity...)
+	}
+	return out
+}
+
+// eccDecode repairs every whole group in stream and returns the data blocks
+// with the parity removed, along with the number of blocks it repaired.
+// Blocks after the last whole group are grid padding and are dropped.
+func eccDecode(stream []byte, n, bpb int) ([]byte, int, error) {
+	k := rsGroupSize - n
+	groups := len(stream) / (rsGroupSize * bpb)
+	out := make([]byte, 0, groups*k*bpb)
+	code := make([]byte, rsGroupSize)
+	repaired := 0
+	for g := 0; g < groups; g++ {
+		group := append([]byte(nil), stream[g*rsGroupSize*bpb:(g+1)*rsGroupSize*bpb]...)
+		bad := make(map[int]bool)
+		for ch := 0; ch < bpb; ch++ {
+			for t := range code {
+				code[t] = group[t*bpb+ch]
+			}
+			pos, err := rsCorrect(code, n)
+			if err != nil {
+				return nil, 0, fmt.Errorf("block group %d: %w", g+1, err)
+			}
+			for _, t := range pos {
+				group[t*bpb+ch] = code[t]
+				bad[t] = true
+			}
+		}
+		repaired += len(bad)
+		out = append(out, group[:k*bpb]...)
+	}
+	return out, repaired, nil
+}
+
+// addECCHeader prefixes stream with the header recording its n parity
+// blocks per group. Its parts are padded to whole blocks of bpb bytes, so
+// that a corrupted block spoils at most one of them and the groups stay
+// aligned with the blocks.
+func addECCHeader(stream []byte, n, bpb int) []byte {
+	header := append([]byte(magic), formatVersion|eccFlag)
+	header = append(header, make([]byte, roundUp(len(header), bpb)-len(header))...)
+	for range 3 {
+		header = append(header, formatVersion|eccFlag, byte(n))
+		header = append(header, make([]byte, roundUp(2, bpb)-2)...)
+	}
+	return append(header, stream...)
+}
+
+// stripECCHeader removes the header added by addECCHeader and returns the
+// number of parity blocks it records, or stream and 0 if it has none. A
+// stream opening with the signature and another version has none. Two
+// copies must agree after the signature and version of the header, or all
+// three when those are corrupted.
+func stripECCHeader(stream []byte, bpb int) ([]byte, int) {
+	start, size := roundUp(len(magic)+1, bpb), roundUp(2, bpb)
+	end := start + 3*size
+	if len(stream) < end {
+		return stream, 0
+	}
+	version := stream[len(magic)]
+	signed := bytes.HasPrefix(stream, []byte(magic))
+	if signed && version&^flagMask == formatVersion {
+		return stream, 0
+	}
+	need := 3
+	if signed && version == formatVersion|eccFlag {
+		need = 2
+	}
+	votes := make(map[byte]int)
+	for i := start; i < end; i += size {
+		if n := stream[i+1]; stream[i] == formatVersion|eccFlag && n > 0 && int(n) < rsGroupSize {
+			votes[n]++
+			if votes[n] == need {
+				return stream[end:], int(n)
+			}
+		}
+	}
+	return stream, 0
+}
+
+// eccHeaderLen is the length of the header added by addECCHeader.
+func eccHeaderLen(bpb int) int {
+	return roundUp(len(magic)+1, bpb) + 3*roundUp(2, bpb)
+}
+
+// roundUp rounds n up to whole blocks of bpb bytes.
+func roundUp(n, bpb int) int {
+	return (n + bpb - 1) / bpb * bpb
+}
@@ -0,0 +1,166 @@
+package hex2img
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+func TestECCRepairs(t *testing.T) {
+	const n, bpb = 8, 3
+	data := make([]byte, 600*bpb)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	encoded := eccEncode(bytes.Clone(data), n, bpb)
+	if groups := len(encoded) / (rsGroupSize * bpb); groups != 3 || len(encoded) != groups*rsGroupSize*bpb {
+		t.Fatalf("encoded %d bytes, want 3 whole groups", len(encoded))
+	}
+
+	// n/2 corrupted blocks in every group, parity blocks among them
+	corrupt := bytes.Clone(encoded)
+	for g := range 3 {
+		for _, b := range []int{0, 100, 200, rsGroupSize - 1} {
+			corrupt[(g*rsGroupSize+b)*bpb+g] ^= 0x5a
+		}
+	}
+	got, repaired, err := eccDecode(corrupt, n, bpb)
+	if err != nil {
+		t.Fatalf("eccDecode: %v", err)
+	}
+	if repaired != 12 {
+		t.Errorf("repaired %d blocks, want 12", repaired)
+	}
+	if !bytes.Equal(got[:len(data)], data) {
+		t.Error("repaired data differs")
+	}
+
+	for _, b := range []int{10, 20, 30, 40, 50} {
+		corrupt[b*bpb] ^= 0xff
+	}
+	if _, _, err := eccDecode(corrupt, n, bpb); err == nil || !strings.Contains(err.Error(), "block group 1") {
+		t.Errorf("got %v, want too many corrupted blocks in group 1", err)
+	}
+}
+
+func TestReadRepairsBlocks(t *testing.T) {
+	data := bytes.Repeat([]byte("hex2img "), 40)
+	opts := Options{PixelSize: 4, BlocksPerRow: 16, ECC: 10}
+	img, err := Encode(data, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	rgba := image.NewNRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	for _, p := range []image.Point{{24, 0}, {20, 8}, {60, 40}} {
+		draw.Draw(rgba, image.Rect(p.X, p.Y, p.X+4, p.Y+4), image.White, image.Point{}, draw.Src)
+	}
+
+	var warnings strings.Builder
+	opts.Warnings = &warnings
+	got, err := Decode(rgba, opts)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+	if !strings.Contains(warnings.String(), "repaired 3 corrupted blocks") {
+		t.Errorf("warnings %q, want the count of repaired blocks", warnings.String())
+	}
+}
+
+// corruptBlocks returns img, with PixelSize 4 and BlocksPerRow 16, with the
+// given blocks painted white.
+func corruptBlocks(img image.Image, blocks ...int) *image.NRGBA {
+	rgba := image.NewNRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	for _, b := range blocks {
+		x, y := b%16*4, b/16*4
+		draw.Draw(rgba, image.Rect(x, y, x+4, y+4), image.White, image.Point{}, draw.Src)
+	}
+	return rgba
+}
+
+func TestReadECCOfBMP(t *testing.T) {
+	data := bytes.Repeat([]byte("hex2img "), 40)
+	for _, noMagic := range []bool{false, true} {
+		opts := Options{PixelSize: 4, BlocksPerRow: 16, ECC: 10, NoMagic: noMagic}
+		img, err := Encode(data, opts)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := bmp.Encode(&buf, corruptBlocks(img, 20)); err != nil {
+			t.Fatal(err)
+		}
+		encoded := buf.Bytes()
+
+		got, err := Read(bytes.NewReader(encoded), opts)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("no magic %v, with ECC: got %q, %v", noMagic, got, err)
+		}
+		// The header records the parity blocks, unless it is left out
+		got, err = Read(bytes.NewReader(encoded), Options{NoMagic: noMagic})
+		if repaired := err == nil && bytes.Equal(got, data); repaired == noMagic {
+			t.Errorf("no magic %v, without ECC: got %q, %v", noMagic, got, err)
+		}
+	}
+}
+
+func TestReadRepairsHalfTheParity(t *testing.T) {
+	data := bytes.Repeat([]byte("hex2img "), 40)
+	img, err := Encode(data, Options{PixelSize: 4, BlocksPerRow: 16, ECC: 10})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	// One corrupted block in the header, and ECC/2 in the group
+	var warnings strings.Builder
+	corrupted := []int{1, 20, 50, 90, 140, 250}
+	got, err := Decode(corruptBlocks(img, corrupted...), Options{Warnings: &warnings})
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+	if !strings.Contains(warnings.String(), "repaired 5 corrupted blocks") {
+		t.Errorf("warnings %q, want 5 repaired blocks", warnings.String())
+	}
+
+	// One more is too many
+	corrupted = append(corrupted, 200)
+	if _, err := Decode(corruptBlocks(img, corrupted...), Options{}); err == nil || !strings.Contains(err.Error(), "too many corrupted blocks") {
+		t.Errorf("got %v, want too many corrupted blocks", err)
+	}
+}
+
+func TestECCHeader(t *testing.T) {
+	stream := []byte("HX2I\x01\x00\x00\x08payload!")
+	for _, bpb := range []int{1, 2, 3, 4, 6, 8} {
+		encoded := addECCHeader(stream, 10, bpb)
+		if len(encoded) != eccHeaderLen(bpb)+len(stream) || len(encoded)%bpb != len(stream)%bpb {
+			t.Errorf("%d bytes per block: header is %d bytes, not whole blocks", bpb, len(encoded)-len(stream))
+		}
+		// Any single corrupted block of the header leaves it readable
+		for b := 0; b < eccHeaderLen(bpb); b += bpb {
+			corrupt := bytes.Clone(encoded)
+			for i := b; i < b+bpb; i++ {
+				corrupt[i] ^= 0xff
+			}
+			if rest, n := stripECCHeader(corrupt, bpb); n != 10 || !bytes.Equal(rest, stream) {
+				t.Errorf("%d bytes per block, block %d corrupted: got %d parity blocks", bpb, b/bpb, n)
+			}
+		}
+		// A stream without the header may hold anything after its version
+		plain := append([]byte("HX2I\x01"), bytes.Repeat([]byte{formatVersion | eccFlag, 10}, 20)...)
+		if rest, n := stripECCHeader(plain, bpb); n != 0 || !bytes.Equal(rest, plain) {
+			t.Errorf("%d bytes per block: found %d parity blocks in a stream without them", bpb, n)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package hex2img
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+// detectFormat identifies the image format from its leading bytes. It only
+// peeks, so the reader still yields the complete image afterwards.
+func detectFormat(br *bufio.Reader) (Format, error) {
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return 0, fmt.Errorf("reading input: %w", err)
+	}
+
+	text := bytes.TrimLeft(head, "\ufeff \t\r\n")
+	switch {
+	case bytes.HasPrefix(head, pngSignature):
+		return FormatPNG, nil
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return FormatGIF, nil
+	case bytes.HasPrefix(head, []byte("\xff\xd8\xff")):
+		return FormatJPEG, nil
+	case bytes.HasPrefix(head, []byte("BM")):
+		return FormatBMP, nil
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return FormatTIFF, nil
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")):
+		return FormatWebP, nil
+	case bytes.HasPrefix(text, []byte("<?xml")), bytes.HasPrefix(text, []byte("<svg")):
+		return FormatSVG, nil
+	}
+	return 0, ErrUnknownFormat
+}
+
+// estimateSize predicts the encoded file size. SVG is cheap to generate, so
+// it is counted exactly; raster formats are bounded by their uncompressed
+// pixel data plus a little room for headers and metadata.
+func estimateSize(data []byte, l layout, opts Options) int64 {
+	width, height := l.size()
+	pixels := int64(width) * int64(height)
+	channels := int64(3)
+	switch {
+	case opts.Gray, opts.Robust:
+		channels = 1
+	case opts.Alpha:
+		channels = 4
+	}
+	if opts.Depth16 {
+		channels *= 2
+	}
+
+	switch opts.Format {
+	case FormatSVG:
+		var c countingWriter
+		opts.Progress, opts.Timings = nil, nil
+		encodeSVG(&c, data, l, opts)
+		return c.n
+	case FormatGIF:
+		return pixels + 3*256 + 1024
+	case FormatBMP:
+		stride := (int64(width)*channels + 3) &^ 3
+		if opts.Gray || opts.Robust {
+			// Gray images are written with a 256 entry palette.
+			return 54 + 4*256 + stride*int64(height)
+		}
+		return 54 + stride*int64(height)
+	case FormatTIFF:
+		// Color images are always stored with an alpha channel.
+		if !opts.Gray && !opts.Robust {
+			channels = 4
+		}
+	case FormatPNG, FormatAuto:
+		// Every row starts with a filter byte.
+		return pixels*channels + int64(height) + 1024
+	}
+	return pixels*channels + 1024
+}
+
+// invalidImage wraps an error from decoding an image in the given format
+// as ErrInvalidImage, telling truncated images apart from malformed ones.
+func invalidImage(format string, err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %s is truncated", ErrInvalidImage, format)
+	}
+	return fmt.Errorf("%w: decoding %s: %w", ErrInvalidImage, format, err)
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func encodePNG(w io.Writer, data []byte, l layout, opts Options) error {
+	img := drawImage(data, l, opts)
+	text := []pngText{
+		{metaPixelSize, strconv.Itoa(l.pixelSize)},
+		{metaBlockHeight, strconv.Itoa(l.blockHeight)},
+		{metaBlocksPerRow, strconv.Itoa(l.blocksPerRow)},
+		{metaOrder, blockOrder(l.columnMajor)},
+		{metaMode, blockMode(opts)},
+		{metaECC, strconv.Itoa(opts.ECC)},
+		{metaBorder, strconv.Itoa(l.border)},
+		{metaDepth, strconv.Itoa(blockDepth(opts))},
+		{metaBits, strconv.Itoa(opts.Bits)},
+		{metaEndian, channelEndian(opts.LittleEndian)},
+	}
+	if opts.Grid {
+		c := opts.GridColor
+		if c == nil {
+			c = color.Gray{Y: 0x80}
+		}
+		drawGrid(img, l, c)
+		text = append(text, pngText{metaGrid, "1"})
+	}
+	if len(l.rowWidths) > 0 {
+		text = append(text, pngText{metaRowWidths, formatInts(l.rowWidths)})
+	}
+	if opts.Caption != "" {
+		text = append(text, pngText{metaCaption, opts.Caption})
+	}
+	return writePNGWithText(w, img, opts.PNGCompression, opts.Interlace, text)
+}
+
+func blockOrder(columnMajor bool) string {
+	if columnMajor {
+		return "column"
+	}
+	return "row"
+}
+
+// blockMode names the block mode recorded in PNG metadata.
+func blockMode(opts Options) string {
+	switch {
+	case opts.Alpha:
+		return "rgba"
+	case opts.Gray:
+		return "gray"
+	case opts.Robust:
+		return "robust"
+	case opts.Palette != nil:
+		return "palette"
+	}
+	return "rgb"
+}
+
+// channelEndian names the byte order of 16-bit channels recorded in PNG
+// metadata.
+func channelEndian(little bool) string {
+	if little {
+		return "little"
+	}
+	return "big"
+}
+
+func blockDepth(opts Options) int {
+	if opts.Depth16 {
+		return 16
+	}
+	return 8
+}
+
+// decodePNG samples one pixel per block. The block size, blocks per row,
+// parity blocks, border, bits per block, block order, block mode, bit depth
+// and channel byte order recorded in the PNG metadata take precedence over
+// opts.
+func decodePNG(r io.Reader, opts Options) ([]byte, Info, error) {
+	encoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, Info{}, fmt.Errorf("reading input: %w", err)
+	}
+
+	if !bytes.HasPrefix(encoded, pngSignature) {
+		return nil, Info{}, fmt.Errorf("%w: input is not a PNG", ErrInvalidImage)
+	}
+	img, err := png.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		// A cut in the compressed pixels shows up as missing pixel data
+		// rather than an unexpected end of the input
+		if pngTruncated(encoded) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, Info{}, invalidImage("PNG", err)
+	}
+
+	text := readPNGText(encoded)
+	if text[metaGrid] != "" {
+		return nil, Info{}, errors.New("refusing to decode PNG: images with a grid overlay are for inspection only")
+	}
+	if opts, err = pngOptions(text, opts); err != nil {
+		return nil, Info{}, err
+	}
+	// The metadata is as untrusted as the pixels
+	if err := validateMode(opts); err != nil {
+		return nil, Info{}, fmt.Errorf("%w: PNG metadata: %w", ErrInvalidImage, err)
+	}
+
+	if opts.Scale == 0 {
+		opts.Scale = detectScale(img, opts)
+	}
+	return decode(img, opts)
+}
+
+// pngOptions returns opts with the layout and block mode recorded in the
+// text chunks of a PNG in place of its own.
+func pngOptions(text map[string]string, opts Options) (Options, error) {
+	var err error
+	if opts.PixelSize, err = readPNGInt(text, metaPixelSize, opts.PixelSize); err != nil {
+		return opts, err
+	}
+	if opts.BlockHeight, err = readPNGInt(text, metaBlockHeight, opts.BlockHeight); err != nil {
+		return opts, err
+	}
+	if opts.BlocksPerRow, err = readPNGInt(text, metaBlocksPerRow, opts.BlocksPerRow); err != nil {
+		return opts, err
+	}
+	if opts.ECC, err = readPNGInt(text, metaECC, opts.ECC); err != nil {
+		return opts, err
+	}
+	if opts.Border, err = readPNGInt(text, metaBorder, opts.Border); err != nil {
+		return opts, err
+	}
+	if opts.Bits, err = readPNGInt(text, metaBits, opts.Bits); err != nil {
+		return opts, err
+	}
+	if opts.RowWidths, err = readPNGInts(text, metaRowWidths, opts.RowWidths); err != nil {
+		return opts, err
+	}
+	switch depth := text[metaDepth]; depth {
+	case "":
+	case "8", "16":
+		opts.Depth16 = depth == "16"
+	default:
+		return opts, fmt.Errorf("invalid %s metadata %q", metaDepth, depth)
+	}
+	switch endian := text[metaEndian]; endian {
+	case "":
+	case "big", "little":
+		opts.LittleEndian = endian == "little"
+	default:
+		return opts, fmt.Errorf("invalid %s metadata %q", metaEndian, endian)
+	}
+	switch order := text[metaOrder]; order {
+	case "":
+	case "row", "column":
+		opts.ColumnMajor = order == "column"
+	default:
+		return opts, fmt.Errorf("invalid %s metadata %q", metaOrder, order)
+	}
+	switch mode := text[metaMode]; mode {
+	case "":
+	case "rgb", "rgba", "gray", "robust":
+		opts.Alpha, opts.Gray, opts.Robust = mode == "rgba", mode == "gray", mode == "robust"
+		opts.Palette = nil
+	case "palette":
+		if opts.Palette == nil {
+			return opts, errors.New("image was written in palette mode; its palette is needed to decode it")
+		}
+		opts.Alpha, opts.Gray, opts.Robust = false, false, false
+	default:
+		return opts, fmt.Errorf("invalid %s metadata %q", metaMode, mode)
+	}
+	return opts, nil
+}
+
+// detectScale finds the factor a PNG was enlarged by since encoding from
+// the pixel size and blocks per row in its metadata, which tell how wide it
+// was then. It returns 1 when that is unknown, or out of range, or the
+// width, or that of the crop rectangle, is not a whole multiple.
+func detectScale(img image.Image, opts Options) int {
+	width := img.Bounds().Dx()
+	if !opts.Crop.Empty() {
+		width = opts.Crop.Dx()
+	}
+	if opts.PixelSize <= 0 || opts.BlocksPerRow <= 0 {
+		return 1
+	}
+	// Compared by division, as the metadata may hold any number
+	blocks := width / opts.PixelSize
+	if opts.BlocksPerRow > blocks || opts.Border > blocks {
+		return 1
+	}
+	encoded := (opts.BlocksPerRow + 2*opts.Border) * opts.PixelSize
+	if width > encoded && width%encoded == 0 {
+		return width / encoded
+	}
+	return 1
+}
+
+func encodeJPEG(w io.Writer, data []byte, l layout, opts Options) error {
+	return jpeg.Encode(w, drawImage(data, l, opts), &jpeg.Options{Quality: opts.Quality})
+}
+
+// decodeJPEG decodes only JPEGs that survive compression: at quality 100 a
+// grayscale block covering whole 8x8 DCT cells keeps its exact value, while
+// chroma subsampling of color images blurs neighbouring blocks together.
+// Robust blocks covering whole cells survive lower qualities too. A gray
+// JPEG whose quantization tables are those of quality 100 is decoded as
+// such without opts saying so.
+func decodeJPEG(r io.Reader, opts Options) ([]byte, Info, error) {
+	const refusal = "refusing to decode JPEG: only images written in grayscale at quality 100 or in robust mode, with a pixel size that is a multiple of 8, decode reliably"
+	encoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, Info{}, fmt.Errorf("reading input: %w", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, Info{}, invalidImage("JPEG", err)
+	}
+	if _, gray := img.(*image.Gray); gray && !opts.Robust && jpegLossless(encoded) {
+		opts.Gray, opts.Quality = true, 100
+	}
+	if !opts.Robust && (opts.Quality != 100 || !opts.Gray) {
+		return nil, Info{}, errors.New(refusal)
+	}
+
+	if opts.PixelSize, err = resolvePixelSize(img, opts); err != nil {
+		return nil, Info{}, err
+	}
+	if opts.PixelSize%8 != 0 || opts.blockHeight()%8 != 0 {
+		return nil, Info{}, errors.New(refusal)
+	}
+	return decode(img, opts)
+}
+
+// jpegLossless reports whether every quantization table of the JPEG is all
+// ones, as written at quality 100, so that nothing but rounding is lost.
+func jpegLossless(encoded []byte) bool {
+	tables := 0
+	// Segments follow the start of image marker up to the start of scan
+	for i := 2; i+4 <= len(encoded) && encoded[i] == 0xff; {
+		marker, n := encoded[i+1], int(binary.BigEndian.Uint16(encoded[i+2:]))
+		if marker == 0xda || n < 2 || i+2+n > len(encoded) {
+			break
+		}
+		if marker == 0xdb {
+			for seg := encoded[i+4 : i+2+n]; len(seg) > 0; tables++ {
+				size := 64
+				if seg[0]>>4 != 0 {
+					size = 128
+				}
+				if len(seg) < 1+size {
+					return false
+				}
+				for j, v := range seg[1 : 1+size] {
+					// The high byte of a 16-bit entry comes first
+					want := byte(1)
+					if size == 128 && j%2 == 0 {
+						want = 0
+					}
+					if v != want {
+						return false
+					}
+				}
+				seg = seg[1+size:]
+			}
+		}
+		i += 2 + n
+	}
+	return tables > 0
+}
+
+// encodeGIF builds a palette from the distinct block colors in order of first
+// appearance, failing rather than quantizing when more than 256 are needed.
+func encodeGIF(w io.Writer, data []byte, l layout, opts Options) error {
+	width, height := l.size()
+	img := image.NewPaletted(image.Rect(0, 0, width, height), nil)
+	index := make(map[color.Color]uint8)
+	if l.border > 0 {
+		// Every pixel starts out as index 0, the border
+		index[borderColor] = 0
+		img.Palette = append(img.Palette, borderColor)
+	}
+
+	blockCount := opts.blockCount(len(data))
+	p := newProgress(opts.Progress, blockCount)
+	reported := 0
+	for b := 0; b < blockCount; b++ {
+		c := blockAt(data, b, opts)
+		idx, ok := index[c]
+		if !ok {
+			if len(img.Palette) == 256 {
+				return fmt.Errorf("data needs more than 256 distinct block colors; GIF cannot hold it losslessly")
+			}
+			idx = uint8(len(img.Palette))
+			index[c] = idx
+			img.Palette = append(img.Palette, c)
+		}
+
+		x, y := getBlockPosition(b, l)
+		for dy := 0; dy < l.blockHeight; dy++ {
+			for dx := 0; dx < l.pixelSize; dx++ {
+				img.SetColorIndex(x+dx, y+dy, idx)
+			}
+		}
+		if done := b + 1; done%l.blocksPerRow == 0 || done == blockCount {
+			p.add(done - reported)
+			reported = done
+		}
+	}
+
+	// The unused blocks take the same color as in drawImage
+	if blockCount < l.cells() {
+		pad := padColor(opts)
+		idx, ok := index[pad]
+		if !ok {
+			if len(img.Palette) == 256 {
+				return fmt.Errorf("data and padding need more than 256 distinct block colors; GIF cannot hold them losslessly")
+			}
+			idx = uint8(len(img.Palette))
+			img.Palette = append(img.Palette, pad)
+		}
+		for b := blockCount; b < l.cells(); b++ {
+			x, y := getBlockPosition(b, l)
+			for dy := 0; dy < l.blockHeight; dy++ {
+				for dx := 0; dx < l.pixelSize; dx++ {
+					img.SetColorIndex(x+dx, y+dy, idx)
+				}
+			}
+		}
+	}
+
+	return gif.Encode(w, img, nil)
+}
+
+func decodeGIF(r io.Reader, opts Options) ([]byte, Info, error) {
+	img, err := gif.Decode(r)
+	if err != nil {
+		return nil, Info{}, invalidImage("GIF", err)
+	}
+	return decode(img, opts)
+}
+
+func encodeBMP(w io.Writer, data []byte, l layout, opts Options) error {
+	return bmp.Encode(w, drawImage(data, l, opts))
+}
+
+func decodeBMP(r io.Reader, opts Options) ([]byte, Info, error) {
+	img, err := bmp.Decode(r)
+	if err != nil {
+		return nil, Info{}, invalidImage("BMP", err)
+	}
+	return decode(img, opts)
+}
+
+// encodeTIFF writes an uncompressed TIFF, so every block keeps its bytes.
+func encodeTIFF(w io.Writer, data []byte, l layout, opts Options) error {
+	return tiff.Encode(w, drawImage(data, l, opts), &tiff.Options{Compression: tiff.Uncompressed})
+}
+
+// decodeTIFF reads the whole input first: TIFF needs random access, and a
+// pipe passed as an *os.File would claim it but fail to seek.
+func decodeTIFF(r io.Reader, opts Options) ([]byte, Info, error) {
+	encoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, Info{}, fmt.Errorf("reading input: %w", err)
+	}
+
+	img, err := tiff.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, Info{}, invalidImage("TIFF", err)
+	}
+	return decode(img, opts)
+}
+
+// encodeWebP writes a lossless WebP. The standard library only decodes
+// WebP, so encoding uses a pure Go VP8L encoder.
+func encodeWebP(w io.Writer, data []byte, l layout, opts Options) error {
+	return nativewebp.Encode(w, drawImage(data, l, opts), nil)
+}
+
+func decodeWebP(r io.Reader, opts Options) ([]byte, Info, error) {
+	img, err := webp.Decode(r)
+	if err != nil {
+		return nil, Info{}, invalidImage("WebP", err)
+	}
+	return decode(img, opts)
+}
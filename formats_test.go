@@ -0,0 +1,222 @@
+package hex2img_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/706f6c6c7578/hex2img"
+)
+
+// write returns the image Write produces for data with opts.
+func write(t *testing.T, data []byte, opts hex2img.Options) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := hex2img.Write(&buf, data, opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIF(t *testing.T) {
+	opts := options()
+	opts.Format = hex2img.FormatGIF
+	opts.Background = color.NRGBA{0x12, 0x34, 0x56, 0xff}
+	data := sample[:100]
+	if got := roundTrip(t, data, opts); !bytes.Equal(got, data) {
+		t.Errorf("got %x, want %x", got, data)
+	}
+
+	// Every block of these differs, which needs more colors than GIF has
+	many := make([]byte, 3*300)
+	for i := range 300 {
+		many[3*i], many[3*i+1] = byte(i), byte(i>>8)
+	}
+	err := hex2img.Write(new(bytes.Buffer), many, opts)
+	if err == nil {
+		t.Error("Write of more than 256 block colors to GIF succeeded, want an error")
+	}
+}
+
+func TestBMP(t *testing.T) {
+	opts := options()
+	opts.Format = hex2img.FormatBMP
+	encoded := write(t, sample, opts)
+	if !bytes.HasPrefix(encoded, []byte("BM")) {
+		t.Fatalf("output starts with %q, want a BMP file header", encoded[:2])
+	}
+
+	// BMP records no layout, so it is detected from the blocks
+	got, err := hex2img.Read(bytes.NewReader(encoded), hex2img.Options{})
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(got, sample) {
+		t.Errorf("got %x, want %x", got, sample)
+	}
+
+	_, err = hex2img.Read(bytes.NewReader(encoded[:len(encoded)/2]), opts)
+	if !errors.Is(err, hex2img.ErrInvalidImage) {
+		t.Errorf("Read of a truncated BMP: got %v, want ErrInvalidImage", err)
+	}
+}
+
+// onlyReader hides every method of a reader but Read, as a pipe does.
+type onlyReader struct{ r io.Reader }
+
+func (o onlyReader) Read(p []byte) (int, error) { return o.r.Read(p) }
+
+func TestTIFF(t *testing.T) {
+	opts := options()
+	opts.Format = hex2img.FormatTIFF
+	encoded := write(t, sample, opts)
+	info, err := hex2img.Measure(sample, opts)
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	if pixels := info.Width * info.Height; len(encoded) < 3*pixels {
+		t.Errorf("TIFF of %d pixels is %d bytes, too small to be uncompressed", pixels, len(encoded))
+	}
+
+	// TIFF needs random access, which Read provides itself
+	got, err := hex2img.Read(onlyReader{bytes.NewReader(encoded)}, opts)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(got, sample) {
+		t.Errorf("got %x, want %x", got, sample)
+	}
+}
+
+func TestWebPLossless(t *testing.T) {
+	data := benchPayload(3000)
+	for _, alpha := range []bool{false, true} {
+		opts := options()
+		opts.Format, opts.Alpha = hex2img.FormatWebP, alpha
+		encoded := write(t, data, opts)
+		if len(encoded) < 16 || string(encoded[12:16]) != "VP8L" {
+			t.Fatalf("alpha %v: output is not a lossless WebP", alpha)
+		}
+		got, err := hex2img.Read(bytes.NewReader(encoded), opts)
+		if err != nil {
+			t.Fatalf("alpha %v: Read: %v", alpha, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("alpha %v: random bytes did not survive", alpha)
+		}
+	}
+}
+
+func TestGrid(t *testing.T) {
+	opts := options()
+	opts.Grid, opts.GridColor = true, color.NRGBA{0xff, 0, 0, 0xff}
+	encoded := write(t, sample, opts)
+	img, err := png.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+	// Lines run along the left and top edges of every block but the first
+	for _, p := range []image.Point{{8, 3}, {3, 8}, {16, 20}} {
+		if got := color.NRGBAModel.Convert(img.At(p.X, p.Y)); got != opts.GridColor {
+			t.Errorf("pixel %v is %v, want the grid color", p, got)
+		}
+	}
+	if got := color.NRGBAModel.Convert(img.At(3, 3)); got == opts.GridColor {
+		t.Error("the first block is covered by the grid")
+	}
+
+	if _, err := hex2img.Read(bytes.NewReader(encoded), options()); err == nil {
+		t.Error("Read of a PNG with a grid succeeded, want an error")
+	}
+	opts.Format = hex2img.FormatBMP
+	if err := hex2img.Write(new(bytes.Buffer), sample, opts); err == nil {
+		t.Error("Write of a BMP with a grid succeeded, want an error")
+	}
+}
+
+func TestPNGRecordsMode(t *testing.T) {
+	// Transparent blocks, whose alpha byte is 0, keep their color bytes
+	transparent := bytes.Repeat([]byte{0x11, 0x22, 0x33, 0x00}, 20)
+	for _, tc := range []struct {
+		name string
+		set  func(*hex2img.Options)
+	}{
+		{"alpha", func(o *hex2img.Options) { o.Alpha = true }},
+		{"gray", func(o *hex2img.Options) { o.Gray = true }},
+		{"depth16 alpha", func(o *hex2img.Options) { o.Depth16, o.Alpha = true, true }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := options()
+			tc.set(&opts)
+			got, err := hex2img.Read(bytes.NewReader(write(t, transparent, opts)), hex2img.Options{})
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if !bytes.Equal(got, transparent) {
+				t.Errorf("got %x, want %x", got, transparent)
+			}
+		})
+	}
+}
+
+func TestReadInvalidPNG(t *testing.T) {
+	encoded := write(t, sample, options())
+	for _, tc := range []struct {
+		name, input, want string
+	}{
+		{"truncated", string(encoded[:len(encoded)-20]), "PNG is truncated"},
+		{"not a PNG", "GIF89a, not what was asked for", "not a PNG"},
+	} {
+		opts := options()
+		opts.Format = hex2img.FormatPNG
+		_, err := hex2img.Read(bytes.NewReader([]byte(tc.input)), opts)
+		if !errors.Is(err, hex2img.ErrInvalidImage) || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want ErrInvalidImage saying %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+// setPNGText returns the PNG encoded with the value of its tEXt chunk for
+// key replaced.
+func setPNGText(t *testing.T, encoded []byte, key, value string) []byte {
+	t.Helper()
+	i := bytes.Index(encoded, []byte("tEXt"+key+"\x00"))
+	if i < 4 {
+		t.Fatalf("no %s text chunk", key)
+	}
+	end := i + 4 + int(binary.BigEndian.Uint32(encoded[i-4:])) + 4
+	chunk := append([]byte("tEXt"+key+"\x00"), value...)
+	var out []byte
+	out = append(out, encoded[:i-4]...)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(chunk)-4))
+	out = append(out, chunk...)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(chunk))
+	return append(out, encoded[end:]...)
+}
+
+func TestReadHostilePNGMetadata(t *testing.T) {
+	opts := hex2img.Options{PixelSize: 1, BlocksPerRow: 2, Border: 1, BlockHeight: 1}
+	for _, text := range [][]string{
+		{"hex2img:border", "-1"},
+		{"hex2img:pixelSize", "4611686018427387904", "hex2img:blocksPerRow", "4", "hex2img:blockHeight", "1"},
+		{"hex2img:pixelSize", "65536"},
+		{"hex2img:blockHeight", "65536"},
+		{"hex2img:blocksPerRow", "4611686018427387904"},
+	} {
+		encoded := write(t, sample[:12], opts)
+		for i := 0; i < len(text); i += 2 {
+			encoded = setPNGText(t, encoded, text[i], text[i+1])
+		}
+		_, err := hex2img.Read(bytes.NewReader(encoded), hex2img.Options{})
+		if !errors.Is(err, hex2img.ErrInvalidImage) {
+			t.Errorf("%v: got %v, want ErrInvalidImage", text, err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+module github.com/706f6c6c7578/hex2img
+
+go 1.24.0
+
+require (
+	github.com/HugoSmits86/nativewebp v1.3.0
+	github.com/ajstarks/svgo v0.0.0-20211024235047-1546f124cd8b
+	golang.org/x/image v0.28.0
+)
@@ -1,206 +1,1153 @@
-package main
+// Package hex2img lays out bytes as blocks of color in an image and reads
+// them back.
+//
+// Every image starts with a header holding the payload length, so padding
+// in the last block is never mistaken for data. By default each block holds
+// three bytes as its red, green and blue channels.
+//
+// Nothing is streamed: the image size depends on the payload length, so
+// encoding, an Encoder included, holds the framed payload and the whole
+// image in memory before writing any of it, and decoding reads the whole
+// image. The image takes 4 bytes per pixel, or 1 in grayscale mode, so an
+// RGB payload of n bytes at pixel size s needs about 4*s*s*n/3 bytes; at
+// the default pixel size of 8 the largest payload, MaxDataLen, needs about
+// 1.3 GiB.
+//
+// Encoding is deterministic: the same data and options always produce the
+// same bytes, however the drawing is spread over goroutines, except when the
+// payload is encrypted.
+package hex2img
 
 import (
 	"bufio"
-	"encoding/hex"
-	"flag"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"image"
 	"image/color"
 	"image/png"
 	"io"
 	"math"
-	"os"
-	"path/filepath"
-	"strings"
+	"slices"
+	"time"
+)
+
+const (
+	// magic opens every stream, followed by the formatVersion byte, so that
+	// hex2img images can be told apart from arbitrary ones.
+	magic         = "HX2I"
+	formatVersion = 1
+
+	// flagMask covers the bits of the version byte that hold flags rather
+	// than the format version.
+	flagMask = scrambledFlag | sequenceFlag | multipartFlag
 
-	"github.com/ajstarks/svgo"
+	headerSize = 3
+
+	// MaxDataLen is the largest payload the length header can describe.
+	MaxDataLen = 1<<(8*headerSize) - 1
+
+	// DefaultPixelSize is the edge length of a block used by the hex2img
+	// command.
+	DefaultPixelSize = 8
+
+	// maxPixelSize bounds the block width and height and the scale, so
+	// that multiplying them with block counts cannot overflow an int.
+	maxPixelSize = 1 << 16
 )
 
+// Format is the image format written by Write and read by Read.
+type Format int
+
 const (
-	pixelSize = 8
+	// FormatAuto makes Read detect the format and Write produce PNG.
+	FormatAuto Format = iota
+	FormatPNG
+	FormatSVG
+	FormatJPEG
+	FormatGIF
+	FormatBMP
+	FormatTIFF
+	FormatWebP
+
+	// FormatANSI previews the blocks as colored text for a terminal. It
+	// can only be written.
+	FormatANSI
 )
 
-func main() {
-	decode := flag.Bool("d", false, "Decode PNG/SVG to hex")
-	blocksPerRow := flag.Int("b", 0, "Number of blocks per row (0 for single row)")
-	useSVG := flag.Bool("v", false, "Use SVG format instead of PNG")
-	help := flag.Bool("h", false, "Show help")
-	flag.Parse()
+var formatNames = map[Format]string{
+	FormatAuto: "auto",
+	FormatPNG:  "png",
+	FormatSVG:  "svg",
+	FormatJPEG: "jpeg",
+	FormatGIF:  "gif",
+	FormatBMP:  "bmp",
+	FormatTIFF: "tiff",
+	FormatWebP: "webp",
+	FormatANSI: "ansi",
+}
 
-	if *help || len(os.Args) == 1 {
-		printUsage()
-		os.Exit(0)
+func (f Format) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
 	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
 
-	if *decode {
-		if err := decodeToHex(os.Stdin, os.Stdout, *useSVG); err != nil {
-			fmt.Fprintf(os.Stderr, "Error decoding: %v\n", err)
-			os.Exit(1)
-		}
-	} else {
-		if err := encodeHexToImage(os.Stdin, os.Stdout, *blocksPerRow, *useSVG); err != nil {
-			fmt.Fprintf(os.Stderr, "Error encoding: %v\n", err)
-			os.Exit(1)
-		}
+var (
+	// ErrUnknownFormat is returned by Read when the input is in none of
+	// the supported formats.
+	ErrUnknownFormat = errors.New("unrecognized image format")
+
+	// ErrInvalidImage is returned, wrapped, by Read when the input is not a
+	// valid image in its format, for instance because it is truncated.
+	ErrInvalidImage = errors.New("invalid image")
+
+	// ErrChecksum is returned, wrapped, together with the decoded payload
+	// when the embedded checksum is missing or does not match.
+	ErrChecksum = errors.New("checksum verification failed")
+
+	// ErrImageTooLarge is returned, wrapped, when an image would exceed
+	// Options.MaxDim.
+	ErrImageTooLarge = errors.New("image too large")
+)
+
+// Options controls the block layout and image format.
+type Options struct {
+	// BlocksPerRow is the number of blocks in each row. When 0, encoding
+	// chooses it from Square and decoding derives it from the image width.
+	// Encoding caps it at the number of blocks, with a warning.
+	BlocksPerRow int
+
+	// MaxWidth, when set, makes encoding fit as many blocks in each row as
+	// an image this many pixels wide holds, instead of BlocksPerRow.
+	MaxWidth int
+
+	// Rows, when set, makes encoding lay the blocks out in this many rows,
+	// or fewer when the blocks do not fill the last ones, instead of using
+	// BlocksPerRow. It must not exceed the number of blocks.
+	Rows int
+
+	// RowWidths, when set, gives the number of blocks in each row, with the
+	// last one repeated for the rows beyond the list, instead of
+	// BlocksPerRow. The image is as wide as the widest row and the space
+	// right of the shorter ones stays empty. PNGs record the widths; other
+	// formats need the same list to decode.
+	RowWidths []int
+
+	// MaxDim, when set, is the largest width or height in pixels an encoded
+	// image may have. Larger images fail with ErrImageTooLarge.
+	MaxDim int
+
+	// Square makes encoding lay the blocks out in a square instead of a
+	// single row when BlocksPerRow is 0.
+	Square bool
+
+	// ColumnMajor fills blocks top to bottom, then left to right.
+	ColumnMajor bool
+
+	// PixelSize is the edge length of a block in pixels. Decoding detects
+	// it from the image when 0.
+	PixelSize int
+
+	// BlockHeight, when set, is the height of a block in pixels, and
+	// PixelSize only its width, for displays with non-square pixels. SVG
+	// does not support it.
+	BlockHeight int
+
+	// Alpha stores 4 bytes per block as RGBA. SVG writes the alpha as the
+	// fill-opacity of each block.
+	Alpha bool
+
+	// Gray stores 1 byte per block as a gray level.
+	Gray bool
+
+	// Palette, when set, stores 1 byte per block as the color at that index
+	// of the palette, which must hold 256 distinct colors. Decoding maps
+	// each block back to the index of the nearest palette color.
+	Palette color.Palette
+
+	// Depth16 stores two bytes in every channel of a 16-bit image, doubling
+	// the bytes per block of the other modes. Only PNG supports it.
+	Depth16 bool
+
+	// LittleEndian packs the two bytes of each 16-bit channel low byte
+	// first instead of high byte first. It needs Depth16.
+	LittleEndian bool
+
+	// Bits, when between 1 and 8, stores that many bits per block in the
+	// low bits of the blue channel of an otherwise gray block, so the data
+	// barely shows. It cannot be combined with other block modes or ECC and
+	// needs a lossless raster format other than GIF.
+	Bits int
+
+	// Robust stores 4 bits per block as one of 16 widely spaced gray levels
+	// and reads every block as the level most of its pixels are closest
+	// to. That holds a sixth of the bytes of RGB mode but survives lossy
+	// compression, so unlike other modes it decodes from JPEGs of moderate
+	// quality when the pixel size is a multiple of 8. It cannot be combined
+	// with other block modes.
+	Robust bool
+
+	// Format is the image format used by Write and Read.
+	Format Format
+
+	// Scale multiplies the rendered size of an SVG, which keeps its block
+	// coordinates in a viewBox. When decoding, it is the factor an image was
+	// enlarged by after encoding, multiplying PixelSize; PNGs detect it from
+	// their metadata when 0. Otherwise 0 means 1.
+	Scale int
+
+	// Labels writes the offset of its first byte in the stream of block
+	// bytes, which starts with the signature and length header, on every
+	// block of an SVG. Decoding ignores the labels.
+	Labels bool
+
+	// Quality is the JPEG quality, from 1 to 100.
+	Quality int
+
+	// PNGCompression trades PNG encoding speed for file size.
+	PNGCompression png.CompressionLevel
+
+	// Interlace writes PNGs with Adam7 interlacing, so that viewers can show
+	// large images progressively. Decoding handles interlaced PNGs either
+	// way. Only PNG supports it.
+	Interlace bool
+
+	// Caption is written to PNGs as a tEXt chunk with the standard
+	// Description keyword, for notes such as the name of the source file.
+	// It must be Latin-1 without NUL characters, as tEXt requires.
+	Caption string
+
+	// Checksum appends a CRC32 of the header and payload on encode and
+	// verifies it on decode.
+	Checksum bool
+
+	// Grid draws 1px lines in GridColor between the blocks of a PNG. The
+	// lines overwrite block pixels, so such images are for inspection only
+	// and are refused on decode.
+	Grid bool
+
+	// GridColor is the color of the grid lines, gray when nil.
+	GridColor color.Color
+
+	// Compress gzips the payload before it is laid out and gunzips it after
+	// it is read back. The length header counts the compressed bytes.
+	Compress bool
+
+	// ECC appends this many Reed-Solomon parity blocks to every group of
+	// 255-ECC data blocks, so that up to ECC/2 corrupted blocks per group are
+	// repaired on decode. It must be between 0 and 254. It is recorded in a
+	// header before the groups unless NoMagic is set, in which case decoding
+	// needs the same ECC again.
+	ECC int
+
+	// NoMagic leaves out the magic signature and format version that
+	// otherwise precede the length header, as in images written before
+	// they were introduced.
+	NoMagic bool
+
+	// Strict makes decoding fail on images without the magic signature
+	// instead of warning, so that a length header is never read from an
+	// image that may not have one. It cannot be combined with NoMagic.
+	Strict bool
+
+	// Passphrase, when not empty, encrypts the payload with AES-256-GCM
+	// after compression and decrypts it on decode. The salt and nonce are
+	// random, so unlike all other output, encrypted images differ from run
+	// to run.
+	Passphrase string
+
+	// Scramble, when not empty, is the seed of a permutation of the payload
+	// bytes applied after encryption, and undone on decode with the same
+	// seed. The image records that it is scrambled but not the seed.
+	Scramble string
+
+	// SequencePart marks the payload as one built by SequencePart, so that
+	// decoding reports it in Info.SequencePart rather than guessing from
+	// its first bytes. It needs the magic signature, which records it.
+	SequencePart bool
+
+	// Multipart marks the payload as one built by JoinParts, so that
+	// decoding reports it in Info.Multipart. Like SequencePart it needs the
+	// magic signature.
+	Multipart bool
+
+	// Border surrounds the grid with this many blocks of magenta. When
+	// decoding, any value above 0 makes Decode look for the border and read
+	// only the grid inside it, so the image may be part of a larger one
+	// such as a screenshot. The first block must not be magenta, which the
+	// magic signature ensures. An image that starts with the border, as
+	// written, is found without a Border unless NoMagic is set.
+	Border int
+
+	// Crop, when not empty, makes decoding read only this rectangle of the
+	// image, in pixels from its top-left corner, as when the grid is part
+	// of a screenshot. Any border is looked for inside it. SVG does not
+	// support it.
+	Crop image.Rectangle
+
+	// Fill is the byte value of the unused channels of the last block and
+	// of the unused blocks that complete the grid. The length header marks
+	// where the data ends, so it never needs to differ from the data.
+	Fill byte
+
+	// Background, when set, colors the unused blocks that complete the grid
+	// instead of a block of Fill bytes. It is purely cosmetic, since decoding
+	// stops where the length header says the data ends.
+	Background color.Color
+
+	// Warnings receives non-fatal diagnostics. They are dropped when nil.
+	Warnings io.Writer
+
+	// Progress, when set, is called as blocks are drawn with the number
+	// drawn so far and the total. Calls never overlap, but they may come
+	// from different goroutines.
+	Progress func(done, total int)
+
+	// Timings, when set, is called by Write with the time each phase took:
+	// "pack" for framing the payload, "draw" for laying out the blocks on
+	// an image, which SVG and GIF skip, and "encode" for writing the
+	// format.
+	Timings func(phase string, elapsed time.Duration)
+
+	// blocksOnly makes decoding stop at the bytes of the blocks, for
+	// ReadBlocks.
+	blocksOnly bool
+}
+
+// bytesPerBlock is the number of data bytes stored in a single block.
+// Bit-packed blocks hold less than a byte, so they count as one.
+func (o Options) bytesPerBlock() int {
+	if o.packedBits() > 0 {
+		return 1
+	}
+	n := 3
+	switch {
+	case o.Alpha:
+		n = 4
+	case o.Gray, o.Palette != nil:
+		n = 1
+	}
+	if o.Depth16 {
+		n *= 2
+	}
+	return n
+}
+
+// blockHeight is the height of a block in pixels.
+func (o Options) blockHeight() int {
+	if o.BlockHeight > 0 {
+		return o.BlockHeight
+	}
+	return o.PixelSize
+}
+
+// packedBits is the number of bits of each block in the modes that store
+// less than a byte per block, or 0 for the others.
+func (o Options) packedBits() int {
+	if o.Robust {
+		return robustBits
+	}
+	return o.Bits
+}
+
+// blockCount is the number of blocks holding n bytes.
+func (o Options) blockCount(n int) int {
+	if bits := o.packedBits(); bits > 0 {
+		return (n*8 + bits - 1) / bits
+	}
+	bpb := o.bytesPerBlock()
+	return (n + bpb - 1) / bpb
+}
+
+func (o Options) warnf(format string, args ...any) {
+	if o.Warnings != nil {
+		fmt.Fprintf(o.Warnings, "Warning: "+format+"\n", args...)
 	}
 }
 
-func printUsage() {
-	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintln(os.Stderr, "  Encode: cat hexfile.txt | "+filepath.Base(os.Args[0])+" -b blocks_per_row [-v] > output.png/svg")
-	fmt.Fprintln(os.Stderr, "  Decode: cat input.png/svg | "+filepath.Base(os.Args[0])+" -d [-v] > output.txt")
-	fmt.Fprintln(os.Stderr, "\nOptions:")
-	flag.PrintDefaults()
+// timing reports the time a phase of Write took to Timings.
+func (o Options) timing(phase string, elapsed time.Duration) {
+	if o.Timings != nil {
+		o.Timings(phase, elapsed)
+	}
 }
 
-func encodeHexToImage(r io.Reader, w io.Writer, blocksPerRow int, useSVG bool) error {
-	hexData, err := io.ReadAll(r)
+// Encode lays data out as blocks on a new image. The image is gray in
+// grayscale mode and NRGBA otherwise; opts.Format is ignored.
+func Encode(data []byte, opts Options) (image.Image, error) {
+	stream, l, err := pack(data, opts)
 	if err != nil {
-		return fmt.Errorf("reading input: %w", err)
+		return nil, err
 	}
+	return drawImage(stream, l, opts), nil
+}
+
+// Decode reads the payload back from an image produced by Encode.
+func Decode(img image.Image, opts Options) ([]byte, error) {
+	data, _, err := decode(img, opts)
+	return data, err
+}
 
-	cleanHexData := strings.Map(func(r rune) rune {
-		if r == ' ' || r == '\n' || r == '\r' {
-			return -1
+// decode is Decode, also returning the layout that was read.
+func decode(img image.Image, opts Options) ([]byte, Info, error) {
+	if err := validateMode(opts); err != nil {
+		return nil, Info{}, err
+	}
+	info := Info{Width: img.Bounds().Dx(), Height: img.Bounds().Dy(), BytesPerBlock: opts.bytesPerBlock()}
+	if !opts.Crop.Empty() {
+		r := opts.Crop.Add(img.Bounds().Min)
+		if !r.In(img.Bounds()) {
+			return nil, info, fmt.Errorf("crop rectangle %v lies outside the %dx%d image", opts.Crop, info.Width, info.Height)
 		}
-		return r
-	}, string(hexData))
+		var err error
+		if img, err = cropImage(img, r); err != nil {
+			return nil, info, err
+		}
+	}
+	if opts.Border > 0 || !opts.NoMagic && hasBorder(img, opts.Gray) {
+		var err error
+		if img, err = cropToBorder(img, opts.Gray); err != nil {
+			return nil, info, err
+		}
+	}
+	if err := checkBlockSize(img, opts); err != nil {
+		return nil, info, err
+	}
+	// A detected pixel size already includes the scale
+	if opts.Scale > 1 && opts.PixelSize > 0 {
+		opts.PixelSize *= opts.Scale
+		opts.BlockHeight *= opts.Scale
+	}
 
-	data, err := hex.DecodeString(cleanHexData)
+	pixelSize, err := resolvePixelSize(img, opts)
 	if err != nil {
-		return fmt.Errorf("decoding hex: %w", err)
+		return nil, info, err
 	}
-
-	blockCount := (len(data) + 2) / 3
-	if blocksPerRow <= 0 {
-		blocksPerRow = blockCount
+	blockHeight := pixelSize
+	if opts.BlockHeight > 0 {
+		blockHeight = opts.BlockHeight
+	}
+	width := img.Bounds().Dx()
+	blocksPerRow := opts.BlocksPerRow
+	if blocksPerRow == 0 {
+		blocksPerRow = width / pixelSize
+	}
+	if blocksPerRow < 1 || blocksPerRow > width/pixelSize {
+		return nil, info, fmt.Errorf("%w: blocks per row %d does not fit image width %d", ErrInvalidImage, blocksPerRow, width)
 	}
 
-	rows := int(math.Ceil(float64(blockCount) / float64(blocksPerRow)))
-	width := blocksPerRow * pixelSize
-	height := rows * pixelSize
+	l := layout{
+		blocksPerRow: blocksPerRow,
+		rows:         img.Bounds().Dy() / blockHeight,
+		pixelSize:    pixelSize,
+		blockHeight:  blockHeight,
+		columnMajor:  opts.ColumnMajor,
+		rowWidths:    opts.RowWidths,
+	}
+	for row := range l.rows {
+		if w := l.rowWidth(row); w > blocksPerRow {
+			return nil, info, fmt.Errorf("row %d of %d blocks does not fit image width %d", row, w, width)
+		}
+	}
+	info.BlocksPerRow, info.Rows, info.Blocks = l.blocksPerRow, l.rows, l.cells()
+	info.PixelSize, info.BlockHeight = l.pixelSize, l.blockHeight
+	stream := readBlocks(img, l, opts)
+	if opts.blocksOnly {
+		return stream, info, nil
+	}
+	data, flags, err := unpack(stream, opts)
+	info.SequencePart, info.Multipart = flags&sequenceFlag != 0, flags&multipartFlag != 0
+	return data, info, err
+}
 
-	if useSVG {
-		return encodeSVG(w, data, width, height, blocksPerRow)
+// checkBlockSize rejects a pixel size or block height that, multiplied by
+// the scale, is larger than img. It divides rather than multiplies, so
+// that values from flags or metadata cannot overflow.
+func checkBlockSize(img image.Image, opts Options) error {
+	scale := max(opts.Scale, 1)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	switch {
+	case opts.PixelSize > width/scale:
+		return fmt.Errorf("%w: pixel size %d at scale %d is wider than the %dx%d image", ErrInvalidImage, opts.PixelSize, scale, width, height)
+	case opts.blockHeight() > height/scale:
+		return fmt.Errorf("%w: block height %d at scale %d is taller than the %dx%d image", ErrInvalidImage, opts.blockHeight(), scale, width, height)
 	}
-	return encodePNG(w, data, width, height, blocksPerRow)
+	return nil
 }
 
-func encodePNG(w io.Writer, data []byte, width, height, blocksPerRow int) error {
-	img := image.NewRGBA(image.Rect(0, 0, width, height))
+// Info describes the layout of an image: the one Write would produce for a
+// payload, as reported by Measure, or the one read by ReadInfo.
+type Info struct {
+	Blocks        int
+	BlocksPerRow  int
+	Rows          int
+	Width, Height int
+	PixelSize     int
+	BlockHeight   int
+	BytesPerBlock int
+
+	// Colors is the number of distinct colors of the blocks holding data,
+	// which GIF needs to fit in 256. Only Measure sets it.
+	Colors int
+
+	// EstimatedSize is the file size in bytes. It is exact for SVG and an
+	// upper bound for the compressed raster formats. Only Measure sets it.
+	EstimatedSize int64
 
-	for i := 0; i < len(data); i += 3 {
-		r, g, b := getColor(data, i)
-		drawBlock(img, i/3, blocksPerRow, r, g, b)
+	// SequencePart reports that the payload was written with
+	// Options.SequencePart, to be reassembled by JoinSequence. Only
+	// decoding sets it.
+	SequencePart bool
+
+	// Multipart reports that the payload was written with
+	// Options.Multipart, to be taken apart by SplitParts. Only decoding
+	// sets it.
+	Multipart bool
+}
+
+// Measure reports the dimensions of the image Write would produce for data,
+// without drawing it.
+func Measure(data []byte, opts Options) (Info, error) {
+	info, stream, l, err := measureSize(data, opts)
+	if err != nil {
+		return Info{}, err
 	}
+	info.EstimatedSize = estimateSize(stream, l, opts)
+	colors := make(map[color.Color]bool)
+	for b := 0; b < info.Blocks; b++ {
+		colors[blockAt(stream, b, opts)] = true
+	}
+	info.Colors = len(colors)
+	return info, nil
+}
 
-	return png.Encode(w, img)
+// MeasureSize is Measure without Colors and EstimatedSize, which take a
+// pass over every block. It suits callers that measure many payloads only
+// to compare their dimensions.
+func MeasureSize(data []byte, opts Options) (Info, error) {
+	info, _, _, err := measureSize(data, opts)
+	return info, err
 }
 
-func encodeSVG(w io.Writer, data []byte, width, height, blocksPerRow int) error {
-	canvas := svg.New(w)
-	canvas.Start(width, height)
+func measureSize(data []byte, opts Options) (Info, []byte, layout, error) {
+	stream, l, err := pack(data, opts)
+	if err != nil {
+		return Info{}, nil, layout{}, err
+	}
+	info := Info{
+		Blocks:        opts.blockCount(len(stream)),
+		BlocksPerRow:  l.blocksPerRow,
+		Rows:          l.rows,
+		PixelSize:     l.pixelSize,
+		BlockHeight:   l.blockHeight,
+		BytesPerBlock: opts.bytesPerBlock(),
+	}
+	info.Width, info.Height = l.size()
+	return info, stream, l, nil
+}
 
-	for i := 0; i < len(data); i += 3 {
-		r, g, b := getColor(data, i)
-		x, y := getBlockPosition(i/3, blocksPerRow)
-		canvas.Rect(x, y, pixelSize, pixelSize, fmt.Sprintf("fill:#%02x%02x%02x", r, g, b))
+// Write encodes data and writes the image to w in opts.Format.
+func Write(w io.Writer, data []byte, opts Options) error {
+	start := time.Now()
+	stream, l, err := pack(data, opts)
+	if err != nil {
+		return err
 	}
+	opts.timing("pack", time.Since(start))
 
-	canvas.End()
+	if opts.Timings == nil {
+		return encode(w, stream, l, opts)
+	}
+	// Drawing the image is reported on its own and left out of the time
+	// the encoder takes
+	report := opts.Timings
+	var drawn time.Duration
+	opts.Timings = func(phase string, elapsed time.Duration) {
+		drawn += elapsed
+		report(phase, elapsed)
+	}
+	start = time.Now()
+	if err := encode(w, stream, l, opts); err != nil {
+		return err
+	}
+	report("encode", time.Since(start)-drawn)
 	return nil
 }
 
-func getColor(data []byte, i int) (r, g, b uint8) {
-	r = data[i]
-	if i+1 < len(data) {
-		g = data[i+1]
+// encode writes the blocks of stream in opts.Format.
+func encode(w io.Writer, stream []byte, l layout, opts Options) error {
+	switch opts.Format {
+	case FormatSVG:
+		return encodeSVG(w, stream, l, opts)
+	case FormatJPEG:
+		return encodeJPEG(w, stream, l, opts)
+	case FormatGIF:
+		return encodeGIF(w, stream, l, opts)
+	case FormatBMP:
+		return encodeBMP(w, stream, l, opts)
+	case FormatTIFF:
+		return encodeTIFF(w, stream, l, opts)
+	case FormatWebP:
+		return encodeWebP(w, stream, l, opts)
+	case FormatANSI:
+		return encodeANSI(w, stream, l, opts)
 	}
-	if i+2 < len(data) {
-		b = data[i+2]
+	return encodePNG(w, stream, l, opts)
+}
+
+// Read decodes an image in opts.Format from r and returns its payload. The
+// format is detected when opts.Format is FormatAuto.
+func Read(r io.Reader, opts Options) ([]byte, error) {
+	data, _, err := ReadInfo(r, opts)
+	return data, err
+}
+
+// ReadInfo is Read, also returning the layout of the image. For SVG, whose
+// blocks are read in document order, the layout is taken from the size of
+// the document and of its first block.
+func ReadInfo(r io.Reader, opts Options) ([]byte, Info, error) {
+	if err := validateMode(opts); err != nil {
+		return nil, Info{}, err
 	}
-	return
+
+	// Image decoders report a failing reader as a broken image, so the
+	// reader's own error is recorded and takes precedence.
+	er := &errReader{r: r}
+	data, info, err := read(er, opts)
+	if err != nil && er.err != nil && !errors.Is(err, er.err) {
+		return nil, info, fmt.Errorf("reading input: %w", er.err)
+	}
+	return data, info, err
+}
+
+// ReadBlocks decodes an image like Read but returns the bytes of each of
+// its blocks in block order, including header, parity and padding blocks,
+// instead of the payload.
+func ReadBlocks(r io.Reader, opts Options) ([][]byte, error) {
+	if opts.packedBits() > 0 {
+		return nil, errors.New("bit-packed and robust blocks hold less than a byte and cannot be read as blocks")
+	}
+	opts.blocksOnly = true
+	stream, info, err := ReadInfo(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([][]byte, 0, len(stream)/info.BytesPerBlock)
+	for i := 0; i+info.BytesPerBlock <= len(stream); i += info.BytesPerBlock {
+		blocks = append(blocks, stream[i:i+info.BytesPerBlock])
+	}
+	return blocks, nil
+}
+
+// Append reads the image on r and writes to w an image of its payload
+// followed by data. It has the same format, pixel size and blocks per row,
+// so the payload grows by adding rows. As when decoding, the settings
+// recorded in a PNG take precedence over opts. Images that are part of a
+// sequence or hold several parts cannot be appended to.
+func Append(w io.Writer, r io.Reader, data []byte, opts Options) error {
+	payload, opts, err := reread(r, opts)
+	if err != nil {
+		return err
+	}
+	switch {
+	case opts.SequencePart:
+		return errors.New("cannot append to an image that is part of a sequence")
+	case opts.Multipart:
+		return errors.New("cannot append to an image of several parts")
+	}
+	return Write(w, append(payload, data...), opts)
+}
+
+// Relayout reads the image on r and writes to w an image of the same
+// payload, format and pixel size with blocksPerRow blocks per row. As when
+// decoding, the settings recorded in a PNG take precedence over opts.
+func Relayout(w io.Writer, r io.Reader, blocksPerRow int, opts Options) error {
+	if blocksPerRow < 1 {
+		return fmt.Errorf("blocks per row must be at least 1, got %d", blocksPerRow)
+	}
+	payload, opts, err := reread(r, opts)
+	if err != nil {
+		return err
+	}
+	opts.BlocksPerRow, opts.Rows, opts.RowWidths = blocksPerRow, 0, nil
+	return Write(w, payload, opts)
 }
 
-func drawBlock(img *image.RGBA, blockIndex, blocksPerRow int, r, g, b uint8) {
-	x, y := getBlockPosition(blockIndex, blocksPerRow)
-	for dy := 0; dy < pixelSize; dy++ {
-		for dx := 0; dx < pixelSize; dx++ {
-			img.Set(x+dx, y+dy, color.RGBA{r, g, b, 255})
+// reread decodes the image on r, returning its payload and the options to
+// draw it again as it was.
+func reread(r io.Reader, opts Options) ([]byte, Options, error) {
+	encoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, opts, fmt.Errorf("reading input: %w", err)
+	}
+	if opts.Format == FormatAuto {
+		if opts.Format, err = detectFormat(bufio.NewReader(bytes.NewReader(encoded))); err != nil {
+			return nil, opts, err
+		}
+	}
+	if opts.Format == FormatPNG {
+		if opts, err = pngOptions(readPNGText(encoded), opts); err != nil {
+			return nil, opts, err
 		}
 	}
+
+	payload, info, err := ReadInfo(bytes.NewReader(encoded), opts)
+	if err != nil {
+		return nil, opts, err
+	}
+	// The image is redrawn at the size it was read at
+	opts.PixelSize, opts.BlockHeight = info.PixelSize, info.BlockHeight
+	opts.BlocksPerRow, opts.MaxWidth, opts.Scale = info.BlocksPerRow, 0, 0
+	opts.SequencePart, opts.Multipart = info.SequencePart, info.Multipart
+	if len(opts.RowWidths) > 0 {
+		// The rows keep their widths instead
+		opts.BlocksPerRow = 0
+	}
+	return payload, opts, nil
 }
 
-func getBlockPosition(blockIndex, blocksPerRow int) (x, y int) {
-	return (blockIndex % blocksPerRow) * pixelSize, (blockIndex / blocksPerRow) * pixelSize
+// errReader remembers the first error other than io.EOF returned by r.
+type errReader struct {
+	r   io.Reader
+	err error
 }
 
-func decodeToHex(r io.Reader, w io.Writer, fromSVG bool) error {
-	var data []byte
-	var err error
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
 
-	if fromSVG {
-		data, err = decodeSVG(r)
+func read(r io.Reader, opts Options) ([]byte, Info, error) {
+	if opts.Format == FormatAuto {
+		br := bufio.NewReader(r)
+		f, err := detectFormat(br)
+		if err != nil {
+			return nil, Info{}, err
+		}
+		opts.Format, r = f, br
+	}
+
+	switch opts.Format {
+	case FormatSVG:
+		stream, info, err := decodeSVG(r, opts)
+		if err != nil || opts.blocksOnly {
+			return stream, info, err
+		}
+		data, flags, err := unpack(stream, opts)
+		info.SequencePart, info.Multipart = flags&sequenceFlag != 0, flags&multipartFlag != 0
+		return data, info, err
+	case FormatJPEG:
+		return decodeJPEG(r, opts)
+	case FormatGIF:
+		return decodeGIF(r, opts)
+	case FormatBMP:
+		return decodeBMP(r, opts)
+	case FormatTIFF:
+		return decodeTIFF(r, opts)
+	case FormatWebP:
+		return decodeWebP(r, opts)
+	case FormatANSI:
+		return nil, Info{}, fmt.Errorf("terminal previews cannot be decoded")
+	}
+	return decodePNG(r, opts)
+}
+
+// pack validates opts and frames data as the stream of bytes stored in the
+// blocks, returning it with the grid that holds it.
+func pack(data []byte, opts Options) ([]byte, layout, error) {
+	if err := validateOptions(opts); err != nil {
+		return nil, layout{}, err
+	}
+	if opts.Compress {
+		var err error
+		if data, err = compress(data); err != nil {
+			return nil, layout{}, err
+		}
+	}
+	if opts.Passphrase != "" {
+		var err error
+		if data, err = encrypt(data, opts.Passphrase); err != nil {
+			return nil, layout{}, err
+		}
+	}
+	if opts.Scramble != "" {
+		data = scramble(data, opts.Scramble)
+	}
+	if len(data) > MaxDataLen {
+		return nil, layout{}, fmt.Errorf("input too large: %d bytes (max %d)", len(data), MaxDataLen)
+	}
+
+	stream := addHeader(data)
+	if opts.Checksum {
+		stream = binary.BigEndian.AppendUint32(stream, crc32.ChecksumIEEE(stream))
+	}
+	if !opts.NoMagic {
+		version := byte(formatVersion)
+		if opts.Scramble != "" {
+			version |= scrambledFlag
+		}
+		if opts.SequencePart {
+			version |= sequenceFlag
+		}
+		if opts.Multipart {
+			version |= multipartFlag
+		}
+		stream = append(append([]byte(magic), version), stream...)
+	}
+	if opts.ECC > 0 {
+		stream = eccEncode(stream, opts.ECC, opts.bytesPerBlock())
+		if !opts.NoMagic {
+			stream = addECCHeader(stream, opts.ECC, opts.bytesPerBlock())
+		}
+	}
+
+	bpb := opts.bytesPerBlock()
+	blockCount := opts.blockCount(len(stream))
+	for opts.packedBits() == 0 && len(stream) < blockCount*bpb {
+		stream = append(stream, opts.Fill)
+	}
+	l := layout{
+		blocksPerRow: opts.BlocksPerRow,
+		pixelSize:    opts.PixelSize,
+		blockHeight:  opts.blockHeight(),
+		columnMajor:  opts.ColumnMajor,
+		border:       opts.Border,
+		rowWidths:    opts.RowWidths,
+	}
+	if len(l.rowWidths) > 0 && l.blocksPerRow > 0 {
+		return nil, layout{}, fmt.Errorf("row widths cannot be set together with blocks per row")
+	}
+	if l.blocksPerRow > blockCount {
+		opts.warnf("%d blocks per row is more than the %d blocks of data, using %d", l.blocksPerRow, blockCount, blockCount)
+		l.blocksPerRow = blockCount
+	}
+	if opts.Rows > 0 {
+		if opts.Rows > blockCount {
+			return nil, layout{}, fmt.Errorf("%d rows is more than the %d blocks of data", opts.Rows, blockCount)
+		}
+		l.blocksPerRow = (blockCount + opts.Rows - 1) / opts.Rows
+	}
+	if opts.MaxWidth > 0 {
+		l.blocksPerRow = min(opts.MaxWidth/l.pixelSize-2*l.border, blockCount)
+		if l.blocksPerRow < 1 {
+			return nil, layout{}, fmt.Errorf("max width %d is too narrow for a single block of %d pixels", opts.MaxWidth, l.pixelSize)
+		}
+	}
+	if l.blocksPerRow == 0 {
+		l.blocksPerRow = blockCount
+		if opts.Square {
+			l.blocksPerRow = int(math.Ceil(math.Sqrt(float64(blockCount))))
+		}
+	}
+	if len(l.rowWidths) > 0 {
+		// The rows are added until they hold every block
+		l.rows, l.blocksPerRow = 0, 0
+		for start := 0; start < blockCount; l.rows++ {
+			w := l.rowWidth(l.rows)
+			start += w
+			l.blocksPerRow = max(l.blocksPerRow, w)
+		}
 	} else {
-		data, err = decodePNG(r)
+		l.rows = int(math.Ceil(float64(blockCount) / float64(l.blocksPerRow)))
+	}
+	if width, height := l.size(); opts.MaxDim > 0 && max(width, height) > opts.MaxDim {
+		return nil, layout{}, fmt.Errorf("%w: %dx%d pixels exceeds the maximum of %d in either dimension", ErrImageTooLarge, width, height, opts.MaxDim)
+	}
+	return stream, l, nil
+}
+
+// unpack extracts the payload from the stream of bytes read from the
+// blocks, along with the flags of its version byte. A failed checksum is
+// reported as ErrChecksum alongside the payload.
+func unpack(stream []byte, opts Options) ([]byte, byte, error) {
+	if !opts.NoMagic {
+		var n int
+		if stream, n = stripECCHeader(stream, opts.bytesPerBlock()); n > 0 {
+			opts.ECC = n
+		}
+	}
+	if opts.ECC > 0 {
+		var repaired int
+		var err error
+		if stream, repaired, err = eccDecode(stream, opts.ECC, opts.bytesPerBlock()); err != nil {
+			return nil, 0, err
+		}
+		if repaired > 0 {
+			opts.warnf("repaired %d corrupted blocks", repaired)
+		}
+	}
+	var flags byte
+	if opts.Scramble != "" {
+		flags = scrambledFlag
+	}
+	if !opts.NoMagic {
+		var err error
+		if stream, flags, err = stripMagic(stream, opts); err != nil {
+			return nil, 0, err
+		}
 	}
 
+	payload, err := stripHeader(stream)
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+	var sumErr error
+	if opts.Checksum {
+		sumErr = verifyChecksum(stream, len(payload))
+	}
+	if flags&scrambledFlag != 0 {
+		payload = unscramble(payload, opts.Scramble)
+	}
+	if opts.Passphrase != "" {
+		if payload, err = decrypt(payload, opts.Passphrase); err != nil {
+			return nil, flags, errors.Join(err, sumErr)
+		}
+	}
+	if opts.Compress {
+		if payload, err = decompress(payload); err != nil {
+			return nil, flags, errors.Join(err, sumErr)
+		}
 	}
+	return payload, flags, sumErr
+}
 
-	// Remove padding
-	for len(data) > 0 && data[len(data)-1] == 0 {
-		data = data[:len(data)-1]
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("compressing: %w", err)
 	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compressing: %w", err)
+	}
+	return buf.Bytes(), nil
+}
 
-	// Write hex data
-	_, err = fmt.Fprintf(w, "%x", data)
+func decompress(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("decompressing: %w", err)
 	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing: %w", err)
+	}
+	return out, nil
+}
 
-	// Add a newline at the end
-	_, err = fmt.Fprintln(w)
-	return err
+// stripMagic removes the magic signature and checks the format version,
+// returning the flags recorded beside it. A stream without the
+// signature is returned unchanged, with a warning, so that older images
+// still decode.
+func stripMagic(stream []byte, opts Options) ([]byte, byte, error) {
+	if !bytes.HasPrefix(stream, []byte(magic)) {
+		if opts.Strict {
+			return nil, 0, errors.New("no hex2img signature found; strict decoding refuses images without one")
+		}
+		opts.warnf("no hex2img signature found, the image may not be a hex2img image")
+		if opts.Scramble != "" {
+			return stream, scrambledFlag, nil
+		}
+		return stream, 0, nil
+	}
+	stream = stream[len(magic):]
+	if len(stream) == 0 {
+		return nil, 0, fmt.Errorf("missing format version")
+	}
+	v := stream[0]
+	if v&^flagMask != formatVersion {
+		return nil, 0, fmt.Errorf("unsupported format version %d", v&^flagMask)
+	}
+	scrambled := v&scrambledFlag != 0
+	switch {
+	case scrambled && opts.Scramble == "":
+		return nil, 0, ErrScrambled
+	case !scrambled && opts.Scramble != "":
+		opts.warnf("image is not scrambled, ignoring the seed")
+	}
+	return stream[1:], v & flagMask, nil
 }
 
-func decodePNG(r io.Reader) ([]byte, error) {
-	img, err := png.Decode(r)
-	if err != nil {
-		return nil, fmt.Errorf("decoding PNG: %w", err)
+// addHeader prefixes data with its length as a 3-byte big-endian value,
+// which fills the first block of an RGB image.
+func addHeader(data []byte) []byte {
+	n := len(data)
+	return append([]byte{byte(n >> 16), byte(n >> 8), byte(n)}, data...)
+}
+
+// stripHeader reads the length header from the first block and truncates
+// the remaining data to exactly that many bytes, discarding block padding.
+func stripHeader(data []byte) ([]byte, error) {
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("missing length header")
 	}
+	n := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	data = data[headerSize:]
+	if n > len(data) {
+		return nil, fmt.Errorf("length header claims %d bytes, image holds %d", n, len(data))
+	}
+	return data[:n], nil
+}
 
-	bounds := img.Bounds()
-	width, height := bounds.Max.X, bounds.Max.Y
+// verifyChecksum checks the CRC32 that follows the header and the n payload
+// bytes at the start of stream.
+func verifyChecksum(stream []byte, n int) error {
+	end := headerSize + n
+	if len(stream) < end+crc32.Size {
+		return fmt.Errorf("%w: image holds no checksum", ErrChecksum)
+	}
+	want := binary.BigEndian.Uint32(stream[end:])
+	if got := crc32.ChecksumIEEE(stream[:end]); got != want {
+		return fmt.Errorf("%w: image says %08x, data has %08x", ErrChecksum, want, got)
+	}
+	return nil
+}
 
-	var data []byte
+func validatePixelSize(pixelSize int) error {
+	if pixelSize < 1 {
+		return fmt.Errorf("pixel size must be at least 1, got %d", pixelSize)
+	}
+	return nil
+}
 
-	for y := 0; y < height; y += pixelSize {
-		for x := 0; x < width; x += pixelSize {
-			r, g, b, _ := img.At(x, y).RGBA()
-			data = append(data, uint8(r>>8), uint8(g>>8), uint8(b>>8))
-		}
+// Validate reports why opts cannot be used to encode an image, if they
+// cannot. Write and Encode validate their options themselves.
+func (o Options) Validate() error {
+	return validateOptions(o)
+}
+
+// validateOptions is validateMode, along with the settings that only
+// encoding uses, such as the JPEG quality.
+func validateOptions(opts Options) error {
+	if err := validateMode(opts); err != nil {
+		return err
+	}
+	if opts.Format == FormatJPEG && (opts.Quality < 1 || opts.Quality > 100) {
+		return fmt.Errorf("JPEG quality must be between 1 and 100, got %d", opts.Quality)
 	}
+	return validatePixelSize(opts.PixelSize)
+}
 
-	return data, nil
+// validateMode rejects combinations of block modes and formats that
+// cannot be encoded together.
+func validateMode(opts Options) error {
+	switch {
+	case opts.BlocksPerRow < 0:
+		return fmt.Errorf("blocks per row must not be negative, got %d", opts.BlocksPerRow)
+	case opts.MaxWidth < 0:
+		return fmt.Errorf("max width must not be negative, got %d", opts.MaxWidth)
+	case opts.MaxWidth > 0 && opts.BlocksPerRow > 0:
+		return fmt.Errorf("blocks per row and max width cannot both be set")
+	case opts.Rows < 0:
+		return fmt.Errorf("rows must not be negative, got %d", opts.Rows)
+	case opts.Rows > 0 && (opts.BlocksPerRow > 0 || opts.MaxWidth > 0):
+		return fmt.Errorf("rows cannot be set together with blocks per row or max width")
+	case slices.ContainsFunc(opts.RowWidths, func(w int) bool { return w < 1 }):
+		return fmt.Errorf("row widths must be at least 1 block, got %v", opts.RowWidths)
+	case len(opts.RowWidths) > 0 && (opts.Rows > 0 || opts.MaxWidth > 0):
+		return fmt.Errorf("row widths cannot be set together with rows or max width")
+	case len(opts.RowWidths) > 0 && opts.ColumnMajor:
+		return fmt.Errorf("row widths cannot be combined with column order")
+	case len(opts.RowWidths) > 0 && opts.Format == FormatSVG:
+		return fmt.Errorf("row widths are not supported for SVG")
+	case opts.Strict && opts.NoMagic:
+		return fmt.Errorf("strict decoding needs the magic signature and cannot be combined with leaving it out")
+	case opts.SequencePart && opts.NoMagic:
+		return fmt.Errorf("sequence parts are recorded in the magic signature and cannot be combined with leaving it out")
+	case opts.Multipart && opts.NoMagic:
+		return fmt.Errorf("multipart payloads are recorded in the magic signature and cannot be combined with leaving it out")
+	case opts.MaxDim < 0:
+		return fmt.Errorf("max dimension must not be negative, got %d", opts.MaxDim)
+	case opts.Scale < 0:
+		return fmt.Errorf("scale must not be negative, got %d", opts.Scale)
+	case opts.Scale > maxPixelSize:
+		return fmt.Errorf("scale must be at most %d, got %d", maxPixelSize, opts.Scale)
+	case opts.PixelSize > maxPixelSize:
+		return fmt.Errorf("pixel size must be at most %d, got %d", maxPixelSize, opts.PixelSize)
+	case opts.Border < 0:
+		return fmt.Errorf("border must not be negative, got %d", opts.Border)
+	case opts.Border > 0 && opts.Format == FormatSVG:
+		return fmt.Errorf("borders are not supported for SVG")
+	case !opts.Crop.Empty() && opts.Format == FormatSVG:
+		return fmt.Errorf("cropping is not supported for SVG")
+	case opts.BlockHeight < 0:
+		return fmt.Errorf("block height must not be negative, got %d", opts.BlockHeight)
+	case opts.BlockHeight > maxPixelSize:
+		return fmt.Errorf("block height must be at most %d, got %d", maxPixelSize, opts.BlockHeight)
+	case opts.BlockHeight > 0 && opts.Format == FormatSVG:
+		return fmt.Errorf("non-square blocks are not supported for SVG")
+	case opts.Alpha && opts.Gray:
+		return fmt.Errorf("alpha and grayscale modes cannot be combined")
+	case opts.Palette != nil && (opts.Alpha || opts.Gray):
+		return fmt.Errorf("palette mode cannot be combined with alpha or grayscale mode")
+	case opts.Palette != nil && opts.Format == FormatSVG:
+		return fmt.Errorf("palette mode is not supported for SVG")
+	case opts.Palette != nil && opts.Format == FormatJPEG:
+		return fmt.Errorf("palette mode is not supported for JPEG")
+	case opts.Depth16 && opts.Palette != nil:
+		return fmt.Errorf("16-bit mode cannot be combined with palette mode")
+	case opts.Depth16 && opts.Format != FormatAuto && opts.Format != FormatPNG:
+		return fmt.Errorf("16-bit mode is only supported for PNG")
+	case opts.Interlace && opts.Format != FormatAuto && opts.Format != FormatPNG:
+		return fmt.Errorf("interlacing is only supported for PNG")
+	case opts.Caption != "" && opts.Format != FormatAuto && opts.Format != FormatPNG:
+		return fmt.Errorf("captions are only supported for PNG")
+	case !isLatin1(opts.Caption):
+		return fmt.Errorf("caption must hold only Latin-1 characters other than NUL")
+	case opts.LittleEndian && !opts.Depth16:
+		return fmt.Errorf("little-endian channels need 16-bit mode")
+	case opts.Bits < 0 || opts.Bits > 8:
+		return fmt.Errorf("bits per block must be between 1 and 8, got %d", opts.Bits)
+	case opts.Robust && (opts.Alpha || opts.Gray || opts.Palette != nil || opts.Depth16 || opts.Bits > 0):
+		return fmt.Errorf("robust mode cannot be combined with other block modes")
+	case opts.Robust && opts.Format == FormatSVG:
+		return fmt.Errorf("robust mode is not supported for SVG")
+	case opts.Bits > 0 && (opts.Alpha || opts.Gray || opts.Palette != nil || opts.Depth16):
+		return fmt.Errorf("bit-packing cannot be combined with other block modes")
+	case opts.Bits > 0 && opts.ECC > 0:
+		return fmt.Errorf("bit-packing cannot be combined with ECC")
+	case opts.Bits > 0 && (opts.Format == FormatSVG || opts.Format == FormatJPEG || opts.Format == FormatGIF || opts.Format == FormatANSI):
+		return fmt.Errorf("bit-packing needs PNG, BMP, TIFF or WebP")
+	case opts.Gray && opts.Format == FormatSVG:
+		return fmt.Errorf("grayscale mode is not supported for SVG")
+	case opts.Alpha && opts.Format == FormatJPEG:
+		return fmt.Errorf("alpha mode is not supported for JPEG")
+	case opts.Alpha && opts.Format == FormatGIF:
+		return fmt.Errorf("alpha mode is not supported for GIF")
+	case opts.Alpha && opts.Format == FormatBMP:
+		return fmt.Errorf("alpha mode is not supported for BMP")
+	case opts.ECC < 0 || opts.ECC >= rsGroupSize:
+		return fmt.Errorf("ECC parity blocks must be between 0 and %d, got %d", rsGroupSize-1, opts.ECC)
+	case opts.Labels && opts.Format != FormatSVG:
+		return fmt.Errorf("block labels are only supported for SVG")
+	case opts.Grid && opts.Format != FormatAuto && opts.Format != FormatPNG:
+		return fmt.Errorf("grid overlay is only supported for PNG")
+	}
+	if opts.Palette != nil {
+		return validatePalette(opts.Palette)
+	}
+	return nil
 }
 
-func decodeSVG(r io.Reader) ([]byte, error) {
-	var data []byte
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "fill:#") {
-			colorStr := strings.Split(line, "fill:#")[1][:6]
-			color, err := hex.DecodeString(colorStr)
-			if err != nil {
-				return nil, fmt.Errorf("decoding color in SVG: %w", err)
-			}
-			data = append(data, color...)
+func validatePalette(p color.Palette) error {
+	if len(p) != 256 {
+		return fmt.Errorf("palette must have 256 colors, got %d", len(p))
+	}
+	seen := make(map[color.NRGBA]int, len(p))
+	for i, c := range p {
+		n := color.NRGBAModel.Convert(c).(color.NRGBA)
+		if j, ok := seen[n]; ok {
+			return fmt.Errorf("palette colors %d and %d are the same", j, i)
 		}
+		seen[n] = i
 	}
-	return data, scanner.Err()
+	return nil
 }
-
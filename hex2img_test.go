@@ -0,0 +1,1253 @@
+package hex2img_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/706f6c6c7578/hex2img"
+)
+
+// sample is a payload touching every byte value a few times.
+var sample = func() []byte {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}()
+
+// testPalette holds 256 distinct colors for palette mode.
+var testPalette = func() color.Palette {
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.NRGBA{byte(i), byte(255 - i), byte(i * 3), 0xff}
+	}
+	return p
+}()
+
+var modes = []struct {
+	name string
+	set  func(*hex2img.Options)
+}{
+	{"rgb", func(*hex2img.Options) {}},
+	{"gray", func(o *hex2img.Options) { o.Gray = true }},
+	{"alpha", func(o *hex2img.Options) { o.Alpha = true }},
+	{"depth16", func(o *hex2img.Options) { o.Depth16 = true }},
+	{"palette", func(o *hex2img.Options) { o.Palette = testPalette }},
+	{"bits", func(o *hex2img.Options) { o.Bits = 3 }},
+	{"robust", func(o *hex2img.Options) { o.Robust = true }},
+}
+
+// formats are the lossless formats, which every payload must survive.
+var formats = []struct {
+	name   string
+	format hex2img.Format
+}{
+	{"PNG", hex2img.FormatPNG},
+	{"SVG", hex2img.FormatSVG},
+	{"GIF", hex2img.FormatGIF},
+	{"BMP", hex2img.FormatBMP},
+	{"TIFF", hex2img.FormatTIFF},
+	{"WebP", hex2img.FormatWebP},
+}
+
+// options returns the options the tests encode with unless they need others.
+func options() hex2img.Options {
+	return hex2img.Options{PixelSize: 8, BlocksPerRow: 16, Quality: 90}
+}
+
+// roundTrip writes data with opts and reads it back with the same options.
+func roundTrip(t *testing.T, data []byte, opts hex2img.Options) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := hex2img.Write(&buf, data, opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got, err := hex2img.Read(&buf, opts)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return got
+}
+
+func TestRoundTripKeepsLength(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"deadbeef00", []byte{0xde, 0xad, 0xbe, 0xef, 0x00}},
+		{"trailing zeros filling a block", []byte{0xab, 0x00, 0x00, 0x00}},
+		{"only zeros", []byte{0x00, 0x00}},
+		{"single byte", []byte{0x42}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := roundTrip(t, tc.data, options()); !bytes.Equal(got, tc.data) {
+				t.Errorf("got %x, want %x", got, tc.data)
+			}
+		})
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, m := range modes {
+		t.Run(m.name, func(t *testing.T) {
+			opts := options()
+			m.set(&opts)
+			img, err := hex2img.Encode(sample, opts)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			got, err := hex2img.Decode(img, opts)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !bytes.Equal(got, sample) {
+				t.Errorf("got %x, want %x", got, sample)
+			}
+		})
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, f := range formats {
+		for _, m := range modes {
+			t.Run(fmt.Sprintf("%s/%s", f.name, m.name), func(t *testing.T) {
+				opts := options()
+				opts.Format = f.format
+				m.set(&opts)
+				var buf bytes.Buffer
+				if err := hex2img.Write(&buf, sample, opts); err != nil {
+					t.Skipf("not supported: %v", err)
+				}
+				got, err := hex2img.Read(&buf, opts)
+				if err != nil {
+					t.Fatalf("Read: %v", err)
+				}
+				if !bytes.Equal(got, sample) {
+					t.Errorf("got %x, want %x", got, sample)
+				}
+			})
+		}
+	}
+}
+
+func TestReadDetectsFormat(t *testing.T) {
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			opts := options()
+			opts.Format = f.format
+			var buf bytes.Buffer
+			if err := hex2img.Write(&buf, sample[:60], opts); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			opts.Format = hex2img.FormatAuto
+			got, err := hex2img.Read(&buf, opts)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if !bytes.Equal(got, sample[:60]) {
+				t.Errorf("got %x, want %x", got, sample[:60])
+			}
+		})
+	}
+}
+
+func TestJPEGQuality(t *testing.T) {
+	opts := options()
+	opts.Format, opts.Gray = hex2img.FormatJPEG, true
+	for _, q := range []int{0, 101} {
+		opts.Quality = q
+		if err := hex2img.Write(new(bytes.Buffer), sample, opts); err == nil {
+			t.Errorf("quality %d: Write succeeded, want an error", q)
+		}
+	}
+
+	// Only gray blocks at quality 100 survive, and decoding refuses others
+	opts.Quality = 100
+	if got := roundTrip(t, sample, opts); !bytes.Equal(got, sample) {
+		t.Errorf("got %x, want %x", got, sample)
+	}
+	opts.Quality = 90
+	var buf bytes.Buffer
+	if err := hex2img.Write(&buf, sample, opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	encoded := buf.Bytes()
+	if _, err := hex2img.Read(bytes.NewReader(encoded), opts); err == nil {
+		t.Error("Read at quality 90 succeeded, want a refusal")
+	}
+	if _, err := hex2img.Read(bytes.NewReader(encoded), hex2img.Options{}); err == nil {
+		t.Error("Read at quality 90 without options succeeded, want a refusal")
+	}
+
+	// A gray JPEG at quality 100 is recognised as one
+	opts.Quality = 100
+	buf.Reset()
+	if err := hex2img.Write(&buf, sample, opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got, err := hex2img.Read(&buf, hex2img.Options{})
+	if err != nil {
+		t.Fatalf("Read without options: %v", err)
+	}
+	if !bytes.Equal(got, sample) {
+		t.Errorf("read without options: got %x, want %x", got, sample)
+	}
+
+	// Decoding does not use the quality, so it may be left unset
+	opts = options()
+	opts.Format, opts.Robust, opts.Quality = hex2img.FormatJPEG, true, 50
+	buf.Reset()
+	if err := hex2img.Write(&buf, sample, opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got, err = hex2img.Read(&buf, hex2img.Options{Format: hex2img.FormatJPEG, Robust: true})
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(got, sample) {
+		t.Errorf("robust blocks: got %x, want %x", got, sample)
+	}
+}
+
+func TestEmptyPayload(t *testing.T) {
+	info, err := hex2img.Measure(nil, options())
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	if info.Width == 0 || info.Height == 0 {
+		t.Errorf("empty payload measures %dx%d, want a non-empty image", info.Width, info.Height)
+	}
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			opts := options()
+			opts.Format = f.format
+			var buf bytes.Buffer
+			if err := hex2img.Write(&buf, nil, opts); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			// Encoding narrowed the row to the few blocks there are
+			opts.BlocksPerRow = 0
+			got, err := hex2img.Read(&buf, opts)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if len(got) != 0 {
+				t.Errorf("got %x, want no bytes", got)
+			}
+		})
+	}
+}
+
+func TestAlphaKeepsLowAlpha(t *testing.T) {
+	// A period of 5 bytes over blocks of 4 puts every value, 0x01 and 0x7f
+	// among them, in the alpha channel of some block, where premultiplying
+	// would lose the color bytes
+	data := bytes.Repeat([]byte{0xff, 0x80, 0x01, 0x7f, 0x33}, 20)
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			opts := options()
+			opts.Format, opts.Alpha = f.format, true
+			var buf bytes.Buffer
+			if err := hex2img.Write(&buf, data, opts); err != nil {
+				t.Skipf("not supported: %v", err)
+			}
+			got, err := hex2img.Read(&buf, opts)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("got %x, want %x", got, data)
+			}
+		})
+	}
+}
+
+// benchSizes are the payload sizes benchmarked, up to the largest there is.
+var benchSizes = []struct {
+	name string
+	n    int
+}{
+	{"1KB", 1 << 10},
+	{"1MB", 1 << 20},
+	{"16MB", hex2img.MaxDataLen},
+}
+
+// benchPayload returns n bytes that are the same on every run.
+func benchPayload(n int) []byte {
+	data := make([]byte, n)
+	rand.NewChaCha8([32]byte{}).Read(data)
+	return data
+}
+
+// benchOptions draws single-pixel blocks, so that the largest payload
+// takes tens rather than thousands of megabytes.
+func benchOptions() hex2img.Options {
+	return hex2img.Options{PixelSize: 1, Square: true}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(size.name, func(b *testing.B) {
+			data := benchPayload(size.n)
+			b.SetBytes(int64(size.n))
+			for b.Loop() {
+				if _, err := hex2img.Encode(data, benchOptions()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(size.name, func(b *testing.B) {
+			img, err := hex2img.Encode(benchPayload(size.n), benchOptions())
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(size.n))
+			for b.Loop() {
+				if _, err := hex2img.Decode(img, benchOptions()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	// A 4000x4000 image of 2x2-pixel blocks, read from its pixel buffer
+	// and, hidden behind an image.Image of another type, pixel by pixel
+	opts := hex2img.Options{PixelSize: 2, BlocksPerRow: 2000}
+	data := benchPayload(2000 * 1999 * 3)
+	img, err := hex2img.Encode(data, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(4000, 4000) {
+		b.Fatalf("image is %v, want 4000x4000", size)
+	}
+	for _, bench := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"4000x4000/buffer", img},
+		{"4000x4000/interface", struct{ image.Image }{img}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				if _, err := hex2img.Decode(bench.img, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWritePNG(b *testing.B) {
+	levels := []struct {
+		name  string
+		level png.CompressionLevel
+	}{
+		{"default", png.DefaultCompression},
+		{"none", png.NoCompression},
+		{"speed", png.BestSpeed},
+		{"best", png.BestCompression},
+	}
+	for _, size := range benchSizes {
+		data := benchPayload(size.n)
+		for _, l := range levels {
+			b.Run(size.name+"/"+l.name, func(b *testing.B) {
+				opts := benchOptions()
+				opts.PNGCompression = l.level
+				b.SetBytes(int64(size.n))
+				var buf bytes.Buffer
+				for b.Loop() {
+					buf.Reset()
+					if err := hex2img.Write(&buf, data, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(buf.Len()), "file-bytes")
+			})
+		}
+	}
+}
+
+func TestDetectPixelSize(t *testing.T) {
+	for _, size := range []int{1, 2, 5, 8, 13} {
+		opts := options()
+		opts.PixelSize = size
+		img, err := hex2img.Encode(sample, opts)
+		if err != nil {
+			t.Fatalf("size %d: Encode: %v", size, err)
+		}
+		var buf bytes.Buffer
+		opts.Format = hex2img.FormatBMP
+		if err := hex2img.Write(&buf, sample, opts); err != nil {
+			t.Fatalf("size %d: Write: %v", size, err)
+		}
+
+		// Without metadata, the pixel size and row width come from the
+		// image alone
+		got, info, err := hex2img.ReadInfo(&buf, hex2img.Options{})
+		if err != nil {
+			t.Fatalf("size %d: ReadInfo: %v", size, err)
+		}
+		if info.PixelSize != size || !bytes.Equal(got, sample) {
+			t.Errorf("size %d: read pixel size %d and %x", size, info.PixelSize, got)
+		}
+		if got, err := hex2img.Decode(img, hex2img.Options{}); err != nil || !bytes.Equal(got, sample) {
+			t.Errorf("size %d: Decode gave %x, %v", size, got, err)
+		}
+	}
+}
+
+func TestColumnMajor(t *testing.T) {
+	opts := options()
+	opts.ColumnMajor, opts.BlocksPerRow = true, 4
+	img, err := hex2img.Encode(sample, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// The second block, holding the end of the signature, the format
+	// version and the top byte of the length, is below the first
+	want := color.NRGBA{'I', 1, 0, 0xff}
+	if got := color.NRGBAModel.Convert(img.At(4, 12)); got != want {
+		t.Errorf("block below the first is %v, want %v", got, want)
+	}
+
+	for _, f := range []hex2img.Format{hex2img.FormatPNG, hex2img.FormatBMP} {
+		opts.Format = f
+		if got := roundTrip(t, sample, opts); !bytes.Equal(got, sample) {
+			t.Errorf("%v: got %x, want %x", f, got, sample)
+		}
+	}
+
+	// PNGs record the order, so decoding needs no option
+	opts.Format = hex2img.FormatPNG
+	got, err := hex2img.Read(bytes.NewReader(write(t, sample, opts)), hex2img.Options{})
+	if err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("PNG read without options: got %x, %v", got, err)
+	}
+}
+
+func TestDecodeIgnoresPartialBlocks(t *testing.T) {
+	for _, pixelSize := range []int{0, 8} {
+		opts := options()
+		img, err := hex2img.Encode(sample, opts)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		// A few stray pixels right of and below the grid
+		b := img.Bounds()
+		padded := image.NewNRGBA(image.Rect(0, 0, b.Dx()+3, b.Dy()+5))
+		draw.Draw(padded, b, img, image.Point{}, draw.Src)
+
+		var warnings bytes.Buffer
+		opts.PixelSize, opts.Warnings = pixelSize, &warnings
+		got, err := hex2img.Decode(padded, opts)
+		if err != nil {
+			t.Fatalf("pixel size %d: Decode: %v", pixelSize, err)
+		}
+		if !bytes.Equal(got, sample) {
+			t.Errorf("pixel size %d: got %x, want %x", pixelSize, got, sample)
+		}
+		if pixelSize > 0 && !strings.Contains(warnings.String(), "not a multiple") {
+			t.Errorf("pixel size %d: warnings %q, want one about partial blocks", pixelSize, warnings.String())
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	data := bytes.Repeat([]byte("hex2img "), 500)
+	opts := options()
+	plain, err := hex2img.Measure(data, opts)
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	opts.Compress = true
+	compressed, err := hex2img.Measure(data, opts)
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	if compressed.Blocks*10 > plain.Blocks {
+		t.Errorf("compressed payload takes %d blocks, plain %d, want a tenth at most", compressed.Blocks, plain.Blocks)
+	}
+	if got := roundTrip(t, data, opts); !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+
+	// A payload that was not compressed does not gunzip
+	_, err = hex2img.Read(bytes.NewReader(write(t, data, options())), opts)
+	if err == nil {
+		t.Error("Read with Compress of an uncompressed image succeeded, want an error")
+	}
+}
+
+func TestPalette(t *testing.T) {
+	opts := options()
+	opts.Palette = testPalette
+	img, err := hex2img.Encode(sample, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// Colors nudged off the palette still map to their nearest entry
+	nudged := image.NewNRGBA(img.Bounds())
+	draw.Draw(nudged, nudged.Bounds(), img, image.Point{}, draw.Src)
+	for i := 0; i < len(nudged.Pix); i += 4 {
+		nudged.Pix[i+2] ^= 1
+	}
+	got, err := hex2img.Decode(nudged, opts)
+	if err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("Decode of nudged colors gave %x, %v", got, err)
+	}
+
+	// A PNG records the mode but not the palette
+	var buf bytes.Buffer
+	if err := hex2img.Write(&buf, sample, opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := hex2img.Read(&buf, hex2img.Options{}); err == nil {
+		t.Error("Read of a palette PNG without the palette succeeded, want an error")
+	}
+
+	dup := append(color.Palette{}, testPalette...)
+	dup[7] = dup[3]
+	for name, p := range map[string]color.Palette{"short": testPalette[:255], "duplicate": dup} {
+		opts.Palette = p
+		if err := hex2img.Write(new(bytes.Buffer), sample, opts); err == nil {
+			t.Errorf("%s palette: Write succeeded, want an error", name)
+		}
+	}
+}
+
+func TestLastRowUnusedBlocks(t *testing.T) {
+	// With the 8 header bytes, 20 and 22 bytes take 10 blocks, leaving 2 of
+	// the third row of 4 unused
+	for _, n := range []int{20, 22} {
+		data := make([]byte, n)
+		data[0] = 0xab
+		opts := options()
+		opts.BlocksPerRow = 4
+		img, err := hex2img.Encode(data, opts)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 24 {
+			t.Fatalf("%d bytes: image is %dx%d, want 32x24", n, b.Dx(), b.Dy())
+		}
+		for _, x := range []int{20, 28} {
+			if got := color.NRGBAModel.Convert(img.At(x, 20)); got != (color.NRGBA{0, 0, 0, 0xff}) {
+				t.Errorf("%d bytes: unused block at x %d is %v, want black", n, x, got)
+			}
+		}
+		// The trailing zero bytes are data, not padding
+		got, err := hex2img.Decode(img, opts)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: got %x, want %x", n, got, data)
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	data := append(bytes.Repeat([]byte{0x42}, 18), 0xff, 0xff)
+	opts := options()
+	opts.BlocksPerRow, opts.Fill = 4, 0xff
+	img, err := hex2img.Encode(data, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if got := color.NRGBAModel.Convert(img.At(28, 20)); got != (color.NRGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("unused block is %v, want white", got)
+	}
+	// The last block holds a single data byte, the rest being fill
+	if got := color.NRGBAModel.Convert(img.At(12, 20)); got != (color.NRGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("last block is %v, want white", got)
+	}
+	got, err := hex2img.Decode(img, opts)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %x, want %x", got, data)
+	}
+
+	// GIF pads with the same color rather than the first in its palette
+	opts.Format = hex2img.FormatGIF
+	decoded, err := gif.Decode(bytes.NewReader(write(t, data, opts)))
+	if err != nil {
+		t.Fatalf("decoding GIF: %v", err)
+	}
+	if got := color.NRGBAModel.Convert(decoded.At(28, 20)); got != (color.NRGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("unused GIF block is %v, want white", got)
+	}
+}
+
+func TestFillInEveryFormat(t *testing.T) {
+	// 20 bytes take 10 blocks, leaving 2 of the third row of 4 unused
+	data := bytes.Repeat([]byte{0x42}, 20)
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			opts := options()
+			opts.Format, opts.BlocksPerRow, opts.Fill = f.format, 4, 0xff
+			blocks, err := hex2img.ReadBlocks(bytes.NewReader(write(t, data, opts)), opts)
+			if err != nil {
+				t.Fatalf("ReadBlocks: %v", err)
+			}
+			if len(blocks) != 12 {
+				t.Fatalf("read %d blocks, want 12", len(blocks))
+			}
+			for i, b := range blocks[10:] {
+				if !bytes.Equal(b, []byte{0xff, 0xff, 0xff}) {
+					t.Errorf("unused block %d is %x, want fill bytes", 10+i, b)
+				}
+			}
+		})
+	}
+}
+
+func TestBlocksPerRowLimits(t *testing.T) {
+	var warnings strings.Builder
+	opts := options()
+	opts.BlocksPerRow, opts.Warnings = 1000000, &warnings
+	img, err := hex2img.Encode([]byte{1, 2, 3, 4}, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// 12 bytes with the header make 4 blocks, all in one row
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 8 {
+		t.Errorf("image is %dx%d, want 32x8", b.Dx(), b.Dy())
+	}
+	if !strings.Contains(warnings.String(), "using 4") {
+		t.Errorf("warnings %q, want one about capping the blocks per row", warnings.String())
+	}
+
+	opts.BlocksPerRow = -1
+	if _, err := hex2img.Encode([]byte{1, 2, 3, 4}, opts); err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Errorf("got %v, want an error about negative blocks per row", err)
+	}
+}
+
+func TestBorder(t *testing.T) {
+	opts := options()
+	opts.Border = 2
+	img, err := hex2img.Encode(sample, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	plain, err := hex2img.Encode(sample, options())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if b, p := img.Bounds(), plain.Bounds(); b.Dx() != p.Dx()+32 || b.Dy() != p.Dy()+32 {
+		t.Errorf("bordered image is %dx%d, want 2 blocks wider than %dx%d on every side", b.Dx(), b.Dy(), p.Dx(), p.Dy())
+	}
+
+	// Pasted into a screenshot, the grid is found by its border
+	b := img.Bounds()
+	canvas := image.NewNRGBA(image.Rect(0, 0, b.Dx()+100, b.Dy()+60))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.NRGBA{0x80, 0x80, 0x80, 0xff}), image.Point{}, draw.Src)
+	draw.Draw(canvas, b.Add(image.Pt(37, 23)), img, b.Min, draw.Src)
+	for _, pixelSize := range []int{8, 0} {
+		dec := hex2img.Options{PixelSize: pixelSize, BlocksPerRow: 16, Border: 1}
+		got, err := hex2img.Decode(canvas, dec)
+		if err != nil {
+			t.Fatalf("pixel size %d: Decode: %v", pixelSize, err)
+		}
+		if !bytes.Equal(got, sample) {
+			t.Errorf("pixel size %d: got %x, want %x", pixelSize, got, sample)
+		}
+	}
+
+	// The border around a whole image is found without options in every
+	// format, but needs a Border when there is no magic signature
+	for _, f := range formats {
+		if f.format == hex2img.FormatSVG {
+			continue
+		}
+		opts.Format = f.format
+		got, err := hex2img.Read(bytes.NewReader(write(t, sample, opts)), hex2img.Options{})
+		if err != nil || !bytes.Equal(got, sample) {
+			t.Errorf("%s read without options: got %x, %v", f.name, got, err)
+		}
+	}
+	opts.Format, opts.NoMagic = hex2img.FormatBMP, true
+	bordered := write(t, sample, opts)
+	got, err := hex2img.Read(bytes.NewReader(bordered), hex2img.Options{NoMagic: true, Border: 1})
+	if err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("BMP without magic read with a border: got %x, %v", got, err)
+	}
+	if got, err := hex2img.Read(bytes.NewReader(bordered), hex2img.Options{NoMagic: true}); err == nil && bytes.Equal(got, sample) {
+		t.Error("BMP without magic read without a border gave the payload, want it not to be found")
+	}
+}
+
+func TestGrayBorder(t *testing.T) {
+	// Gray images draw the border in the gray of its color
+	for _, format := range []hex2img.Format{hex2img.FormatPNG, hex2img.FormatBMP, hex2img.FormatTIFF, hex2img.FormatWebP} {
+		opts := options()
+		opts.Format, opts.Gray, opts.Border = format, true, 1
+		if got := roundTrip(t, sample, opts); !bytes.Equal(got, sample) {
+			t.Errorf("format %v: got %x, want %x", format, got, sample)
+		}
+		got, err := hex2img.Read(bytes.NewReader(write(t, sample, opts)), hex2img.Options{Format: format, Gray: true})
+		if err != nil || !bytes.Equal(got, sample) {
+			t.Errorf("format %v read without a border: got %x, %v", format, got, err)
+		}
+	}
+}
+
+func TestWriteIsDeterministic(t *testing.T) {
+	data := benchPayload(20000)
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			opts := options()
+			opts.Format = f.format
+			switch f.format {
+			case hex2img.FormatPNG:
+				opts.Caption = "same every time"
+			case hex2img.FormatGIF:
+				// Random bytes need more colors than GIF has
+				opts.Gray = true
+			}
+			first := write(t, data, opts)
+			for range 3 {
+				if !bytes.Equal(write(t, data, opts), first) {
+					t.Fatal("two writes of the same data differ")
+				}
+			}
+		})
+	}
+}
+
+func TestMaxWidth(t *testing.T) {
+	for _, tc := range []struct{ maxWidth, pixelSize, border int }{
+		{100, 8, 0},
+		{104, 8, 0},
+		{1920, 3, 0},
+		{100, 8, 2},
+		{10000, 8, 0},
+	} {
+		opts := hex2img.Options{PixelSize: tc.pixelSize, MaxWidth: tc.maxWidth, Border: tc.border}
+		img, err := hex2img.Encode(sample, opts)
+		if err != nil {
+			t.Fatalf("%+v: Encode: %v", tc, err)
+		}
+		w := img.Bounds().Dx()
+		if w > tc.maxWidth {
+			t.Errorf("%+v: image is %d pixels wide", tc, w)
+		}
+		if w+tc.pixelSize <= tc.maxWidth && img.Bounds().Dy() > tc.pixelSize*(1+2*tc.border) {
+			t.Errorf("%+v: image is %d pixels wide, room was left for another block per row", tc, w)
+		}
+	}
+
+	opts := hex2img.Options{PixelSize: 8, MaxWidth: 7}
+	if _, err := hex2img.Encode(sample, opts); err == nil {
+		t.Error("max width below the pixel size succeeded, want an error")
+	}
+}
+
+func TestDepth16(t *testing.T) {
+	opts := options()
+	opts.Depth16 = true
+	img, err := hex2img.Encode(sample, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// The first block holds the first 6 bytes of the signature
+	if got := color.NRGBA64Model.Convert(img.At(0, 0)); got != (color.NRGBA64{0x4858, 0x3249, 0x0100, 0xffff}) {
+		t.Errorf("first block is %v, want the signature in 16-bit channels", got)
+	}
+	// The bit depth is the first byte after the size in the IHDR chunk
+	if encoded := write(t, sample, opts); encoded[24] != 16 {
+		t.Errorf("PNG bit depth is %d, want 16", encoded[24])
+	}
+
+	plain, err := hex2img.Measure(sample, options())
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	dense, err := hex2img.Measure(sample, opts)
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	if dense.Blocks*2 > plain.Blocks+1 {
+		t.Errorf("16-bit blocks: %d, 8-bit: %d, want half as many", dense.Blocks, plain.Blocks)
+	}
+
+	// Every length of the last block, read back without options
+	for n := 1; n <= 7; n++ {
+		got, err := hex2img.Read(bytes.NewReader(write(t, sample[:n], opts)), hex2img.Options{})
+		if err != nil || !bytes.Equal(got, sample[:n]) {
+			t.Errorf("%d bytes: got %x, %v", n, got, err)
+		}
+	}
+
+	opts.Format = hex2img.FormatJPEG
+	if err := hex2img.Write(new(bytes.Buffer), sample, opts); err == nil {
+		t.Error("Write of a 16-bit JPEG succeeded, want an error")
+	}
+}
+
+func TestBackground(t *testing.T) {
+	bg := color.NRGBA{0x20, 0x80, 0xc0, 0xff}
+	data := make([]byte, 20)
+	opts := options()
+	opts.BlocksPerRow, opts.Background = 4, bg
+	img, err := hex2img.Encode(data, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// 28 bytes take 10 blocks, so the last 2 of the third row are unused
+	for _, p := range []image.Point{{16, 16}, {31, 23}} {
+		if got := color.NRGBAModel.Convert(img.At(p.X, p.Y)); got != bg {
+			t.Errorf("unused block at %v is %v, want the background", p, got)
+		}
+	}
+	if got := color.NRGBAModel.Convert(img.At(8, 16)); got == bg {
+		t.Error("the last data block has the background color")
+	}
+	got, err := hex2img.Decode(img, opts)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %x, want %x", got, data)
+	}
+}
+
+// upscale enlarges img by factor as an image editor does without smoothing.
+func upscale(img image.Image, factor int) image.Image {
+	b := img.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, b.Dx()*factor, b.Dy()*factor))
+	for y := range out.Bounds().Dy() {
+		for x := range out.Bounds().Dx() {
+			out.Set(x, y, img.At(b.Min.X+x/factor, b.Min.Y+y/factor))
+		}
+	}
+	return out
+}
+
+func TestDecodeUpscaled(t *testing.T) {
+	img, err := hex2img.Encode(sample, options())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	big := upscale(img, 3)
+	for _, opts := range []hex2img.Options{
+		{PixelSize: 8, BlocksPerRow: 16, Scale: 3},
+		{},
+	} {
+		got, err := hex2img.Decode(big, opts)
+		if err != nil {
+			t.Fatalf("%+v: Decode: %v", opts, err)
+		}
+		if !bytes.Equal(got, sample) {
+			t.Errorf("%+v: got %x, want %x", opts, got, sample)
+		}
+	}
+
+	// Sampling every original block size reads each block three times over
+	got, err := hex2img.Decode(big, hex2img.Options{PixelSize: 8, BlocksPerRow: 48})
+	if err == nil && bytes.Equal(got, sample) {
+		t.Error("an upscaled image decoded without the scale")
+	}
+}
+
+func TestMaxDim(t *testing.T) {
+	// A single row of 103 blocks is 824 pixels wide
+	opts := hex2img.Options{PixelSize: 8, MaxDim: 500}
+	_, err := hex2img.Encode(sample, opts)
+	if !errors.Is(err, hex2img.ErrImageTooLarge) {
+		t.Errorf("single row: got %v, want ErrImageTooLarge", err)
+	}
+	if _, err := hex2img.Measure(sample, opts); !errors.Is(err, hex2img.ErrImageTooLarge) {
+		t.Errorf("Measure: got %v, want ErrImageTooLarge", err)
+	}
+	opts.BlocksPerRow = 50
+	if _, err := hex2img.Encode(sample, opts); err != nil {
+		t.Errorf("wrapped into rows: %v", err)
+	}
+}
+
+func TestBits(t *testing.T) {
+	data := sample[:40]
+	for bits := 1; bits <= 8; bits++ {
+		opts := options()
+		opts.Bits = bits
+		info, err := hex2img.Measure(data, opts)
+		if err != nil {
+			t.Fatalf("%d bits: Measure: %v", bits, err)
+		}
+		if want := ((8+len(data))*8 + bits - 1) / bits; info.Blocks != want {
+			t.Errorf("%d bits: %d blocks, want %d", bits, info.Blocks, want)
+		}
+
+		img, err := hex2img.Encode(data, opts)
+		if err != nil {
+			t.Fatalf("%d bits: Encode: %v", bits, err)
+		}
+		// Only the low bits of blue differ from the gray of every block
+		mask := byte(1<<bits - 1)
+		rgba := image.NewNRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+		for i := 0; i < len(rgba.Pix); i += 4 {
+			if r, g, b := rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2]; r != g || b&^mask != r&^mask {
+				t.Errorf("%d bits: pixel %d is %02x%02x%02x", bits, i/4, r, g, b)
+				break
+			}
+		}
+
+		for _, format := range []hex2img.Format{hex2img.FormatPNG, hex2img.FormatBMP} {
+			opts.Format = format
+			if got := roundTrip(t, data, opts); !bytes.Equal(got, data) {
+				t.Errorf("%d bits, format %v: got %x, want %x", bits, format, got, data)
+			}
+		}
+	}
+
+	opts := options()
+	opts.Bits, opts.Format = 1, hex2img.FormatJPEG
+	if err := hex2img.Write(new(bytes.Buffer), data, opts); err == nil {
+		t.Error("bit-packed JPEG is valid, want an error")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	opts := hex2img.Options{PixelSize: 5, BlocksPerRow: 10, Alpha: true}
+	encoded := write(t, sample[:30], opts)
+	for _, more := range [][]byte{sample[30:100], sample[100:]} {
+		var buf bytes.Buffer
+		// The PNG records the settings, so none are needed
+		if err := hex2img.Append(&buf, bytes.NewReader(encoded), more, hex2img.Options{}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		before, err := png.DecodeConfig(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := png.DecodeConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.Width != before.Width || after.Height <= before.Height {
+			t.Errorf("appending %d bytes went from %dx%d to %dx%d, want only more rows", len(more), before.Width, before.Height, after.Width, after.Height)
+		}
+		encoded = buf.Bytes()
+	}
+	got, err := hex2img.Read(bytes.NewReader(encoded), hex2img.Options{})
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(got, sample) {
+		t.Errorf("got %x, want %x", got, sample)
+	}
+
+	// Other formats take the settings from opts
+	opts.Format, opts.Alpha = hex2img.FormatBMP, false
+	var buf bytes.Buffer
+	if err := hex2img.Append(&buf, bytes.NewReader(write(t, sample[:30], opts)), sample[30:], opts); err != nil {
+		t.Fatalf("Append to BMP: %v", err)
+	}
+	if got, err := hex2img.Read(&buf, opts); err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("BMP: got %x, %v", got, err)
+	}
+}
+
+func TestLittleEndian(t *testing.T) {
+	for _, little := range []bool{false, true} {
+		opts := options()
+		opts.Depth16, opts.LittleEndian = true, little
+		img, err := hex2img.Encode(sample, opts)
+		if err != nil {
+			t.Fatalf("little %v: Encode: %v", little, err)
+		}
+		want := color.NRGBA64{0x4858, 0x3249, 0x0100, 0xffff}
+		if little {
+			want = color.NRGBA64{0x5848, 0x4932, 0x0001, 0xffff}
+		}
+		if got := color.NRGBA64Model.Convert(img.At(0, 0)); got != want {
+			t.Errorf("little %v: first block is %v, want %v", little, got, want)
+		}
+
+		if got, err := hex2img.Decode(img, opts); err != nil || !bytes.Equal(got, sample) {
+			t.Errorf("little %v: got %x, %v", little, got, err)
+		}
+		// PNGs record the byte order
+		if got, err := hex2img.Read(bytes.NewReader(write(t, sample, opts)), hex2img.Options{}); err != nil || !bytes.Equal(got, sample) {
+			t.Errorf("little %v: PNG read without options: got %x, %v", little, got, err)
+		}
+
+		opts.LittleEndian = !little
+		if got, err := hex2img.Decode(img, opts); err == nil && bytes.Equal(got, sample) {
+			t.Errorf("little %v: decoding in the other byte order gave the payload", little)
+		}
+	}
+
+	opts := options()
+	opts.LittleEndian = true
+	if err := opts.Validate(); err == nil {
+		t.Error("little-endian without 16-bit channels is valid, want an error")
+	}
+}
+
+func TestCrop(t *testing.T) {
+	img, err := hex2img.Encode(sample, options())
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	b := img.Bounds()
+	canvas := image.NewNRGBA(image.Rect(0, 0, b.Dx()+50, b.Dy()+40))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.NRGBA{0xee, 0x11, 0x22, 0xff}), image.Point{}, draw.Src)
+	at := image.Pt(21, 13)
+	draw.Draw(canvas, b.Add(at), img, b.Min, draw.Src)
+
+	opts := options()
+	opts.Crop = b.Add(at)
+	got, err := hex2img.Decode(canvas, opts)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !bytes.Equal(got, sample) {
+		t.Errorf("got %x, want %x", got, sample)
+	}
+	// The crop is relative to the top-left corner of a sub-image too
+	sub := canvas.SubImage(image.Rect(1, 1, canvas.Bounds().Dx(), canvas.Bounds().Dy()))
+	opts.Crop = b.Add(at).Sub(image.Pt(1, 1))
+	if got, err := hex2img.Decode(sub, opts); err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("sub-image: got %x, %v", got, err)
+	}
+
+	opts.Crop = image.Rect(0, 0, canvas.Bounds().Dx()+1, 10)
+	if _, err := hex2img.Decode(canvas, opts); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("crop beyond the image: got %v, want an error", err)
+	}
+}
+
+func TestRobustJPEG(t *testing.T) {
+	data := benchPayload(500)
+	for _, quality := range []int{50, 80} {
+		opts := hex2img.Options{PixelSize: 8, BlocksPerRow: 40, Format: hex2img.FormatJPEG, Quality: quality, Robust: true}
+		if got := roundTrip(t, data, opts); !bytes.Equal(got, data) {
+			t.Errorf("quality %d: random bytes did not survive", quality)
+		}
+	}
+
+	// Every robust block holds half a byte
+	info, err := hex2img.Measure(data, hex2img.Options{PixelSize: 8, Robust: true})
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	if want := 2 * (8 + len(data)); info.Blocks != want {
+		t.Errorf("%d robust blocks, want %d", info.Blocks, want)
+	}
+
+	// Plain blocks do not survive the same compression
+	opts := hex2img.Options{PixelSize: 8, BlocksPerRow: 40, Format: hex2img.FormatJPEG, Quality: 80}
+	var buf bytes.Buffer
+	if err := hex2img.Write(&buf, data, opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got, err := hex2img.Read(&buf, opts); err == nil && bytes.Equal(got, data) {
+		t.Error("RGB blocks survived JPEG at quality 80")
+	}
+}
+
+func TestBlockHeight(t *testing.T) {
+	opts := options()
+	opts.PixelSize, opts.BlockHeight = 4, 12
+	img, err := hex2img.Encode(sample, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	info, err := hex2img.Measure(sample, opts)
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 16*4 || b.Dy() != info.Rows*12 {
+		t.Errorf("image is %dx%d, want %dx%d", b.Dx(), b.Dy(), 16*4, info.Rows*12)
+	}
+	if got, err := hex2img.Decode(img, opts); err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("Decode: got %x, %v", got, err)
+	}
+	// PNGs record the block height
+	if got, err := hex2img.Read(bytes.NewReader(write(t, sample, opts)), hex2img.Options{}); err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("PNG read without options: got %x, %v", got, err)
+	}
+
+	opts.BlockHeight = -1
+	if err := opts.Validate(); err == nil {
+		t.Error("a negative block height is valid, want an error")
+	}
+}
+
+func TestRows(t *testing.T) {
+	// sample takes 103 blocks
+	for _, rows := range []int{1, 2, 7, 10, 50, 103} {
+		opts := hex2img.Options{PixelSize: 2, Rows: rows}
+		info, err := hex2img.Measure(sample, opts)
+		if err != nil {
+			t.Fatalf("%d rows: Measure: %v", rows, err)
+		}
+		if info.Rows > rows || info.Rows*info.BlocksPerRow < 103 || (info.Rows-1)*info.BlocksPerRow >= 103 {
+			t.Errorf("%d rows: laid out %d rows of %d blocks", rows, info.Rows, info.BlocksPerRow)
+		}
+		img, err := hex2img.Encode(sample, opts)
+		if err != nil {
+			t.Fatalf("%d rows: Encode: %v", rows, err)
+		}
+		if h := img.Bounds().Dy(); h != 2*info.Rows {
+			t.Errorf("%d rows: image is %d pixels high, want %d", rows, h, 2*info.Rows)
+		}
+		if got, err := hex2img.Read(bytes.NewReader(write(t, sample, opts)), hex2img.Options{}); err != nil || !bytes.Equal(got, sample) {
+			t.Errorf("%d rows: got %x, %v", rows, got, err)
+		}
+	}
+
+	for _, rows := range []int{104, -1} {
+		if _, err := hex2img.Encode(sample, hex2img.Options{PixelSize: 2, Rows: rows}); err == nil {
+			t.Errorf("%d rows succeeded, want an error", rows)
+		}
+	}
+	if _, err := hex2img.Encode(sample, hex2img.Options{PixelSize: 2, Rows: 2, BlocksPerRow: 4}); err == nil {
+		t.Error("rows together with blocks per row succeeded, want an error")
+	}
+}
+
+func TestRowWidths(t *testing.T) {
+	opts := hex2img.Options{PixelSize: 4, RowWidths: []int{8, 8, 4}}
+	info, err := hex2img.Measure(sample, opts)
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	// 103 blocks take rows of 8 and 8, then 22 rows of 4, the last of 3
+	if info.Rows != 24 || info.Width != 32 {
+		t.Errorf("laid out %d rows %d pixels wide, want 24 rows 32 wide", info.Rows, info.Width)
+	}
+	img, err := hex2img.Encode(sample, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if got, err := hex2img.Decode(img, opts); err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("Decode: got %x, %v", got, err)
+	}
+	// PNGs record the widths
+	if got, err := hex2img.Read(bytes.NewReader(write(t, sample, opts)), hex2img.Options{}); err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("PNG read without options: got %x, %v", got, err)
+	}
+	// Without them, the empty space right of the short rows is read as blocks
+	if got, err := hex2img.Decode(img, hex2img.Options{PixelSize: 4, BlocksPerRow: 8}); err == nil && bytes.Equal(got, sample) {
+		t.Error("decoding with fixed rows gave the payload")
+	}
+
+	for _, widths := range [][]int{{8, 0}, {-1}} {
+		if _, err := hex2img.Encode(sample, hex2img.Options{PixelSize: 4, RowWidths: widths}); err == nil {
+			t.Errorf("widths %v succeeded, want an error", widths)
+		}
+	}
+}
+
+func TestRelayout(t *testing.T) {
+	opts := hex2img.Options{PixelSize: 3, BlocksPerRow: 10, Alpha: true}
+	encoded := write(t, sample, opts)
+	for _, b := range []int{1, 7, 40} {
+		var buf bytes.Buffer
+		if err := hex2img.Relayout(&buf, bytes.NewReader(encoded), b, hex2img.Options{}); err != nil {
+			t.Fatalf("%d blocks per row: Relayout: %v", b, err)
+		}
+		cfg, err := png.DecodeConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != 3*b {
+			t.Errorf("%d blocks per row: image is %d pixels wide, want %d", b, cfg.Width, 3*b)
+		}
+		got, info, err := hex2img.ReadInfo(&buf, hex2img.Options{})
+		if err != nil {
+			t.Fatalf("%d blocks per row: ReadInfo: %v", b, err)
+		}
+		if !bytes.Equal(got, sample) || info.PixelSize != 3 {
+			t.Errorf("%d blocks per row: read pixel size %d and %x", b, info.PixelSize, got)
+		}
+	}
+
+	// Irregular rows give way to the new width
+	opts = hex2img.Options{PixelSize: 3, RowWidths: []int{5, 2}}
+	var buf bytes.Buffer
+	if err := hex2img.Relayout(&buf, bytes.NewReader(write(t, sample, opts)), 20, hex2img.Options{}); err != nil {
+		t.Fatalf("Relayout of row widths: %v", err)
+	}
+	if _, info, err := hex2img.ReadInfo(&buf, hex2img.Options{}); err != nil || info.BlocksPerRow != 20 {
+		t.Errorf("relaid out row widths: %d blocks per row, %v, want 20", info.BlocksPerRow, err)
+	}
+
+	if err := hex2img.Relayout(io.Discard, bytes.NewReader(encoded), 0, hex2img.Options{}); err == nil {
+		t.Error("Relayout to 0 blocks per row succeeded, want an error")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	old := options()
+	old.NoMagic = true
+	unsigned := write(t, sample, old)
+
+	var warnings strings.Builder
+	opts := options()
+	opts.Warnings = &warnings
+	// Without the signature, the length header is read from the first blocks
+	if got, err := hex2img.Read(bytes.NewReader(unsigned), opts); err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("unsigned image: got %x, %v", got, err)
+	}
+	if !strings.Contains(warnings.String(), "no hex2img signature") {
+		t.Errorf("warnings %q, want one about the missing signature", warnings.String())
+	}
+
+	opts.Strict = true
+	if _, err := hex2img.Read(bytes.NewReader(unsigned), opts); err == nil || !strings.Contains(err.Error(), "strict") {
+		t.Errorf("strict read of an unsigned image: got %v, want an error", err)
+	}
+	if got, err := hex2img.Read(bytes.NewReader(write(t, sample, options())), opts); err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("strict read of a signed image: got %x, %v", got, err)
+	}
+
+	opts.NoMagic = true
+	if err := opts.Validate(); err == nil {
+		t.Error("strict decoding without a signature is valid, want an error")
+	}
+}
+
+func TestMeasureSize(t *testing.T) {
+	opts := options()
+	opts.Compress = true
+	full, err := hex2img.Measure(sample, opts)
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	size, err := hex2img.MeasureSize(sample, opts)
+	if err != nil {
+		t.Fatalf("MeasureSize: %v", err)
+	}
+	if size.Colors != 0 || size.EstimatedSize != 0 {
+		t.Errorf("MeasureSize counted %d colors and %d bytes, want neither", size.Colors, size.EstimatedSize)
+	}
+	full.Colors, full.EstimatedSize = 0, 0
+	if size != full {
+		t.Errorf("MeasureSize gave %+v, want %+v as from Measure", size, full)
+	}
+}
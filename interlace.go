@@ -0,0 +1,110 @@
+package hex2img
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+)
+
+// adam7 holds the first column and row and the steps between the pixels of
+// each of the seven interlacing passes.
+var adam7 = [7]struct{ x, y, dx, dy int }{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// encodeInterlacedPNG encodes img as an Adam7 interlaced PNG, which
+// image/png cannot write. It handles the image types drawImage creates.
+// Rows are left unfiltered, so the file is usually larger than without
+// interlacing.
+func encodeInterlacedPNG(img image.Image, level png.CompressionLevel) ([]byte, error) {
+	var pix []byte
+	var stride, size, keep int
+	var depth, colorType byte
+	switch m := img.(type) {
+	case *image.Gray:
+		pix, stride, size, keep, depth, colorType = m.Pix, m.Stride, 1, 1, 8, 0
+	case *image.Gray16:
+		pix, stride, size, keep, depth, colorType = m.Pix, m.Stride, 2, 2, 16, 0
+	case *image.NRGBA:
+		pix, stride, size, keep, depth, colorType = m.Pix, m.Stride, 4, 4, 8, 6
+		if m.Opaque() {
+			keep, colorType = 3, 2
+		}
+	case *image.NRGBA64:
+		pix, stride, size, keep, depth, colorType = m.Pix, m.Stride, 8, 8, 16, 6
+		if m.Opaque() {
+			keep, colorType = 6, 2
+		}
+	default:
+		return nil, fmt.Errorf("cannot interlace %T", img)
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	var idat bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&idat, zlibLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	row := make([]byte, 0, 1+width*keep)
+	for _, p := range adam7 {
+		for y := p.y; y < height; y += p.dy {
+			// Every row starts with filter type 0, none
+			row = append(row[:0], 0)
+			for x := p.x; x < width; x += p.dx {
+				i := y*stride + x*size
+				row = append(row, pix[i:i+keep]...)
+			}
+			if len(row) == 1 {
+				// Passes with no pixels in a row have no rows at all
+				break
+			}
+			if _, err := zw.Write(row); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8], ihdr[9] = depth, colorType
+	ihdr[12] = 1 // Adam7
+
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	for _, c := range []struct {
+		chunkType string
+		data      []byte
+	}{{"IHDR", ihdr[:]}, {"IDAT", idat.Bytes()}, {"IEND", nil}} {
+		if err := writePNGChunk(&buf, c.chunkType, c.data); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// zlibLevel maps a PNG compression level to the zlib level image/png uses
+// for it.
+func zlibLevel(level png.CompressionLevel) int {
+	switch level {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	}
+	return zlib.DefaultCompression
+}
@@ -0,0 +1,76 @@
+package hex2img
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestEncodeInterlacedPNG(t *testing.T) {
+	// Images smaller than 8 pixels leave some of the passes empty
+	for _, size := range []image.Point{{1, 1}, {3, 5}, {9, 17}} {
+		r := image.Rect(0, 0, size.X, size.Y)
+		gray, gray16 := image.NewGray(r), image.NewGray16(r)
+		opaque, translucent := image.NewNRGBA(r), image.NewNRGBA(r)
+		opaque64, translucent64 := image.NewNRGBA64(r), image.NewNRGBA64(r)
+		for y := range size.Y {
+			for x := range size.X {
+				v := byte(x*31 + y*17)
+				gray.SetGray(x, y, color.Gray{v})
+				gray16.SetGray16(x, y, color.Gray16{uint16(v)<<8 | uint16(y)})
+				opaque.SetNRGBA(x, y, color.NRGBA{v, byte(x), byte(y), 0xff})
+				translucent.SetNRGBA(x, y, color.NRGBA{v, byte(x), byte(y), v | 1})
+				opaque64.SetNRGBA64(x, y, color.NRGBA64{uint16(v) << 8, uint16(x), uint16(y), 0xffff})
+				translucent64.SetNRGBA64(x, y, color.NRGBA64{uint16(v) << 8, uint16(x), uint16(y), uint16(v)<<8 | 1})
+			}
+		}
+
+		for _, img := range []image.Image{gray, gray16, opaque, translucent, opaque64, translucent64} {
+			encoded, err := encodeInterlacedPNG(img, png.DefaultCompression)
+			if err != nil {
+				t.Fatalf("%v %T: %v", size, img, err)
+			}
+			// The interlace method is the last byte of the IHDR chunk
+			if encoded[28] != 1 {
+				t.Errorf("%v %T: interlace method %d, want Adam7", size, img, encoded[28])
+			}
+			decoded, err := png.Decode(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("%v %T: png.Decode: %v", size, img, err)
+			}
+			for y := range size.Y {
+				for x := range size.X {
+					want := color.NRGBA64Model.Convert(img.At(x, y))
+					if got := color.NRGBA64Model.Convert(decoded.At(x, y)); got != want {
+						t.Fatalf("%v %T: pixel %d,%d is %v, want %v", size, img, x, y, got, want)
+					}
+				}
+			}
+		}
+	}
+
+	if _, err := encodeInterlacedPNG(image.NewRGBA(image.Rect(0, 0, 2, 2)), png.DefaultCompression); err == nil {
+		t.Error("interlacing an *image.RGBA succeeded, want an error")
+	}
+}
+
+func TestWriteInterlaced(t *testing.T) {
+	data := bytes.Repeat([]byte("interlaced "), 20)
+	opts := Options{PixelSize: 3, BlocksPerRow: 7, Interlace: true, Alpha: true}
+	var buf bytes.Buffer
+	if err := Write(&buf, data, opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if buf.Bytes()[28] != 1 {
+		t.Error("Write did not interlace the PNG")
+	}
+	got, err := Read(&buf, Options{})
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+}
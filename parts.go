@@ -0,0 +1,113 @@
+package hex2img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// partsMagic opens a payload made of several parts by JoinParts.
+const partsMagic = "HX2M"
+
+// multipartFlag is set in the format version byte of the images written with
+// Options.Multipart, so that a payload is only taken apart when it was built
+// by JoinParts, whatever its first bytes.
+const multipartFlag = 0x20
+
+// JoinParts combines several payloads into one. Each part is preceded by a
+// separator holding its length as a 4-byte big-endian value, so parts may
+// contain any bytes. The image should be written with Options.Multipart so
+// that it is known to hold several parts.
+func JoinParts(parts [][]byte) []byte {
+	data := []byte(partsMagic)
+	for _, p := range parts {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(p)))
+		data = append(data, p...)
+	}
+	return data
+}
+
+// SplitParts takes apart a payload built by JoinParts, as told by
+// Info.Multipart. Any other payload is an error.
+func SplitParts(data []byte) ([][]byte, error) {
+	if !bytes.HasPrefix(data, []byte(partsMagic)) {
+		return nil, errors.New("payload is not made of several parts")
+	}
+
+	var parts [][]byte
+	data = data[len(partsMagic):]
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("part %d: truncated separator", len(parts)+1)
+		}
+		n := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint64(n) > uint64(len(data)) {
+			return nil, fmt.Errorf("part %d: separator claims %d bytes, %d remain", len(parts)+1, n, len(data))
+		}
+		parts = append(parts, data[:n])
+		data = data[n:]
+	}
+	return parts, nil
+}
+
+// sequenceFlag is set in the format version byte of the images written with
+// Options.SequencePart, so that decoding knows to reassemble them without
+// looking into payloads that may start with anything.
+const sequenceFlag = 0x40
+
+// sequenceMagic opens the payload of each image of a sequence made by
+// SequencePart. It is followed by the index of the image and the number of
+// images, both 2-byte big-endian values, and then its share of the data.
+const (
+	sequenceMagic      = "HX2S"
+	sequenceHeaderSize = len(sequenceMagic) + 4
+
+	// MaxSequenceLen is the largest number of images in a sequence.
+	MaxSequenceLen = 1<<16 - 1
+)
+
+// SequencePart frames chunk as the image at index, counting from 0, of a
+// sequence of count images, so that JoinSequence can put the data of the
+// whole set back together in any order. The image should be written with
+// Options.SequencePart so that it is known to be part of a sequence.
+func SequencePart(chunk []byte, index, count int) []byte {
+	data := []byte(sequenceMagic)
+	data = binary.BigEndian.AppendUint16(data, uint16(index))
+	data = binary.BigEndian.AppendUint16(data, uint16(count))
+	return append(data, chunk...)
+}
+
+// JoinSequence reassembles the data split across the payloads of a
+// sequence by SequencePart, given in any order. Every image of the sequence
+// must be present exactly once. Whether an image is part of a sequence is
+// told by Info.SequencePart, not by its payload.
+func JoinSequence(payloads [][]byte) ([]byte, error) {
+	var chunks [][]byte
+	for i, p := range payloads {
+		if len(p) < sequenceHeaderSize || !bytes.HasPrefix(p, []byte(sequenceMagic)) {
+			return nil, fmt.Errorf("payload %d is not part of a sequence", i+1)
+		}
+		index := int(binary.BigEndian.Uint16(p[len(sequenceMagic):]))
+		count := int(binary.BigEndian.Uint16(p[len(sequenceMagic)+2:]))
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		switch {
+		case count != len(chunks):
+			return nil, fmt.Errorf("payload %d belongs to a sequence of %d images, not %d", i+1, count, len(chunks))
+		case index >= count:
+			return nil, fmt.Errorf("payload %d claims index %d in a sequence of %d images", i+1, index, count)
+		case chunks[index] != nil:
+			return nil, fmt.Errorf("image %d of the sequence is given twice", index)
+		}
+		chunks[index] = p[sequenceHeaderSize:]
+	}
+	for i, c := range chunks {
+		if c == nil {
+			return nil, fmt.Errorf("image %d of the sequence of %d images, counting from 0, is missing", i, len(chunks))
+		}
+	}
+	return bytes.Join(chunks, nil), nil
+}
@@ -0,0 +1,132 @@
+package hex2img_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/706f6c6c7578/hex2img"
+)
+
+func TestJoinSplitParts(t *testing.T) {
+	parts := [][]byte{
+		[]byte("first"),
+		{},
+		bytes.Repeat([]byte{0x00, 0xff}, 300),
+	}
+	got, err := hex2img.SplitParts(hex2img.JoinParts(parts))
+	if err != nil {
+		t.Fatalf("SplitParts: %v", err)
+	}
+	if len(got) != len(parts) {
+		t.Fatalf("got %d parts, want %d", len(got), len(parts))
+	}
+	for i := range parts {
+		if !bytes.Equal(got[i], parts[i]) {
+			t.Errorf("part %d: got %x, want %x", i, got[i], parts[i])
+		}
+	}
+}
+
+func TestSplitPartsTruncated(t *testing.T) {
+	data := hex2img.JoinParts([][]byte{[]byte("abc"), []byte("defg")})
+	if _, err := hex2img.SplitParts(data[:len(data)-1]); err == nil {
+		t.Error("SplitParts of a truncated payload succeeded, want an error")
+	}
+}
+
+func TestMultipartFlag(t *testing.T) {
+	joined := hex2img.JoinParts([][]byte{[]byte("a"), []byte("bc")})
+	for _, multipart := range []bool{false, true} {
+		opts := options()
+		opts.Multipart = multipart
+		var buf bytes.Buffer
+		if err := hex2img.Write(&buf, joined, opts); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		// Only the flag tells, since both payloads start alike
+		_, info, err := hex2img.ReadInfo(&buf, opts)
+		if err != nil {
+			t.Fatalf("ReadInfo: %v", err)
+		}
+		if info.Multipart != multipart {
+			t.Errorf("written with Multipart %v, read as %v", multipart, info.Multipart)
+		}
+	}
+
+	if _, err := hex2img.SplitParts([]byte("plain")); err == nil {
+		t.Error("SplitParts of a payload not made by JoinParts succeeded, want an error")
+	}
+	opts := options()
+	opts.Multipart, opts.NoMagic = true, true
+	if err := opts.Validate(); err == nil {
+		t.Error("Multipart without the magic signature is valid, want an error")
+	}
+}
+
+func TestJoinSequence(t *testing.T) {
+	chunks := [][]byte{[]byte("one "), []byte("two "), []byte("three")}
+	parts := make([][]byte, len(chunks))
+	for i, c := range chunks {
+		parts[i] = hex2img.SequencePart(c, i, len(chunks))
+	}
+
+	// The images may come in any order
+	got, err := hex2img.JoinSequence([][]byte{parts[2], parts[0], parts[1]})
+	if err != nil {
+		t.Fatalf("JoinSequence: %v", err)
+	}
+	if want := "one two three"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for name, payloads := range map[string][][]byte{
+		"missing":       {parts[0], parts[2]},
+		"twice":         {parts[0], parts[1], parts[1]},
+		"not a part":    {[]byte("plain")},
+		"other lengths": {parts[0], hex2img.SequencePart(nil, 1, 2), parts[2]},
+	} {
+		if _, err := hex2img.JoinSequence(payloads); err == nil {
+			t.Errorf("%s: JoinSequence succeeded, want an error", name)
+		}
+	}
+}
+
+func TestSequencePartFlag(t *testing.T) {
+	// A payload that merely looks like a part is not one
+	lookalike := hex2img.SequencePart([]byte{0xca, 0xfe}, 0, 1)
+	for _, part := range []bool{false, true} {
+		opts := options()
+		opts.SequencePart = part
+		var buf bytes.Buffer
+		if err := hex2img.Write(&buf, lookalike, opts); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		got, info, err := hex2img.ReadInfo(&buf, opts)
+		if err != nil {
+			t.Fatalf("ReadInfo: %v", err)
+		}
+		if info.SequencePart != part {
+			t.Errorf("written with SequencePart %v, read as %v", part, info.SequencePart)
+		}
+		if !bytes.Equal(got, lookalike) {
+			t.Errorf("got %x, want %x", got, lookalike)
+		}
+	}
+}
+
+func TestAppendRefusesParts(t *testing.T) {
+	for name, set := range map[string]func(*hex2img.Options){
+		"sequence":  func(o *hex2img.Options) { o.SequencePart = true },
+		"multipart": func(o *hex2img.Options) { o.Multipart = true },
+	} {
+		opts := options()
+		set(&opts)
+		var buf bytes.Buffer
+		if err := hex2img.Write(&buf, sample, opts); err != nil {
+			t.Fatalf("%s: Write: %v", name, err)
+		}
+		if err := hex2img.Append(new(bytes.Buffer), &buf, []byte{1}, options()); err == nil {
+			t.Errorf("%s: Append succeeded, want an error", name)
+		}
+	}
+}
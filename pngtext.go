@@ -0,0 +1,224 @@
+package hex2img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	metaPixelSize    = "hex2img:pixelSize"
+	metaBlockHeight  = "hex2img:blockHeight"
+	metaBlocksPerRow = "hex2img:blocksPerRow"
+	metaOrder        = "hex2img:order"
+	metaGrid         = "hex2img:grid"
+	metaMode         = "hex2img:mode"
+	metaECC          = "hex2img:ecc"
+	metaBorder       = "hex2img:border"
+	metaDepth        = "hex2img:depth"
+	metaBits         = "hex2img:bits"
+	metaEndian       = "hex2img:endian"
+	metaRowWidths    = "hex2img:rowWidths"
+
+	// metaCaption is the standard PNG keyword for a description of the
+	// image, which image viewers and tools like exiftool show.
+	metaCaption = "Description"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+type pngText struct {
+	key, value string
+}
+
+// writePNGWithText encodes img as PNG at the given compression level,
+// interlaced if requested, and inserts a tEXt chunk for every entry directly
+// after the IHDR chunk, in the order given. Values are stored in Latin-1,
+// which tEXt requires.
+func writePNGWithText(w io.Writer, img image.Image, level png.CompressionLevel, interlace bool, text []pngText) error {
+	var encoded []byte
+	if interlace {
+		var err error
+		if encoded, err = encodeInterlacedPNG(img, level); err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		enc := png.Encoder{CompressionLevel: level}
+		if err := enc.Encode(&buf, img); err != nil {
+			return err
+		}
+		encoded = buf.Bytes()
+	}
+
+	// The signature is followed by IHDR: 4 bytes length, 4 bytes type,
+	// 13 bytes data and 4 bytes CRC.
+	ihdrEnd := len(pngSignature) + 4 + 4 + 13 + 4
+	if _, err := w.Write(encoded[:ihdrEnd]); err != nil {
+		return err
+	}
+	for _, t := range text {
+		if err := writePNGChunk(w, "tEXt", append([]byte(t.key+"\x00"), toLatin1(t.value)...)); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(encoded[ihdrEnd:])
+	return err
+}
+
+func writePNGChunk(w io.Writer, chunkType string, data []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], chunkType)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+
+	var footer [4]byte
+	binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+
+	for _, b := range [][]byte{header[:], data, footer[:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPNGText collects the tEXt chunks of an encoded PNG. Parsing stops at
+// IEND or at the first malformed chunk, leaving validation of the image
+// itself to png.Decode.
+func readPNGText(encoded []byte) map[string]string {
+	text := make(map[string]string)
+	if !bytes.HasPrefix(encoded, pngSignature) {
+		return text
+	}
+
+	rest := encoded[len(pngSignature):]
+	for len(rest) >= 12 {
+		n := int(binary.BigEndian.Uint32(rest[:4]))
+		chunkType := string(rest[4:8])
+		if n < 0 || n > len(rest)-12 {
+			break
+		}
+		data := rest[8 : 8+n]
+		if chunkType == "tEXt" {
+			if key, value, ok := bytes.Cut(data, []byte{0}); ok {
+				text[string(key)] = fromLatin1(value)
+			}
+		}
+		if chunkType == "IEND" {
+			break
+		}
+		rest = rest[12+n:]
+	}
+	return text
+}
+
+// ReadPNGText returns the key and value of every tEXt chunk of a PNG,
+// including the hex2img layout metadata and any caption, without decoding
+// the image.
+func ReadPNGText(r io.Reader) (map[string]string, error) {
+	encoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading input: %w", err)
+	}
+	if !bytes.HasPrefix(encoded, pngSignature) {
+		return nil, fmt.Errorf("%w: input is not a PNG", ErrInvalidImage)
+	}
+	return readPNGText(encoded), nil
+}
+
+// isLatin1 reports whether s can be stored as a tEXt value: as Latin-1,
+// which holds the first 256 code points, and without NUL, which ends the
+// keyword.
+func isLatin1(s string) bool {
+	for _, r := range s {
+		if r == 0 || r > 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// toLatin1 converts s, which isLatin1 accepts, to Latin-1.
+func toLatin1(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = append(b, byte(r))
+	}
+	return b
+}
+
+// fromLatin1 converts a tEXt value back from Latin-1.
+func fromLatin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// pngTruncated reports whether the chunks of an encoded PNG run out before
+// the IEND chunk.
+func pngTruncated(encoded []byte) bool {
+	rest := encoded[len(pngSignature):]
+	for len(rest) >= 12 {
+		n := int(binary.BigEndian.Uint32(rest[:4]))
+		if n < 0 || n > len(rest)-12 {
+			return true
+		}
+		if string(rest[4:8]) == "IEND" {
+			return false
+		}
+		rest = rest[12+n:]
+	}
+	return true
+}
+
+// readPNGInt looks up a numeric tEXt entry, returning def when it is absent.
+func readPNGInt(text map[string]string, key string, def int) (int, error) {
+	v, ok := text[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s metadata %q", key, v)
+	}
+	return n, nil
+}
+
+// readPNGInts looks up a tEXt entry of comma-separated numbers, returning
+// def when it is absent.
+func readPNGInts(text map[string]string, key string, def []int) ([]int, error) {
+	v, ok := text[key]
+	if !ok {
+		return def, nil
+	}
+	var ns []int
+	for _, f := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s metadata %q", key, v)
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+// formatInts joins numbers with commas, as readPNGInts reads them.
+func formatInts(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,57 @@
+package hex2img_test
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"testing"
+
+	"github.com/706f6c6c7578/hex2img"
+)
+
+func TestCaption(t *testing.T) {
+	opts := options()
+	opts.Caption = "café, ½ full"
+	encoded := write(t, sample, opts)
+	// tEXt stores Latin-1
+	if !bytes.Contains(encoded, []byte("tEXtDescription\x00caf\xe9, \xbd full")) {
+		t.Error("the caption is not a Latin-1 tEXt chunk")
+	}
+	// The chunks keep their checksums, which image/png verifies
+	if _, err := png.Decode(bytes.NewReader(encoded)); err != nil {
+		t.Fatalf("png.Decode: %v", err)
+	}
+
+	text, err := hex2img.ReadPNGText(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("ReadPNGText: %v", err)
+	}
+	if text["Description"] != opts.Caption {
+		t.Errorf("caption %q, want %q", text["Description"], opts.Caption)
+	}
+	if text["hex2img:pixelSize"] != "8" || text["hex2img:blocksPerRow"] != "16" {
+		t.Errorf("layout metadata %v, want pixel size 8 and 16 blocks per row", text)
+	}
+	if got, err := hex2img.Read(bytes.NewReader(encoded), hex2img.Options{}); err != nil || !bytes.Equal(got, sample) {
+		t.Errorf("Read: got %x, %v", got, err)
+	}
+}
+
+func TestCaptionInvalid(t *testing.T) {
+	for _, caption := range []string{"snow ☃", "nul\x00"} {
+		opts := options()
+		opts.Caption = caption
+		if err := opts.Validate(); err == nil {
+			t.Errorf("caption %q is valid, want an error", caption)
+		}
+	}
+	opts := options()
+	opts.Caption, opts.Format = "note", hex2img.FormatBMP
+	if err := opts.Validate(); err == nil {
+		t.Error("a caption on a BMP is valid, want an error")
+	}
+
+	if _, err := hex2img.ReadPNGText(bytes.NewReader([]byte("GIF89a"))); !errors.Is(err, hex2img.ErrInvalidImage) {
+		t.Errorf("ReadPNGText of a GIF: got %v, want ErrInvalidImage", err)
+	}
+}
@@ -0,0 +1,65 @@
+package hex2img
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/rand/v2"
+)
+
+// scrambledFlag is set in the format version byte of scrambled streams, so
+// that decoding without the seed fails clearly instead of yielding noise.
+// The seed itself is not stored.
+const scrambledFlag = 0x80
+
+// ErrScrambled is returned when an image was scrambled but no seed was
+// given to decode it.
+var ErrScrambled = errors.New("image is scrambled: its seed is needed to decode it")
+
+// scramble moves every byte of data to a position chosen by a permutation
+// derived from seed. Since bytes move between blocks, the block colors and
+// their order both change. It hides the payload from casual viewers but is
+// no substitute for encryption.
+func scramble(data []byte, seed string) []byte {
+	out := make([]byte, len(data))
+	for i, j := range permutation(len(data), seed) {
+		out[i] = data[j]
+	}
+	return out
+}
+
+// unscramble reverses scramble with the same seed.
+func unscramble(data []byte, seed string) []byte {
+	out := make([]byte, len(data))
+	for i, j := range permutation(len(data), seed) {
+		out[j] = data[i]
+	}
+	return out
+}
+
+// permutation shuffles the numbers 0 to n-1 by Fisher-Yates, drawing from
+// ChaCha8 keyed with the SHA-256 of seed. It draws the random numbers
+// itself rather than through rand.Perm, whose use of the source may change
+// between Go releases and would make older images undecodable.
+func permutation(n int, seed string) []int {
+	src := rand.NewChaCha8(sha256.Sum256([]byte(seed)))
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	for i := n - 1; i > 0; i-- {
+		j := int(uniform(src, uint64(i)+1))
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+	return perm
+}
+
+// uniform returns a number below n from src, rejecting the draws that would
+// make the smaller results more likely.
+func uniform(src *rand.ChaCha8, n uint64) uint64 {
+	limit := -n % n // 2^64 mod n
+	for {
+		if v := src.Uint64(); v >= limit {
+			return v % n
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package hex2img
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPermutationIsStable(t *testing.T) {
+	// Images scrambled by earlier releases must keep decoding
+	want := []int{6, 9, 4, 7, 0, 3, 1, 2, 5, 8}
+	if got := permutation(10, "hex2img"); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestScramble(t *testing.T) {
+	data := bytes.Repeat([]byte("scramble me "), 10)
+	scrambled := scramble(data, "seed")
+	if bytes.Equal(scrambled, data) {
+		t.Fatal("scrambling left the data as it was")
+	}
+	if got := unscramble(scrambled, "seed"); !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+	if got := unscramble(scrambled, "Seed"); bytes.Equal(got, data) {
+		t.Error("a wrong seed unscrambled the data")
+	}
+}
+
+func TestReadScrambled(t *testing.T) {
+	data := bytes.Repeat([]byte("scramble me "), 10)
+	opts := Options{PixelSize: 4, Scramble: "seed"}
+	var buf bytes.Buffer
+	if err := Write(&buf, data, opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	if got, err := Read(bytes.NewReader(encoded), opts); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("right seed: got %q, %v", got, err)
+	}
+	if got, err := Read(bytes.NewReader(encoded), Options{Scramble: "wrong"}); err != nil || bytes.Equal(got, data) {
+		t.Errorf("wrong seed: got %q, %v, want garbage", got, err)
+	}
+	if _, err := Read(bytes.NewReader(encoded), Options{}); !errors.Is(err, ErrScrambled) {
+		t.Errorf("no seed: got %v, want ErrScrambled", err)
+	}
+
+	buf.Reset()
+	if err := Write(&buf, data, Options{PixelSize: 4}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var warnings strings.Builder
+	got, err := Read(&buf, Options{Scramble: "seed", Warnings: &warnings})
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("unscrambled image with a seed: got %q, %v", got, err)
+	}
+	if !strings.Contains(warnings.String(), "not scrambled") {
+		t.Errorf("warnings %q, want one about the ignored seed", warnings.String())
+	}
+}
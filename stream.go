@@ -0,0 +1,80 @@
+package hex2img
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// An Encoder writes the bytes written to it as an image. The image size
+// depends on the payload length, so nothing is written until Close.
+type Encoder struct {
+	w      io.Writer
+	opts   Options
+	buf    bytes.Buffer
+	closed bool
+}
+
+// NewEncoder returns an Encoder that writes an image in opts.Format to w.
+func NewEncoder(w io.Writer, opts Options) *Encoder {
+	return &Encoder{w: w, opts: opts}
+}
+
+// Write buffers p as part of the payload. Without compression it fails as
+// soon as the payload outgrows MaxDataLen.
+func (e *Encoder) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed Encoder")
+	}
+	if n := e.buf.Len() + len(p); !e.opts.Compress && n > MaxDataLen {
+		return 0, fmt.Errorf("input too large: %d bytes (max %d)", n, MaxDataLen)
+	}
+	return e.buf.Write(p)
+}
+
+// Close encodes the buffered payload and writes the image. It does not
+// close the underlying writer.
+func (e *Encoder) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return Write(e.w, e.buf.Bytes(), e.opts)
+}
+
+// A Decoder reads the payload of an image. The whole image is decoded on
+// the first call to Read.
+type Decoder struct {
+	r    io.Reader
+	opts Options
+
+	data    *bytes.Reader
+	err     error
+	decoded bool
+}
+
+// NewDecoder returns a Decoder that reads the image in opts.Format on r.
+func NewDecoder(r io.Reader, opts Options) *Decoder {
+	return &Decoder{r: r, opts: opts}
+}
+
+// Read reads the decoded payload. When the checksum fails the payload is
+// still returned, and the error wrapping ErrChecksum takes the place of
+// io.EOF.
+func (d *Decoder) Read(p []byte) (int, error) {
+	if !d.decoded {
+		d.decoded = true
+		data, err := Read(d.r, d.opts)
+		d.data, d.err = bytes.NewReader(data), err
+		if err != nil && !errors.Is(err, ErrChecksum) {
+			return 0, err
+		}
+	}
+
+	n, err := d.data.Read(p)
+	if err == io.EOF && d.err != nil {
+		err = d.err
+	}
+	return n, err
+}
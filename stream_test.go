@@ -0,0 +1,84 @@
+package hex2img_test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/706f6c6c7578/hex2img"
+)
+
+func TestEncoderDecoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := hex2img.NewEncoder(&buf, options())
+	if _, err := io.Copy(enc, iotest.OneByteReader(bytes.NewReader(sample))); err != nil {
+		t.Fatalf("copy to Encoder: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes written before Close, want none", buf.Len())
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), write(t, sample, options())) {
+		t.Error("Encoder output differs from Write")
+	}
+	if _, err := enc.Write([]byte{1}); err == nil {
+		t.Error("Write after Close succeeded, want an error")
+	}
+
+	got, err := io.ReadAll(iotest.OneByteReader(hex2img.NewDecoder(&buf, options())))
+	if err != nil {
+		t.Fatalf("reading Decoder: %v", err)
+	}
+	if !bytes.Equal(got, sample) {
+		t.Errorf("got %x, want %x", got, sample)
+	}
+}
+
+func TestEncoderTooLarge(t *testing.T) {
+	enc := hex2img.NewEncoder(io.Discard, options())
+	if _, err := enc.Write(make([]byte, hex2img.MaxDataLen)); err != nil {
+		t.Fatalf("Write of MaxDataLen bytes: %v", err)
+	}
+	if _, err := enc.Write([]byte{1}); err == nil {
+		t.Error("Write beyond MaxDataLen succeeded, want an error")
+	}
+}
+
+func TestDecoderChecksum(t *testing.T) {
+	opts := options()
+	opts.Checksum = true
+	img, err := hex2img.Encode(sample, opts)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// Change a payload byte in the fourth block, past the header
+	corrupt := image.NewNRGBA(img.Bounds())
+	draw.Draw(corrupt, corrupt.Bounds(), img, img.Bounds().Min, draw.Src)
+	c := corrupt.NRGBAAt(24, 0)
+	c.R ^= 1
+	draw.Draw(corrupt, image.Rect(24, 0, 32, 8), image.NewUniform(c), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, corrupt); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(hex2img.NewDecoder(&buf, opts))
+	if !errors.Is(err, hex2img.ErrChecksum) {
+		t.Errorf("got %v, want ErrChecksum", err)
+	}
+	if len(got) != len(sample) {
+		t.Errorf("read %d bytes, want the %d bytes of the payload", len(got), len(sample))
+	}
+
+	_, err = io.ReadAll(hex2img.NewDecoder(bytes.NewReader([]byte("not an image")), opts))
+	if err == nil || errors.Is(err, hex2img.ErrChecksum) {
+		t.Errorf("reading a broken image: got %v, want a decoding error", err)
+	}
+}
@@ -0,0 +1,338 @@
+package hex2img
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ajstarks/svgo"
+)
+
+func encodeSVG(w io.Writer, data []byte, l layout, opts Options) error {
+	width, height := l.size()
+	scale := max(opts.Scale, 1)
+	canvas := svg.New(w)
+	// The viewBox keeps block coordinates in pixels while the rendered size
+	// grows with the scale. Without crisp edges, renderers antialias the
+	// seams between blocks.
+	canvas.Start(width*scale, height*scale,
+		fmt.Sprintf(`viewBox="0 0 %d %d"`, width, height),
+		`shape-rendering="crispEdges"`)
+
+	// The unused blocks take the same color as in drawImage. They come
+	// after the data, which decoding stops at.
+	bpb := opts.bytesPerBlock()
+	blockCount := (len(data) + bpb - 1) / bpb
+	total := l.cells()
+	pad := color.NRGBAModel.Convert(padColor(opts)).(color.NRGBA)
+	colorOf := func(b int) color.NRGBA {
+		if b < blockCount {
+			c, _ := getColor(data, b*bpb, opts.Alpha)
+			return c
+		}
+		return pad
+	}
+
+	// Runs of blocks of the same color along a row, or a column when the
+	// blocks fill columns, become one longer rect
+	line := l.blocksPerRow
+	if l.columnMajor {
+		line = l.rows
+	}
+	p := newProgress(opts.Progress, blockCount)
+	reported := 0
+	for b := 0; b < total; {
+		c := colorOf(b)
+		run := 1
+		for b+run < total && (b+run)%line != 0 && colorOf(b+run) == c {
+			run++
+		}
+		x, y := getBlockPosition(b, l)
+		w, h := run*l.pixelSize, l.pixelSize
+		if l.columnMajor {
+			w, h = h, w
+		}
+		canvas.Rect(x, y, w, h, svgFill(c, opts.Alpha))
+		b += run
+
+		if done := min(b, blockCount); done > reported && (done%line == 0 || done == blockCount) {
+			p.add(done - reported)
+			reported = done
+		}
+	}
+
+	if opts.Labels {
+		drawSVGLabels(canvas, data, l, bpb)
+	}
+
+	canvas.End()
+	return nil
+}
+
+// svgFill returns the style of a rect of color c: its fill and, in alpha
+// mode, a fill-opacity with enough digits to recover the alpha byte.
+func svgFill(c color.NRGBA, alpha bool) string {
+	fill := fmt.Sprintf("fill:#%02x%02x%02x", c.R, c.G, c.B)
+	if alpha {
+		fill += ";fill-opacity:" + strconv.FormatFloat(float64(c.A)/255, 'f', 4, 64)
+	}
+	return fill
+}
+
+// drawSVGLabels writes the stream offset of every data block in its center,
+// in black or white, whichever stands out more against the block. The
+// stream starts with the signature and length header, so the offsets are
+// not those of the payload.
+func drawSVGLabels(canvas *svg.SVG, data []byte, l layout, bpb int) {
+	size := max(l.pixelSize/4, 1)
+	for i := 0; i < len(data); i += bpb {
+		c, _ := getColor(data, i, false)
+		ink := "#000000"
+		if color.GrayModel.Convert(c).(color.Gray).Y < 0x80 {
+			ink = "#ffffff"
+		}
+		x, y := getBlockPosition(i/bpb, l)
+		canvas.Text(x+l.pixelSize/2, y+l.pixelSize/2, strconv.Itoa(i),
+			fmt.Sprintf("font-family:monospace;font-size:%dpx;text-anchor:middle;dominant-baseline:central;fill:%s", size, ink))
+	}
+}
+
+// decodeSVG collects the fill colors of all <rect> elements in document
+// order, skipping anything else such as block labels. The fill may be given
+// as a fill attribute or as a fill property of the style attribute. Since
+// the document is parsed as XML, line breaks don't matter: minified SVGs
+// with every rect on one line decode the same. A rect longer than wide
+// stands for that many blocks of its color. The layout is derived from the
+// viewBox, or else the size, of the document and the width of its first
+// rect. With alpha, every block also holds the alpha of its #rrggbbaa fill,
+// scaled by any fill-opacity. A run never reaches past the edge of the
+// image, and documents holding more blocks than the longest stream and a
+// line of unused blocks are refused.
+func decodeSVG(r io.Reader, opts Options) ([]byte, Info, error) {
+	alpha := opts.Alpha
+	bpb := 3
+	if alpha {
+		bpb = 4
+	}
+	limit, padding := maxStreamLen(opts.ECC, bpb), 0
+	eccRead := opts.NoMagic
+	var data []byte
+	var info Info
+	blockSize, rects := 0, 0
+	decoder := xml.NewDecoder(r)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, info, fmt.Errorf("%w: parsing SVG: %w", ErrInvalidImage, err)
+		}
+
+		el, ok := tok.(xml.StartElement)
+		if ok && el.Name.Local == "svg" && info.Width == 0 {
+			info.Width, info.Height = svgSize(el.Attr)
+		}
+		if !ok || el.Name.Local != "rect" {
+			continue
+		}
+		fill, ok := rectProperty(el.Attr, "fill")
+		if !ok {
+			continue
+		}
+		rects++
+		c, err := parseSVGColor(fill)
+		if err == nil && alpha {
+			c, err = withOpacity(c, el.Attr)
+		}
+		if err != nil {
+			return nil, info, fmt.Errorf("%w: decoding color of rect %d in SVG: %w", ErrInvalidImage, rects, err)
+		}
+		if !alpha {
+			c = c[:3]
+		}
+		w, _ := strconv.Atoi(xmlAttr(el.Attr, "width"))
+		h, _ := strconv.Atoi(xmlAttr(el.Attr, "height"))
+		if blockSize == 0 {
+			blockSize = min(w, h)
+			if blockSize > 0 {
+				// The unused blocks completing the last line follow the
+				// stream, fewer than a row or column holds
+				padding = min(max(info.Width, info.Height)/blockSize, limit/bpb) * bpb
+			}
+		}
+		n := rectBlocks(w, h)
+		if n > 1 {
+			// A run ends at the edge of the image, however long its rect
+			x, _ := strconv.Atoi(xmlAttr(el.Attr, "x"))
+			y, _ := strconv.Atoi(xmlAttr(el.Attr, "y"))
+			left := (info.Width - x) / blockSize
+			if h > w {
+				left = (info.Height - y) / blockSize
+			}
+			n = min(n, max(left, 1))
+		}
+		if !eccRead && len(data) >= eccHeaderLen(bpb) {
+			// The ECC header lengthens the limit by the parity it records
+			eccRead = true
+			if _, ecc := stripECCHeader(data, bpb); ecc > 0 {
+				limit = maxStreamLen(ecc, bpb)
+			}
+		}
+		// Compared by division, as n*len(c) can overflow for a huge rect
+		if n > (limit+padding-len(data))/len(c) {
+			return nil, info, fmt.Errorf("%w: SVG holds more than the %d bytes of the largest stream and grid", ErrInvalidImage, limit+padding)
+		}
+		for range n {
+			data = append(data, c...)
+		}
+	}
+
+	info.Blocks, info.BytesPerBlock = len(data)/bpb, bpb
+	if blockSize > 0 {
+		info.BlocksPerRow, info.Rows = info.Width/blockSize, info.Height/blockSize
+		info.PixelSize = blockSize
+	}
+	return data, info, nil
+}
+
+// maxStreamLen returns the length of the longest stream: the largest
+// payload in its signature, version, length header and checksum, spread
+// over whole ECC groups after their header if there are parity blocks, and
+// rounded up to a whole block.
+func maxStreamLen(ecc, bpb int) int {
+	n := len(magic) + 1 + headerSize + MaxDataLen + crc32.Size
+	if ecc > 0 {
+		group := (rsGroupSize - ecc) * bpb
+		n = eccHeaderLen(bpb) + (n+group-1)/group*rsGroupSize*bpb
+	}
+	return n + bpb
+}
+
+// rectBlocks returns how many blocks a w by h rect covers: the runs of
+// blocks that encodeSVG merges are as many times longer than wide.
+func rectBlocks(w, h int) int {
+	if w <= 0 || h <= 0 {
+		return 1
+	}
+	return max(w, h) / min(w, h)
+}
+
+// svgSize returns the size of an svg element in user units: that of its
+// viewBox if it has one, else its width and height.
+func svgSize(attrs []xml.Attr) (width, height int) {
+	if f := strings.Fields(xmlAttr(attrs, "viewBox")); len(f) == 4 {
+		width, _ = strconv.Atoi(f[2])
+		height, _ = strconv.Atoi(f[3])
+		return width, height
+	}
+	width, _ = strconv.Atoi(xmlAttr(attrs, "width"))
+	height, _ = strconv.Atoi(xmlAttr(attrs, "height"))
+	return width, height
+}
+
+func xmlAttr(attrs []xml.Attr, name string) string {
+	for _, attr := range attrs {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// rectProperty returns a property of a rect such as its fill, preferring
+// the style property over the presentation attribute as CSS does.
+func rectProperty(attrs []xml.Attr, property string) (string, bool) {
+	var value string
+	var found bool
+	for _, attr := range attrs {
+		switch attr.Name.Local {
+		case "style":
+			for _, decl := range strings.Split(attr.Value, ";") {
+				name, v, ok := strings.Cut(decl, ":")
+				if ok && strings.TrimSpace(name) == property {
+					return strings.TrimSpace(v), true
+				}
+			}
+		case property:
+			value, found = strings.TrimSpace(attr.Value), true
+		}
+	}
+	return value, found
+}
+
+// withOpacity scales the alpha byte of c, a color returned by
+// parseSVGColor, by the fill-opacity of its rect, if it has one.
+func withOpacity(c []byte, attrs []xml.Attr) ([]byte, error) {
+	s, ok := rectProperty(attrs, "fill-opacity")
+	if !ok {
+		return c, nil
+	}
+	opacity, err := strconv.ParseFloat(s, 64)
+	if err != nil || opacity < 0 || opacity > 1 {
+		return nil, fmt.Errorf("malformed fill-opacity %q: expected a number from 0 to 1", s)
+	}
+	c[3] = byte(math.Round(float64(c[3]) * opacity))
+	return c, nil
+}
+
+// parseSVGColor converts a #rrggbb, #rrggbbaa or rgb(r,g,b) color to four
+// bytes, with an alpha of 0xff unless it is given. A shorter #rrggbb color,
+// as left by a file cut off in the middle of one, is reported as
+// truncated.
+func parseSVGColor(s string) ([]byte, error) {
+	if args, ok := strings.CutPrefix(s, "rgb("); ok {
+		c, err := parseRGBFunc(s, args)
+		if err != nil {
+			return nil, err
+		}
+		return append(c, 0xff), nil
+	}
+	if !strings.HasPrefix(s, "#") || len(s) > 9 || len(s) == 8 {
+		return nil, fmt.Errorf("unsupported color %q", s)
+	}
+	if len(s) < 7 {
+		return nil, fmt.Errorf("truncated color %q: expected #rrggbb", s)
+	}
+	c, err := hex.DecodeString(s[1:])
+	if err != nil {
+		return nil, fmt.Errorf("malformed color %q: %w", s, err)
+	}
+	if len(c) == 3 {
+		c = append(c, 0xff)
+	}
+	return c, nil
+}
+
+// parseRGBFunc parses the arguments of an rgb() color. Components outside
+// 0-255 are rejected rather than clamped, since clamping would silently
+// change the decoded bytes.
+func parseRGBFunc(s, args string) ([]byte, error) {
+	args, ok := strings.CutSuffix(strings.TrimSpace(args), ")")
+	if !ok {
+		return nil, fmt.Errorf("malformed color %q: missing closing parenthesis", s)
+	}
+	parts := strings.Split(args, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed color %q: expected 3 components, got %d", s, len(parts))
+	}
+
+	c := make([]byte, 3)
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("malformed color %q: component %q is not an integer", s, strings.TrimSpace(part))
+		}
+		if v < 0 || v > 255 {
+			return nil, fmt.Errorf("malformed color %q: component %d out of range 0-255", s, v)
+		}
+		c[i] = byte(v)
+	}
+	return c, nil
+}
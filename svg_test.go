@@ -0,0 +1,360 @@
+package hex2img_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/706f6c6c7578/hex2img"
+)
+
+// framed returns payload as Write lays it out in blocks: after the
+// signature, the format version and the 3-byte length header.
+func framed(payload []byte) []byte {
+	n := len(payload)
+	return append([]byte{'H', 'X', '2', 'I', 1, byte(n >> 16), byte(n >> 8), byte(n)}, payload...)
+}
+
+// svgDoc returns an SVG holding stream in a single row of 10-unit blocks of
+// 3 bytes, each drawn by rect from its x coordinate and #rrggbb fill.
+func svgDoc(stream []byte, rect func(x int, fill string) string) string {
+	var b strings.Builder
+	blocks := len(stream) / 3
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="10">`+"\n", blocks*10)
+	for i := range blocks {
+		b.WriteString(rect(i*10, fmt.Sprintf("#%x", stream[3*i:3*i+3])))
+		b.WriteString("\n")
+	}
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// readSVG decodes doc, which must hold payload.
+func readSVG(t *testing.T, doc string, payload []byte, opts hex2img.Options) {
+	t.Helper()
+	opts.Format = hex2img.FormatSVG
+	got, err := hex2img.Read(strings.NewReader(doc), opts)
+	if err != nil {
+		t.Fatalf("Read: %v\n%s", err, doc)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("got %x, want %x\n%s", got, payload, doc)
+	}
+}
+
+func TestSVGAttributeForms(t *testing.T) {
+	payload := []byte{0xde, 0xad, 0xbe, 0xef}
+	for name, rect := range map[string]func(x int, fill string) string{
+		"fill first": func(x int, fill string) string {
+			return fmt.Sprintf(`<rect fill="%s" height="10" width="10" y="0" x="%d"/>`, fill, x)
+		},
+		"style": func(x int, fill string) string {
+			return fmt.Sprintf(`<rect x="%d" y="0" width="10" height="10" style="stroke:none; fill: %s"/>`, x, fill)
+		},
+		"single quotes": func(x int, fill string) string {
+			return fmt.Sprintf(`<rect x='%d' y='0' width='10' height='10' fill='%s' />`, x, fill)
+		},
+		"extra attributes": func(x int, fill string) string {
+			return fmt.Sprintf(`<rect id="b%d" class="block" x="%d" y="0" width="10" height="10" fill="%s" stroke-width="0"/>`, x, x, fill)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			readSVG(t, svgDoc(framed(payload), rect), payload, hex2img.Options{})
+		})
+	}
+}
+
+func TestSVGRGBFunction(t *testing.T) {
+	payload := []byte{0xde, 0xad, 0xbe, 0xef}
+	doc := svgDoc(framed(payload), func(x int, fill string) string {
+		var r, g, b int
+		fmt.Sscanf(fill, "#%02x%02x%02x", &r, &g, &b)
+		return fmt.Sprintf(`<rect x="%d" y="0" width="10" height="10" fill="rgb(%d, %d,%d)"/>`, x, r, g, b)
+	})
+	readSVG(t, doc, payload, hex2img.Options{})
+
+	for _, fill := range []string{"rgb(256,0,0)", "rgb(1,2)", "rgb(1,2,3", "rgb(a,b,c)"} {
+		doc := strings.Replace(doc, `fill="rgb(`, `fill="`+fill+`" data-x="rgb(`, 1)
+		_, err := hex2img.Read(strings.NewReader(doc), hex2img.Options{Format: hex2img.FormatSVG})
+		if !errors.Is(err, hex2img.ErrInvalidImage) {
+			t.Errorf("fill %s: got %v, want ErrInvalidImage", fill, err)
+		}
+	}
+}
+
+func TestSVGLayoutOfRects(t *testing.T) {
+	payload := []byte{0xde, 0xad, 0xbe, 0xef}
+	rect := func(x int, fill string) string {
+		return fmt.Sprintf(`<rect x="%d" y="0" width="10" height="10" fill="%s"/>`, x, fill)
+	}
+	doc := svgDoc(framed(payload), rect)
+
+	t.Run("one line", func(t *testing.T) {
+		readSVG(t, strings.ReplaceAll(doc, "\n", ""), payload, hex2img.Options{})
+	})
+	t.Run("several per line", func(t *testing.T) {
+		readSVG(t, strings.Replace(doc, "/>\n<rect", "/> <rect", 2), payload, hex2img.Options{})
+	})
+	t.Run("closing tags", func(t *testing.T) {
+		readSVG(t, strings.ReplaceAll(doc, "/>", "></rect>"), payload, hex2img.Options{})
+	})
+	t.Run("attributes over lines", func(t *testing.T) {
+		readSVG(t, strings.ReplaceAll(doc, `" `, "\"\n\t"), payload, hex2img.Options{})
+	})
+	t.Run("other elements between", func(t *testing.T) {
+		doc := strings.Replace(doc, "\n<rect", "\n<!-- blocks -->\n<g></g>\n<rect", 2)
+		readSVG(t, doc, payload, hex2img.Options{})
+	})
+}
+
+// svgRoot returns the attributes of the svg element of doc.
+func svgRoot(t *testing.T, doc []byte) map[string]string {
+	t.Helper()
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("no svg element: %v", err)
+		}
+		if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "svg" {
+			attrs := make(map[string]string)
+			for _, a := range el.Attr {
+				attrs[a.Name.Local] = a.Value
+			}
+			return attrs
+		}
+	}
+}
+
+func TestSVGCrispEdges(t *testing.T) {
+	opts := options()
+	opts.Format = hex2img.FormatSVG
+	doc := write(t, sample, opts)
+	if got := svgRoot(t, doc)["shape-rendering"]; got != "crispEdges" {
+		t.Errorf("shape-rendering is %q, want crispEdges", got)
+	}
+	if bytes.Contains(doc, []byte("stroke")) {
+		t.Error("blocks have a stroke, which would blur their edges")
+	}
+}
+
+func TestSVGScale(t *testing.T) {
+	opts := options()
+	opts.Format = hex2img.FormatSVG
+	info, err := hex2img.Measure(sample, opts)
+	if err != nil {
+		t.Fatalf("Measure: %v", err)
+	}
+	viewBox := fmt.Sprintf("0 0 %d %d", info.Width, info.Height)
+
+	for _, scale := range []int{0, 1, 3} {
+		opts.Scale = scale
+		doc := write(t, sample, opts)
+		root := svgRoot(t, doc)
+		want := max(scale, 1)
+		if root["viewBox"] != viewBox || root["width"] != fmt.Sprint(want*info.Width) || root["height"] != fmt.Sprint(want*info.Height) {
+			t.Errorf("scale %d: svg is %s by %s with viewBox %q, want %d times %q", scale, root["width"], root["height"], root["viewBox"], want, viewBox)
+		}
+
+		// The blocks keep their coordinates, so decoding needs no scale
+		got, err := hex2img.Read(bytes.NewReader(doc), hex2img.Options{Format: hex2img.FormatSVG})
+		if err != nil || !bytes.Equal(got, sample) {
+			t.Errorf("scale %d: Read gave %x, %v", scale, got, err)
+		}
+	}
+}
+
+func TestSVGMergesRuns(t *testing.T) {
+	data := bytes.Repeat([]byte{0x5a}, 300)
+	for _, columnMajor := range []bool{false, true} {
+		opts := options()
+		opts.Format, opts.ColumnMajor = hex2img.FormatSVG, columnMajor
+		doc := write(t, data, opts)
+		info, err := hex2img.Measure(data, opts)
+		if err != nil {
+			t.Fatalf("Measure: %v", err)
+		}
+		// Runs never cross a line, so there is at least one rect per line
+		rects := bytes.Count(doc, []byte("<rect"))
+		if rects >= info.Blocks/4 {
+			t.Errorf("column-major %v: %d rects for %d blocks of one color, want runs merged", columnMajor, rects, info.Blocks)
+		}
+		got, err := hex2img.Read(bytes.NewReader(doc), opts)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("column-major %v: Read gave %x, %v", columnMajor, got, err)
+		}
+	}
+}
+
+func TestSVGHostileRects(t *testing.T) {
+	// A long rect without an image size to bound it is a single block
+	const rect = `<rect width="200000000" height="1" fill="#000000"/>`
+	doc := `<svg xmlns="http://www.w3.org/2000/svg">` + rect + `</svg>`
+	opts := hex2img.Options{Format: hex2img.FormatSVG}
+	if blocks, err := hex2img.ReadBlocks(strings.NewReader(doc), opts); err != nil || len(blocks) != 1 {
+		t.Errorf("unsized SVG: got %d blocks, %v, want 1", len(blocks), err)
+	}
+
+	// A run stops at the edge of the image
+	doc = `<svg xmlns="http://www.w3.org/2000/svg" width="3" height="2">` + strings.Repeat(rect, 2) + `</svg>`
+	if blocks, err := hex2img.ReadBlocks(strings.NewReader(doc), opts); err != nil || len(blocks) != 6 {
+		t.Errorf("3x2 SVG: got %d blocks, %v, want 6", len(blocks), err)
+	}
+
+	// An image wide enough for the rect holds more than any stream
+	doc = `<svg xmlns="http://www.w3.org/2000/svg" width="200000000" height="1">` + rect + `</svg>`
+	if _, err := hex2img.ReadBlocks(strings.NewReader(doc), opts); !errors.Is(err, hex2img.ErrInvalidImage) {
+		t.Errorf("wide SVG: got %v, want ErrInvalidImage", err)
+	}
+
+	// So does one whose run is long enough to overflow its length in bytes
+	const huge = "6148914691236517206"
+	doc = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 ` + huge + ` 1">` +
+		`<rect width="` + huge + `" height="1" fill="#000000"/></svg>`
+	if _, err := hex2img.ReadBlocks(strings.NewReader(doc), opts); !errors.Is(err, hex2img.ErrInvalidImage) {
+		t.Errorf("huge SVG: got %v, want ErrInvalidImage", err)
+	}
+}
+
+func TestSVGLabels(t *testing.T) {
+	opts := options()
+	opts.Format, opts.Labels = hex2img.FormatSVG, true
+	doc := write(t, sample[:10], opts)
+
+	// The 18 bytes of stream, signature and header included, make six
+	// blocks labelled with the offset of their first byte
+	var labels []string
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "text" {
+			var s string
+			if err := d.DecodeElement(&s, &el); err != nil {
+				t.Fatal(err)
+			}
+			labels = append(labels, s)
+		}
+	}
+	if got, want := strings.Join(labels, " "), "0 3 6 9 12 15"; got != want {
+		t.Errorf("labels are %q, want %q", got, want)
+	}
+
+	got, err := hex2img.Read(bytes.NewReader(doc), opts)
+	if err != nil || !bytes.Equal(got, sample[:10]) {
+		t.Errorf("Read gave %x, %v", got, err)
+	}
+	opts.Format = hex2img.FormatPNG
+	if err := hex2img.Write(new(bytes.Buffer), sample, opts); err == nil {
+		t.Error("labels on a PNG are valid, want an error")
+	}
+}
+
+func TestSVGEstimatedSize(t *testing.T) {
+	labels := options()
+	labels.Format, labels.Labels = hex2img.FormatSVG, true
+	background := options()
+	background.Format, background.Background = hex2img.FormatSVG, color.NRGBA{0x12, 0x34, 0x56, 0xff}
+	for _, opts := range []hex2img.Options{labels, background} {
+		info, err := hex2img.Measure(sample, opts)
+		if err != nil {
+			t.Fatalf("Measure: %v", err)
+		}
+		if n := int64(len(write(t, sample, opts))); info.EstimatedSize != n {
+			t.Errorf("labels %v, background %v: estimated %d bytes, want the %d written", opts.Labels, opts.Background, info.EstimatedSize, n)
+		}
+	}
+}
+
+func TestSVGTruncatedFill(t *testing.T) {
+	payload := []byte{0xde, 0xad, 0xbe, 0xef}
+	doc := svgDoc(framed(payload), func(x int, fill string) string {
+		return fmt.Sprintf(`<rect x="%d" y="0" width="10" height="10" fill="%s"/>`, x, fill)
+	})
+	// Cut the third rect's fill short, as a file cut off inside it would be
+	rects := strings.SplitAfter(doc, "\n")
+	i := strings.Index(rects[3], `fill="#`) + len(`fill="#`)
+	rects[3] = rects[3][:i+2] + `"/>` + "\n"
+	_, err := hex2img.Read(strings.NewReader(strings.Join(rects, "")), hex2img.Options{Format: hex2img.FormatSVG})
+	if !errors.Is(err, hex2img.ErrInvalidImage) || !strings.Contains(err.Error(), "truncated") || !strings.Contains(err.Error(), "rect 3") {
+		t.Errorf("got %v, want a truncated color in rect 3", err)
+	}
+
+	for _, fill := range []string{"#12345", "#1234567", "#12345g", "red"} {
+		doc := strings.Replace(doc, `fill="#`, `fill="`+fill+`" data-fill="#`, 1)
+		if _, err := hex2img.Read(strings.NewReader(doc), hex2img.Options{Format: hex2img.FormatSVG}); err == nil {
+			t.Errorf("fill %s: Read succeeded, want an error", fill)
+		}
+	}
+}
+
+func TestSVGAlpha(t *testing.T) {
+	payload := []byte{0xde, 0xad, 0xbe, 0x00}
+	stream := framed(payload)
+	doc := func(rect func(x int, c []byte) string) string {
+		var b strings.Builder
+		fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="10">`, len(stream)/4*10)
+		for i := 0; i < len(stream); i += 4 {
+			b.WriteString(rect(i/4*10, stream[i:i+4]))
+		}
+		b.WriteString("</svg>")
+		return b.String()
+	}
+	opts := hex2img.Options{Alpha: true}
+
+	t.Run("rrggbbaa", func(t *testing.T) {
+		readSVG(t, doc(func(x int, c []byte) string {
+			return fmt.Sprintf(`<rect x="%d" y="0" width="10" height="10" fill="#%x"/>`, x, c)
+		}), payload, opts)
+	})
+	t.Run("fill-opacity", func(t *testing.T) {
+		readSVG(t, doc(func(x int, c []byte) string {
+			return fmt.Sprintf(`<rect x="%d" y="0" width="10" height="10" style="fill:#%x;fill-opacity:%.4f"/>`, x, c[:3], float64(c[3])/255)
+		}), payload, opts)
+	})
+
+	// Write stores the alpha as fill-opacity, precise enough for every byte
+	data := make([]byte, 4*256)
+	for i := range 256 {
+		data[4*i], data[4*i+3] = byte(i), byte(i)
+	}
+	wopts := options()
+	wopts.Format, wopts.Alpha = hex2img.FormatSVG, true
+	encoded := write(t, data, wopts)
+	if !bytes.Contains(encoded, []byte("fill-opacity:")) {
+		t.Error("alpha SVG has no fill-opacity")
+	}
+	got, err := hex2img.Read(bytes.NewReader(encoded), wopts)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Read gave %x, %v", got, err)
+	}
+}
+
+func TestReadMinifiedSVG(t *testing.T) {
+	data := bytes.Repeat(sample, 100)
+	opts := options()
+	opts.Format = hex2img.FormatSVG
+	var buf bytes.Buffer
+	if err := hex2img.Write(&buf, data, opts); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// A single line longer than the 64 KB a bufio.Scanner takes by default
+	line := strings.ReplaceAll(buf.String(), "\n", "")
+	if len(line) <= 64<<10 {
+		t.Fatalf("minified SVG is %d bytes, want more than 64 KB", len(line))
+	}
+	got, err := hex2img.Read(strings.NewReader(line), opts)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes that differ from the %d written", len(got), len(data))
+	}
+}
@@ -0,0 +1,35 @@
+package hex2img
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"io"
+)
+
+// encodeANSI previews the blocks on a terminal with 24-bit color escapes.
+// Every character cell is an upper half block showing one block in its
+// foreground and the block below it in its background, so a text line
+// covers two rows of blocks.
+func encodeANSI(w io.Writer, data []byte, l layout, opts Options) error {
+	l.pixelSize, l.blockHeight = 1, 1
+	img := drawImage(data, l, opts)
+
+	width, height := l.size()
+	bw := bufio.NewWriter(w)
+	for y := 0; y < height; y += 2 {
+		for x := 0; x < width; x++ {
+			top := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			fmt.Fprintf(bw, "\x1b[38;2;%d;%d;%dm", top.R, top.G, top.B)
+			if y+1 < height {
+				bottom := color.NRGBAModel.Convert(img.At(x, y+1)).(color.NRGBA)
+				fmt.Fprintf(bw, "\x1b[48;2;%d;%d;%dm", bottom.R, bottom.G, bottom.B)
+			} else {
+				bw.WriteString("\x1b[49m")
+			}
+			bw.WriteString("▀")
+		}
+		bw.WriteString("\x1b[0m\n")
+	}
+	return bw.Flush()
+}